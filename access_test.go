@@ -0,0 +1,82 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestAccessFor(t *testing.T) {
+	grant := func(access ...string) UserAccess {
+		return UserAccess{Access: access}
+	}
+	repos := map[string]*RepoConfig{
+		"implicit-public": {Users: map[string]UserAccess{
+			"nobody": grant("web", "git-upload-pack"),
+		}},
+		"implicit-private": {Users: map[string]UserAccess{
+			"nobody": grant("git-upload-pack"),
+			"alice":  grant("web", "git-receive-pack"),
+		}},
+		"private": {Visibility: VisibilityPrivate, Users: map[string]UserAccess{
+			"nobody": grant("web"),
+		}},
+		"internal": {Visibility: VisibilityInternal},
+		"public": {Visibility: VisibilityPublic, Users: map[string]UserAccess{
+			"nobody": grant("web", "git-receive-pack"),
+		}},
+		"groups": {
+			Users:  map[string]UserAccess{"alice": grant("web")},
+			Groups: map[string]UserAccess{"devs": grant("web", "git-receive-pack")},
+		},
+	}
+	gs := newTestServer(&Config{
+		Users: map[string]*User{
+			"alice": {},
+			"bob":   {Groups: []string{"devs"}},
+		},
+		Repos: repos,
+	}, nil)
+
+	tests := []struct {
+		repo, user, access string
+	}{
+		{"implicit-public", "nobody", "git-upload-pack,web"},
+		{"implicit-public", "alice", "git-upload-pack,web"},
+		{"implicit-private", "nobody", ""},
+		{"implicit-private", "alice", "git-receive-pack,web"},
+		{"private", "nobody", ""},
+		{"private", "alice", ""},
+		{"internal", "nobody", ""},
+		{"internal", "alice", "git-upload-pack,web"},
+		{"public", "nobody", "git-receive-pack,git-upload-pack,web"},
+		// grants to nobody aren't extended to everyone who logs in
+		{"public", "bob", "git-upload-pack,web"},
+		{"groups", "alice", "web"},
+		{"groups", "bob", "git-receive-pack,web"},
+	}
+	for _, test := range tests {
+		access := gs.accessFor(repos[test.repo], test.user, nil)
+		sort.Strings(access)
+		if got := strings.Join(access, ","); got != test.access {
+			t.Errorf("%s as %s: got %q, want %q", test.repo, test.user, got, test.access)
+		}
+	}
+}
+
+func TestVisibilityMatchesAccess(t *testing.T) {
+	repos := map[string]*RepoConfig{
+		"a": {Users: map[string]UserAccess{"nobody": {Access: []string{"web"}}}},
+		"b": {Users: map[string]UserAccess{"nobody": {Access: []string{"git-upload-pack"}}}},
+		"c": {Visibility: VisibilityPrivate, Users: map[string]UserAccess{"nobody": {Access: []string{"web"}}}},
+		"d": {Visibility: VisibilityPublic},
+		"e": {Visibility: VisibilityInternal},
+	}
+	gs := newTestServer(&Config{Repos: repos}, nil)
+	for name, rc := range repos {
+		public := rc.meta(name).Visibility == VisibilityPublic
+		if anon := len(gs.accessFor(rc, "nobody", nil)) > 0; anon != public {
+			t.Errorf("%s: shown as %s, but anonymous access is %v", name, rc.visibility(), anon)
+		}
+	}
+}
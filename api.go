@@ -0,0 +1,682 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// apiViews are the endpoints available below /api/v1/repos/<repo>/.
+var apiViews = []view{
+	{"refs", true},
+	{"head", true},
+	{"tree", false},
+	{"blob", false},
+	{"commit", false},
+	{"hooks", false},
+	{"mirrors", true},
+}
+
+// apiMaxContent is the largest blob whose contents are inlined in a blob
+// response; larger blobs have to be fetched with ?raw=1.
+const apiMaxContent = 1 << 20
+
+type apiRepo struct {
+	Path        string   `json:"path"`
+	Head        string   `json:"head,omitempty"`
+	Access      []string `json:"access"`
+	Description string   `json:"description,omitempty"`
+	Topics      []string `json:"topics,omitempty"`
+	Homepage    string   `json:"homepage,omitempty"`
+	Visibility  string   `json:"visibility"`
+}
+
+func newAPIRepo(m RepoMeta, access []string) apiRepo {
+	return apiRepo{
+		Path:        m.Path,
+		Access:      access,
+		Description: m.Description,
+		Topics:      m.Topics,
+		Homepage:    m.Homepage,
+		Visibility:  m.Visibility,
+	}
+}
+
+type apiSignature struct {
+	Name  string    `json:"name"`
+	Email string    `json:"email"`
+	Date  time.Time `json:"date"`
+}
+
+type apiBranch struct {
+	Name   string `json:"name"`
+	Commit string `json:"commit"`
+}
+
+type apiTag struct {
+	Name    string        `json:"name"`
+	Commit  string        `json:"commit"`
+	Message string        `json:"message,omitempty"`
+	Tagger  *apiSignature `json:"tagger,omitempty"`
+}
+
+type apiRefs struct {
+	Head     string      `json:"head"`
+	Branches []apiBranch `json:"branches"`
+	Tags     []apiTag    `json:"tags"`
+}
+
+type apiTreeEntry struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+	Type string `json:"type"`
+	Mode string `json:"mode"`
+	Hash string `json:"hash"`
+}
+
+type apiTree struct {
+	Ref     string         `json:"ref"`
+	Commit  string         `json:"commit"`
+	Path    string         `json:"path"`
+	Hash    string         `json:"hash"`
+	Entries []apiTreeEntry `json:"entries"`
+}
+
+type apiBlob struct {
+	Ref       string `json:"ref"`
+	Commit    string `json:"commit"`
+	Path      string `json:"path"`
+	Hash      string `json:"hash"`
+	Mode      string `json:"mode"`
+	Size      int64  `json:"size"`
+	Encoding  string `json:"encoding,omitempty"`
+	Content   string `json:"content,omitempty"`
+	Truncated bool   `json:"truncated,omitempty"`
+}
+
+type apiFileStat struct {
+	Path      string `json:"path"`
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+}
+
+type apiCommit struct {
+	Hash      string        `json:"hash"`
+	Tree      string        `json:"tree"`
+	Parents   []string      `json:"parents"`
+	Author    apiSignature  `json:"author"`
+	Committer apiSignature  `json:"committer"`
+	Message   string        `json:"message"`
+	Stats     []apiFileStat `json:"stats"`
+}
+
+func apiSig(s object.Signature) apiSignature {
+	return apiSignature{
+		Name:  s.Name,
+		Email: s.Email,
+		Date:  s.When,
+	}
+}
+
+func apiJSON(rw http.ResponseWriter, code int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	enc := json.NewEncoder(rw)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(v)
+	if err != nil {
+		log.Println("api encode error", err)
+	}
+}
+
+func apiError(rw http.ResponseWriter, code int, msg string) {
+	if code == 401 {
+		rw.Header().Set("WWW-Authenticate", "Basic")
+	}
+	apiJSON(rw, code, struct {
+		Error string `json:"error"`
+	}{msg})
+}
+
+// accessFor returns the access rc grants user, either directly, through one
+// of their groups or by the repo's visibility. claimed are groups the
+// request's OIDC login claims, on top of those in the config. Grants to
+// nobody are only for anonymous users; logged in users get a public repo's
+// access through its visibility.
+func (g *gitServe) accessFor(rc *RepoConfig, user string, claimed []string) []string {
+	if rc == nil {
+		return nil
+	}
+	vis := rc.visibility()
+	anon := rc.Users["nobody"].Access
+	if vis != VisibilityPublic {
+		// only public repos can be used anonymously, whatever nobody is granted
+		anon = nil
+	}
+	access := []string{}
+	if user == "nobody" {
+		access = append(access, anon...)
+	} else {
+		access = append(access, rc.Users[user].Access...)
+	}
+	add := func(grant []string) {
+		for _, a := range grant {
+			found := false
+			for _, b := range access {
+				if a == b {
+					found = true
+					break
+				}
+			}
+			if !found {
+				access = append(access, a)
+			}
+		}
+	}
+	switch vis {
+	case VisibilityPublic:
+		add(visibilityAccess)
+	case VisibilityInternal:
+		if user != "nobody" {
+			add(visibilityAccess)
+		}
+	}
+	if user != "nobody" {
+		for _, group := range g.groupsOf(user) {
+			add(rc.Groups[group].Access)
+		}
+		for _, group := range claimed {
+			add(rc.Groups[group].Access)
+		}
+	}
+	return access
+}
+
+func (g *gitServe) hasAccess(rc *RepoConfig, user string, claimed []string, access string) bool {
+	for _, a := range g.accessFor(rc, user, claimed) {
+		if a == access {
+			return true
+		}
+	}
+	return false
+}
+
+// splitRef splits "<ref>/<path>" as used by the blob and tree endpoints,
+// defaulting to HEAD when no ref is given.
+func splitRef(r *git.Repository, rest string) (ref string, p string) {
+	names, err := refNames(r)
+	if err != nil {
+		log.Println(err)
+	}
+	ref, p = splitRefPath(names, rest)
+	p = strings.Trim(p, "/")
+	if ref == "" {
+		ref = "HEAD"
+	}
+	return ref, p
+}
+
+func (g *gitServe) api(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	rw := &metricsWriter{ResponseWriter: w, code: 200}
+	service := "api"
+	defer func() {
+		metrics.observeRequest(service, rw.code, start)
+	}()
+
+	user, groups, ok := g.authenticate(req)
+	if !ok {
+		apiError(rw, 401, "unauthorized")
+		return
+	}
+
+	p := strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/v1"), "/")
+	if p == "repos" {
+		g.apiRepos(user, groups, rw, req)
+		return
+	}
+	if p == "audit" {
+		g.apiAudit(user, rw, req)
+		return
+	}
+	if p == "search" {
+		service = "api/search"
+		results, err := g.Search(user, groups, strings.TrimSpace(req.FormValue("q")), req.FormValue("repo"))
+		if err != nil {
+			apiError(rw, 400, err.Error())
+			return
+		}
+		apiJSON(rw, 200, results)
+		return
+	}
+	if !strings.HasPrefix(p, "repos/") {
+		apiError(rw, 404, "not found")
+		return
+	}
+
+	repo, view, rest := splitView(strings.TrimPrefix(p, "repos/"), apiViews)
+	service = "api/" + view
+	if view == "" {
+		service = "api/repo"
+	}
+	ep := &transport.Endpoint{
+		User:     user,
+		Password: "web",
+		Path:     repo,
+	}
+	if view == "head" && req.Method != http.MethodGet || view == "hooks" || view == "mirrors" {
+		ep.Password = "admin"
+	}
+	log.Println("api/"+view, repo)
+
+	ld := loader{gs: g, groups: groups}
+	r, err := ld.openRepo(ep)
+	if err != nil {
+		apiError(rw, 401, "unauthorized")
+		return
+	}
+
+	switch view {
+	case "":
+		g.apiRepo(r, ep, groups, rw, req)
+	case "refs":
+		g.apiRefs(r, rw, req)
+	case "head":
+		g.apiHead(r, ep, rw, req)
+	case "tree":
+		g.apiTree(r, rest, rw, req)
+	case "blob":
+		g.apiBlob(r, rest, rw, req)
+	case "commit":
+		g.apiCommit(r, rest, rw, req)
+	case "hooks":
+		g.apiHooks(ep, rest, rw, req)
+	case "mirrors":
+		apiJSON(rw, 200, struct {
+			Pull *MirrorStatus      `json:"pull,omitempty"`
+			Push []PushMirrorStatus `json:"push"`
+		}{g.MirrorStatus(repo), g.PushMirrorStatus(repo)})
+	}
+}
+
+func (g *gitServe) apiRepos(user string, groups []string, rw http.ResponseWriter, req *http.Request) {
+	c := g.getConfig()
+	q := req.FormValue("q")
+	topic := req.FormValue("topic")
+	visibility := req.FormValue("visibility")
+	repos := []apiRepo{}
+	for name, rc := range c.Repos {
+		if !g.hasAccess(rc, user, groups, "web") {
+			continue
+		}
+		m := rc.meta(name)
+		if !m.matches(q, topic, visibility) {
+			continue
+		}
+		repos = append(repos, newAPIRepo(m, g.accessFor(rc, user, groups)))
+	}
+	sort.Slice(repos, func(i, j int) bool {
+		return repos[i].Path < repos[j].Path
+	})
+	apiJSON(rw, 200, repos)
+}
+
+func (g *gitServe) apiRepo(r *git.Repository, ep *transport.Endpoint, groups []string, rw http.ResponseWriter, req *http.Request) {
+	rc := g.getConfig().Repos[ep.Path]
+	ar := newAPIRepo(rc.meta(ep.Path), g.accessFor(rc, ep.User, groups))
+	head, err := r.Storer.Reference(plumbing.HEAD)
+	if err == nil {
+		ar.Head = headName(head)
+	}
+	apiJSON(rw, 200, ar)
+}
+
+func (g *gitServe) apiRefs(r *git.Repository, rw http.ResponseWriter, req *http.Request) {
+	ri, err := g.repoInfo(r)
+	if err != nil {
+		apiError(rw, 500, err.Error())
+		return
+	}
+	refs := apiRefs{
+		Head:     ri.Head,
+		Branches: []apiBranch{},
+		Tags:     []apiTag{},
+	}
+	biter, err := r.Branches()
+	if err != nil {
+		apiError(rw, 500, err.Error())
+		return
+	}
+	err = biter.ForEach(func(ref *plumbing.Reference) error {
+		refs.Branches = append(refs.Branches, apiBranch{
+			Name:   ref.Name().Short(),
+			Commit: ref.Hash().String(),
+		})
+		return nil
+	})
+	if err != nil {
+		apiError(rw, 500, err.Error())
+		return
+	}
+	for _, t := range ri.Tags {
+		at := apiTag{
+			Name:   t.Name,
+			Commit: t.Commit,
+		}
+		if t.Annotated {
+			at.Message = t.Message
+			sig := apiSig(t.Tagger)
+			at.Tagger = &sig
+		}
+		refs.Tags = append(refs.Tags, at)
+	}
+	apiJSON(rw, 200, refs)
+}
+
+func (g *gitServe) apiHead(r *git.Repository, ep *transport.Endpoint, rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		body := struct {
+			Ref string `json:"ref"`
+		}{}
+		err := json.NewDecoder(req.Body).Decode(&body)
+		if err != nil {
+			apiError(rw, 400, err.Error())
+			return
+		}
+		err = g.SetHead(r, body.Ref)
+		g.audit(req, &AuditEvent{
+			Action:  "set-head",
+			User:    ep.User,
+			Repo:    ep.Path,
+			Success: err == nil,
+			Detail:  body.Ref,
+		})
+		if err != nil {
+			apiError(rw, 400, err.Error())
+			return
+		}
+	}
+	head, err := r.Storer.Reference(plumbing.HEAD)
+	if err != nil {
+		apiError(rw, 404, err.Error())
+		return
+	}
+	apiJSON(rw, 200, struct {
+		Head string `json:"head"`
+	}{headName(head)})
+}
+
+func (g *gitServe) apiTree(r *git.Repository, rest string, rw http.ResponseWriter, req *http.Request) {
+	ref, p := splitRef(r, rest)
+	c, err := resolveCommit(r, ref)
+	if err != nil {
+		apiError(rw, 404, err.Error())
+		return
+	}
+	tree, err := c.Tree()
+	if err != nil {
+		apiError(rw, 500, err.Error())
+		return
+	}
+	if p != "" {
+		tree, err = tree.Tree(p)
+		if err != nil {
+			apiError(rw, 404, err.Error())
+			return
+		}
+	}
+	at := apiTree{
+		Ref:     ref,
+		Commit:  c.Hash.String(),
+		Path:    p,
+		Hash:    tree.Hash.String(),
+		Entries: []apiTreeEntry{},
+	}
+	for _, e := range tree.Entries {
+		t := "blob"
+		switch e.Mode {
+		case filemode.Dir:
+			t = "tree"
+		case filemode.Submodule:
+			t = "commit"
+		}
+		at.Entries = append(at.Entries, apiTreeEntry{
+			Name: e.Name,
+			Path: path.Join(p, e.Name),
+			Type: t,
+			Mode: e.Mode.String(),
+			Hash: e.Hash.String(),
+		})
+	}
+	apiJSON(rw, 200, at)
+}
+
+func (g *gitServe) apiBlob(r *git.Repository, rest string, rw http.ResponseWriter, req *http.Request) {
+	ref, p := splitRef(r, rest)
+	c, err := resolveCommit(r, ref)
+	if err != nil {
+		apiError(rw, 404, err.Error())
+		return
+	}
+	tree, err := c.Tree()
+	if err != nil {
+		apiError(rw, 500, err.Error())
+		return
+	}
+	e, err := tree.FindEntry(p)
+	if err != nil {
+		apiError(rw, 404, err.Error())
+		return
+	}
+	if !e.Mode.IsFile() {
+		apiError(rw, 400, p+" is not a file")
+		return
+	}
+	b, err := r.BlobObject(e.Hash)
+	if err != nil {
+		apiError(rw, 500, err.Error())
+		return
+	}
+	rc, err := b.Reader()
+	if err != nil {
+		apiError(rw, 500, err.Error())
+		return
+	}
+	defer rc.Close()
+
+	if req.FormValue("raw") != "" {
+		rw.Header().Set("Content-Type", "application/octet-stream")
+		io.Copy(rw, rc)
+		return
+	}
+
+	ab := apiBlob{
+		Ref:    ref,
+		Commit: c.Hash.String(),
+		Path:   p,
+		Hash:   b.Hash.String(),
+		Mode:   e.Mode.String(),
+		Size:   b.Size,
+	}
+	if b.Size > apiMaxContent {
+		ab.Truncated = true
+		apiJSON(rw, 200, ab)
+		return
+	}
+	buf := &strings.Builder{}
+	_, err = io.Copy(buf, rc)
+	if err != nil {
+		apiError(rw, 500, err.Error())
+		return
+	}
+	if utf8.ValidString(buf.String()) {
+		ab.Encoding = "utf-8"
+		ab.Content = buf.String()
+	} else {
+		ab.Encoding = "base64"
+		ab.Content = base64.StdEncoding.EncodeToString([]byte(buf.String()))
+	}
+	apiJSON(rw, 200, ab)
+}
+
+func (g *gitServe) apiCommit(r *git.Repository, rest string, rw http.ResponseWriter, req *http.Request) {
+	rev := strings.Trim(rest, "/")
+	if rev == "" {
+		rev = "HEAD"
+	}
+	c, err := resolveCommit(r, rev)
+	if err != nil {
+		apiError(rw, 404, err.Error())
+		return
+	}
+	ac := apiCommit{
+		Hash:      c.Hash.String(),
+		Tree:      c.TreeHash.String(),
+		Parents:   []string{},
+		Author:    apiSig(c.Author),
+		Committer: apiSig(c.Committer),
+		Message:   c.Message,
+		Stats:     []apiFileStat{},
+	}
+	for _, p := range c.ParentHashes {
+		ac.Parents = append(ac.Parents, p.String())
+	}
+	stats, err := c.StatsContext(req.Context())
+	if err != nil {
+		apiError(rw, 500, err.Error())
+		return
+	}
+	for _, s := range stats {
+		ac.Stats = append(ac.Stats, apiFileStat{
+			Path:      s.Name,
+			Additions: s.Addition,
+			Deletions: s.Deletion,
+		})
+	}
+	apiJSON(rw, 200, ac)
+}
+
+// apiHooks serves the webhook delivery log:
+//
+//	GET  hooks                 list deliveries, newest first: up to limit
+//	                           (default 20) older than the one with ID before
+//	GET  hooks/<id>            a single delivery
+//	POST hooks/<id>/redeliver  send a delivery's payload again
+func (g *gitServe) apiHooks(ep *transport.Endpoint, rest string, rw http.ResponseWriter, req *http.Request) {
+	repo := ep.Path
+	parts := strings.Split(strings.Trim(rest, "/"), "/")
+	switch {
+	case parts[0] == "" && req.Method == http.MethodGet:
+		limit := 20
+		if v := req.FormValue("limit"); v != "" {
+			var err error
+			limit, err = strconv.Atoi(v)
+			if err != nil || limit < 1 {
+				apiError(rw, 400, "bad limit "+v)
+				return
+			}
+		}
+		if limit > deliveriesMax {
+			limit = deliveriesMax
+		}
+		ds, err := g.listDeliveries(repo, req.FormValue("before"), limit)
+		if err != nil {
+			apiError(rw, 500, err.Error())
+			return
+		}
+		apiJSON(rw, 200, ds)
+	case len(parts) == 1 && req.Method == http.MethodGet:
+		d, err := g.loadDelivery(repo, parts[0])
+		if err != nil {
+			apiError(rw, 404, err.Error())
+			return
+		}
+		apiJSON(rw, 200, d)
+	case len(parts) == 2 && parts[1] == "redeliver" && req.Method == http.MethodPost:
+		d, err := g.redeliver(repo, parts[0])
+		g.audit(req, &AuditEvent{
+			Action:  "webhook-redeliver",
+			User:    ep.User,
+			Repo:    repo,
+			Success: err == nil,
+			Detail:  parts[0],
+		})
+		if err != nil {
+			apiError(rw, 400, err.Error())
+			return
+		}
+		apiJSON(rw, 202, d)
+	default:
+		apiError(rw, 404, "not found")
+	}
+}
+
+// auditMaxLimit is the most audit events one query returns.
+const auditMaxLimit = 1000
+
+// apiAudit queries the audit log. Only admin users may use it.
+func (g *gitServe) apiAudit(user string, rw http.ResponseWriter, req *http.Request) {
+	if user == "nobody" {
+		apiError(rw, 401, "unauthorized")
+		return
+	}
+	u := g.getConfig().Users[user]
+	if u == nil || !u.Admin {
+		apiError(rw, 403, "forbidden")
+		return
+	}
+	q := &AuditQuery{
+		User:   req.FormValue("user"),
+		Repo:   req.FormValue("repo"),
+		Action: req.FormValue("action"),
+		Limit:  100,
+	}
+	var err error
+	if v := req.FormValue("since"); v != "" {
+		q.Since, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			apiError(rw, 400, err.Error())
+			return
+		}
+	}
+	if v := req.FormValue("until"); v != "" {
+		q.Until, err = time.Parse(time.RFC3339, v)
+		if err != nil {
+			apiError(rw, 400, err.Error())
+			return
+		}
+	}
+	if v := req.FormValue("limit"); v != "" {
+		q.Limit, err = strconv.Atoi(v)
+		if err != nil || q.Limit < 1 {
+			apiError(rw, 400, "bad limit "+v)
+			return
+		}
+	}
+	if q.Limit > auditMaxLimit {
+		q.Limit = auditMaxLimit
+	}
+	events, err := g.auditLog.Query(q)
+	if err != nil {
+		apiError(rw, 500, err.Error())
+		return
+	}
+	if events == nil {
+		events = []*AuditEvent{}
+	}
+	apiJSON(rw, 200, events)
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+func apiTestServer(t *testing.T) (*gitServe, *testRepo) {
+	tr := newTestRepo(t)
+	first := tr.commit("first", map[string]string{"a.txt": "one\n"})
+	second := tr.commit("second\n\nbody", map[string]string{
+		"a.txt":    "one\ntwo\n",
+		"bin":      "\xff\x00\xfe",
+		"dir/b.go": "package b\n",
+	}, first)
+	tr.branch("master", second)
+	tr.annotatedTag("v1", first, "release one")
+	gs := newTestServer(&Config{
+		Users: map[string]*User{"alice": testUser(t, "pw")},
+		Repos: map[string]*RepoConfig{
+			"repo": {Users: public, Description: "the repo", Topics: []string{"go"}},
+			"private": {Users: map[string]UserAccess{
+				"alice": {Access: []string{"web", "admin"}},
+			}},
+		},
+	}, map[string]*testRepo{"repo": tr, "private": tr})
+	gs.s3, _ = newFakeS3(t)
+	return gs, tr
+}
+
+// apiGet fetches target from the API, decoding a 200 response into v.
+func apiGet(t *testing.T, gs *gitServe, target string, v interface{}, setup ...func(*http.Request)) int {
+	rr := get(http.HandlerFunc(gs.api), target, setup...)
+	if rr.Code == 200 && v != nil {
+		err := json.Unmarshal(rr.Body.Bytes(), v)
+		if err != nil {
+			t.Fatalf("%s: %v", target, err)
+		}
+	}
+	return rr.Code
+}
+
+func TestAPIRepos(t *testing.T) {
+	gs, _ := apiTestServer(t)
+
+	var repos []apiRepo
+	apiGet(t, gs, "/api/v1/repos", &repos)
+	if len(repos) != 1 || repos[0].Path != "repo" || repos[0].Description != "the repo" || repos[0].Visibility != "public" {
+		t.Errorf("anonymous: got %+v", repos)
+	}
+	apiGet(t, gs, "/api/v1/repos", &repos, basicAuth("alice", "pw"))
+	if len(repos) != 2 || repos[0].Path != "private" {
+		t.Errorf("alice: got %+v", repos)
+	}
+	apiGet(t, gs, "/api/v1/repos?topic=go", &repos, basicAuth("alice", "pw"))
+	if len(repos) != 1 || repos[0].Path != "repo" {
+		t.Errorf("topic: got %+v", repos)
+	}
+
+	var repo apiRepo
+	apiGet(t, gs, "/api/v1/repos/repo", &repo)
+	if repo.Head != "refs/heads/master" || !reflect.DeepEqual(repo.Access, []string{"web", "git-upload-pack"}) {
+		t.Errorf("repo: got %+v", repo)
+	}
+}
+
+func TestAPIAccess(t *testing.T) {
+	gs, _ := apiTestServer(t)
+	tests := []struct {
+		target string
+		alice  bool
+		code   int
+	}{
+		{"/api/v1/repos/private", false, 401},
+		{"/api/v1/repos/private", true, 200},
+		{"/api/v1/repos/missing", true, 401},
+		// hooks and mirrors need admin access
+		{"/api/v1/repos/repo/mirrors", false, 401},
+		{"/api/v1/repos/private/mirrors", true, 200},
+		{"/api/v1/other", false, 404},
+	}
+	for _, test := range tests {
+		var setup []func(*http.Request)
+		if test.alice {
+			setup = append(setup, basicAuth("alice", "pw"))
+		}
+		if code := apiGet(t, gs, test.target, nil, setup...); code != test.code {
+			t.Errorf("%s (alice %v): got %d, want %d", test.target, test.alice, code, test.code)
+		}
+	}
+	if code := apiGet(t, gs, "/api/v1/repos", nil, basicAuth("alice", "wrong")); code != 401 {
+		t.Errorf("wrong password: got %d", code)
+	}
+}
+
+func TestAPIRefs(t *testing.T) {
+	gs, tr := apiTestServer(t)
+	var refs apiRefs
+	apiGet(t, gs, "/api/v1/repos/repo/refs", &refs)
+	master, _ := tr.r.Reference("refs/heads/master", true)
+	if refs.Head != "master" || len(refs.Branches) != 1 || refs.Branches[0].Commit != master.Hash().String() {
+		t.Errorf("got %+v", refs)
+	}
+	if len(refs.Tags) != 1 || refs.Tags[0].Name != "v1" || refs.Tags[0].Message != "release one" || refs.Tags[0].Tagger == nil {
+		t.Errorf("tags: got %+v", refs.Tags)
+	}
+}
+
+func TestAPITreeAndBlob(t *testing.T) {
+	gs, _ := apiTestServer(t)
+
+	var tree apiTree
+	apiGet(t, gs, "/api/v1/repos/repo/tree/master", &tree)
+	types := map[string]string{}
+	for _, e := range tree.Entries {
+		types[e.Path] = e.Type
+	}
+	if want := map[string]string{"a.txt": "blob", "bin": "blob", "dir": "tree"}; !reflect.DeepEqual(types, want) {
+		t.Errorf("tree: got %v", types)
+	}
+
+	var blob apiBlob
+	apiGet(t, gs, "/api/v1/repos/repo/blob/master/a.txt", &blob)
+	if blob.Encoding != "utf-8" || blob.Content != "one\ntwo\n" || blob.Size != 8 {
+		t.Errorf("text blob: got %+v", blob)
+	}
+	apiGet(t, gs, "/api/v1/repos/repo/blob/v1/a.txt", &blob)
+	if blob.Content != "one\n" {
+		t.Errorf("blob at tag: got %+v", blob)
+	}
+	apiGet(t, gs, "/api/v1/repos/repo/blob/master/bin", &blob)
+	if blob.Encoding != "base64" || blob.Content != base64.StdEncoding.EncodeToString([]byte("\xff\x00\xfe")) {
+		t.Errorf("binary blob: got %+v", blob)
+	}
+	rr := get(http.HandlerFunc(gs.api), "/api/v1/repos/repo/blob/master/bin?raw=1")
+	if rr.Code != 200 || rr.Body.String() != "\xff\x00\xfe" {
+		t.Errorf("raw blob: got %d %q", rr.Code, rr.Body)
+	}
+
+	for target, code := range map[string]int{
+		"/api/v1/repos/repo/blob/master/dir":     400,
+		"/api/v1/repos/repo/blob/master/missing": 404,
+		"/api/v1/repos/repo/tree/nope":           404,
+	} {
+		if got := apiGet(t, gs, target, nil); got != code {
+			t.Errorf("%s: got %d, want %d", target, got, code)
+		}
+	}
+}
+
+func TestAPICommit(t *testing.T) {
+	gs, tr := apiTestServer(t)
+	var c apiCommit
+	apiGet(t, gs, "/api/v1/repos/repo/commit/master", &c)
+	first, _ := tr.r.ResolveRevision("master~1")
+	if c.Message != "second\n\nbody" || len(c.Parents) != 1 || c.Parents[0] != first.String() {
+		t.Errorf("got %+v", c)
+	}
+	stats := map[string][2]int{}
+	for _, s := range c.Stats {
+		stats[s.Path] = [2]int{s.Additions, s.Deletions}
+	}
+	if stats["a.txt"] != [2]int{1, 0} || stats["dir/b.go"] != [2]int{1, 0} {
+		t.Errorf("stats: got %v", stats)
+	}
+	if code := apiGet(t, gs, "/api/v1/repos/repo/commit/nope", nil); code != 404 {
+		t.Errorf("unknown commit: got %d", code)
+	}
+}
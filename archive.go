@@ -0,0 +1,324 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/sideband"
+)
+
+// archiveFormats maps the suffixes accepted on /repo/archive/<ref>.<suffix>
+// to the format names understood by writeArchive.
+var archiveFormats = []struct {
+	Suffix string
+	Format string
+	Type   string
+}{
+	{".tar.gz", "tgz", "application/gzip"},
+	{".tgz", "tgz", "application/gzip"},
+	{".tar", "tar", "application/x-tar"},
+	{".zip", "zip", "application/zip"},
+}
+
+// splitArchiveName splits "v1.0.tar.gz" into the ref "v1.0" and the archive
+// format, returning ok false for unknown suffixes.
+func splitArchiveName(name string) (ref string, format string, contentType string, ok bool) {
+	for _, af := range archiveFormats {
+		if strings.HasSuffix(name, af.Suffix) {
+			return strings.TrimSuffix(name, af.Suffix), af.Format, af.Type, true
+		}
+	}
+	return "", "", "", false
+}
+
+// archivePrefix builds the directory every archive entry is placed under,
+// e.g. "gitserve-v1.0/" for the repo "andyleap/gitserve" at "v1.0".
+func archivePrefix(repo string, ref string) string {
+	name := path.Base(repo) + "-" + strings.Replace(ref, "/", "-", -1)
+	return name + "/"
+}
+
+// writeArchive streams the contents of tree to w as a tar, tgz or zip archive.
+// Every entry is placed under prefix, and only entries at or below one of
+// paths are included when paths is non-empty.
+func writeArchive(w io.Writer, format string, prefix string, repo *git.Repository, tree *object.Tree, mtime time.Time, paths []string) error {
+	switch format {
+	case "tar":
+		return writeTar(w, prefix, repo, tree, mtime, paths)
+	case "tgz", "tar.gz":
+		gw := gzip.NewWriter(w)
+		err := writeTar(gw, prefix, repo, tree, mtime, paths)
+		if err != nil {
+			return err
+		}
+		return gw.Close()
+	case "zip":
+		return writeZip(w, prefix, repo, tree, mtime, paths)
+	}
+	return fmt.Errorf("Unknown archive format %q", format)
+}
+
+func archiveIncludes(name string, paths []string) bool {
+	if len(paths) == 0 {
+		return true
+	}
+	for _, p := range paths {
+		p = strings.Trim(p, "/")
+		if p == "" || name == p || strings.HasPrefix(name, p+"/") || strings.HasPrefix(p, name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func walkArchive(tree *object.Tree, paths []string, cb func(name string, e object.TreeEntry) error) error {
+	tw := object.NewTreeWalker(tree, true, nil)
+	defer tw.Close()
+	for {
+		name, e, err := tw.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !archiveIncludes(name, paths) {
+			continue
+		}
+		err = cb(name, e)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func blobContents(r *git.Repository, e object.TreeEntry) (io.ReadCloser, int64, error) {
+	b, err := r.BlobObject(e.Hash)
+	if err != nil {
+		return nil, 0, err
+	}
+	rc, err := b.Reader()
+	if err != nil {
+		return nil, 0, err
+	}
+	return rc, b.Size, nil
+}
+
+func writeTar(w io.Writer, prefix string, repo *git.Repository, tree *object.Tree, mtime time.Time, paths []string) error {
+	tw := tar.NewWriter(w)
+	if prefix != "" {
+		err := tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     prefix,
+			Mode:     0755,
+			ModTime:  mtime,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	err := walkArchive(tree, paths, func(name string, e object.TreeEntry) error {
+		hdr := &tar.Header{
+			Name:    prefix + name,
+			ModTime: mtime,
+		}
+		switch e.Mode {
+		case filemode.Dir, filemode.Submodule:
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+			hdr.Mode = 0755
+			return tw.WriteHeader(hdr)
+		case filemode.Symlink:
+			r, _, err := blobContents(repo, e)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+			target, err := readAllString(r)
+			if err != nil {
+				return err
+			}
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = target
+			hdr.Mode = 0777
+			return tw.WriteHeader(hdr)
+		}
+		r, size, err := blobContents(repo, e)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = size
+		hdr.Mode = 0644
+		if e.Mode == filemode.Executable {
+			hdr.Mode = 0755
+		}
+		err = tw.WriteHeader(hdr)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, r)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func writeZip(w io.Writer, prefix string, repo *git.Repository, tree *object.Tree, mtime time.Time, paths []string) error {
+	zw := zip.NewWriter(w)
+	if prefix != "" {
+		dir := &zip.FileHeader{Name: prefix, Modified: mtime}
+		dir.SetMode(os.ModeDir | 0755)
+		_, err := zw.CreateHeader(dir)
+		if err != nil {
+			return err
+		}
+	}
+	err := walkArchive(tree, paths, func(name string, e object.TreeEntry) error {
+		hdr := &zip.FileHeader{
+			Name:     prefix + name,
+			Modified: mtime,
+		}
+		switch e.Mode {
+		case filemode.Dir, filemode.Submodule:
+			hdr.Name += "/"
+			hdr.SetMode(os.ModeDir | 0755)
+			_, err := zw.CreateHeader(hdr)
+			return err
+		case filemode.Symlink:
+			hdr.SetMode(os.ModeSymlink | 0777)
+		case filemode.Executable:
+			hdr.Method = zip.Deflate
+			hdr.SetMode(0755)
+		default:
+			hdr.Method = zip.Deflate
+			hdr.SetMode(0644)
+		}
+		r, _, err := blobContents(repo, e)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		fw, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(fw, r)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+func readAllString(r io.Reader) (string, error) {
+	buf := &strings.Builder{}
+	_, err := io.Copy(buf, r)
+	return buf.String(), err
+}
+
+// uploadArchive speaks the server side of git-upload-archive, which is what
+// `git archive --remote` talks to. The client sends its command line as
+// "argument" pkt-lines, and the archive is returned over sideband 1.
+func (gs *gitServe) uploadArchive(r *git.Repository, rw http.ResponseWriter, req *http.Request) {
+	format := "tar"
+	prefix := ""
+	rev := ""
+	paths := []string{}
+
+	s := pktline.NewScanner(req.Body)
+	for s.Scan() {
+		line := strings.TrimSuffix(string(s.Bytes()), "\n")
+		if line == "" {
+			break
+		}
+		if !strings.HasPrefix(line, "argument ") {
+			http.Error(rw, "expected argument, got "+line, 400)
+			return
+		}
+		arg := strings.TrimPrefix(line, "argument ")
+		switch {
+		case strings.HasPrefix(arg, "--format="):
+			format = strings.TrimPrefix(arg, "--format=")
+		case strings.HasPrefix(arg, "--prefix="):
+			prefix = strings.TrimPrefix(arg, "--prefix=")
+		case strings.HasPrefix(arg, "-"):
+			// compression levels and other tweaks we don't support
+		case rev == "":
+			rev = arg
+		default:
+			paths = append(paths, arg)
+		}
+	}
+	if err := s.Err(); err != nil {
+		http.Error(rw, err.Error(), 400)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/x-git-upload-archive-result")
+	pl := pktline.NewEncoder(rw)
+
+	if rev == "" {
+		pl.EncodeString("NACK no tree-ish given\n")
+		pl.Flush()
+		return
+	}
+	c, err := resolveCommit(r, rev)
+	if err != nil {
+		pl.Encodef("NACK %s\n", err)
+		pl.Flush()
+		return
+	}
+	tree, err := c.Tree()
+	if err != nil {
+		pl.Encodef("NACK %s\n", err)
+		pl.Flush()
+		return
+	}
+	if format == "tar.gz" {
+		format = "tgz"
+	}
+	if format != "tar" && format != "tgz" && format != "zip" {
+		pl.Encodef("NACK unknown archive format '%s'\n", format)
+		pl.Flush()
+		return
+	}
+
+	pl.EncodeString("ACK\n")
+	pl.Flush()
+
+	mux := sideband.NewMuxer(sideband.Sideband64k, rw)
+	err = writeArchive(mux, format, prefix, r, tree, c.Committer.When, paths)
+	if err != nil {
+		log.Println("upload archive error", err)
+		mux.WriteChannel(sideband.ErrorMessage, []byte("fatal: "+err.Error()+"\n"))
+	}
+	pl.Flush()
+}
+
+// resolveCommit resolves rev to a commit, peeling annotated tags.
+func resolveCommit(r *git.Repository, rev string) (*object.Commit, error) {
+	h, err := r.ResolveRevision(plumbing.Revision(rev))
+	if err != nil {
+		return nil, err
+	}
+	return r.CommitObject(*h)
+}
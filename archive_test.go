@@ -0,0 +1,180 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing/format/pktline"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp/sideband"
+)
+
+func TestSplitArchiveName(t *testing.T) {
+	tests := []struct {
+		name   string
+		ref    string
+		format string
+		ok     bool
+	}{
+		{"v1.0.tar.gz", "v1.0", "tgz", true},
+		{"master.tgz", "master", "tgz", true},
+		{"feature/x.tar", "feature/x", "tar", true},
+		{"v2.zip", "v2", "zip", true},
+		{"v2.rar", "", "", false},
+	}
+	for _, test := range tests {
+		ref, format, _, ok := splitArchiveName(test.name)
+		if ref != test.ref || format != test.format || ok != test.ok {
+			t.Errorf("%s: got %q %q %v", test.name, ref, format, ok)
+		}
+	}
+	if got := archivePrefix("andyleap/gitserve", "feature/x"); got != "gitserve-feature-x/" {
+		t.Errorf("prefix: got %q", got)
+	}
+}
+
+// tarFiles reads a tar archive into a map of entry names to their contents,
+// or link targets for symlinks.
+func tarFiles(t *testing.T, r io.Reader) map[string]string {
+	files := map[string]string{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return files
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[hdr.Name] = string(b) + hdr.Linkname
+	}
+}
+
+func archiveTestServer(t *testing.T) *gitServe {
+	tr := newTestRepo(t)
+	c := tr.commit("init", map[string]string{
+		"README":     "hello",
+		"sub/a.txt":  "a",
+		"sub/link@":  "a.txt",
+		"other/b.go": "package b",
+	})
+	tr.branch("master", c)
+	tr.annotatedTag("v1", c, "release")
+	return newTestServer(&Config{Repos: map[string]*RepoConfig{
+		"repo":    {Users: public},
+		"private": {},
+	}}, map[string]*testRepo{"repo": tr, "private": tr})
+}
+
+func TestArchiveView(t *testing.T) {
+	gs := archiveTestServer(t)
+	h := http.HandlerFunc(gs.git)
+	want := map[string]string{
+		"repo-master/":           "",
+		"repo-master/README":     "hello",
+		"repo-master/other/":     "",
+		"repo-master/other/b.go": "package b",
+		"repo-master/sub/":       "",
+		"repo-master/sub/a.txt":  "a",
+		"repo-master/sub/link":   "a.txt",
+	}
+
+	rr := get(h, "/repo/archive/master.tar.gz")
+	if rr.Code != 200 || rr.Header().Get("Content-Type") != "application/gzip" {
+		t.Fatalf("tar.gz: got %d %q", rr.Code, rr.Header().Get("Content-Type"))
+	}
+	if cd := rr.Header().Get("Content-Disposition"); cd != `attachment; filename="repo-master.tar.gz"` {
+		t.Errorf("disposition: %s", cd)
+	}
+	zr, err := gzip.NewReader(rr.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tarFiles(t, zr); !reflect.DeepEqual(got, want) {
+		t.Errorf("tar.gz: got %v", got)
+	}
+
+	rr = get(h, "/repo/archive/v1.zip")
+	if rr.Code != 200 {
+		t.Fatalf("zip: got %d", rr.Code)
+	}
+	zf, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, f := range zf.File {
+		names = append(names, f.Name)
+		if f.Name == "repo-v1/sub/link" && f.Mode()&0777 != 0777 {
+			t.Errorf("symlink mode %v", f.Mode())
+		}
+	}
+	sort.Strings(names)
+	wantNames := []string{"repo-v1/", "repo-v1/README", "repo-v1/other/", "repo-v1/other/b.go", "repo-v1/sub/", "repo-v1/sub/a.txt", "repo-v1/sub/link"}
+	if !reflect.DeepEqual(names, wantNames) {
+		t.Errorf("zip: got %v", names)
+	}
+
+	for target, code := range map[string]int{
+		"/repo/archive/master.rar":    400,
+		"/repo/archive/missing.tar":   404,
+		"/private/archive/master.tar": 0,
+	} {
+		rr := get(h, target)
+		if code == 0 && rr.Code == 200 || code != 0 && rr.Code != code {
+			t.Errorf("%s: got %d", target, rr.Code)
+		}
+	}
+}
+
+func TestUploadArchive(t *testing.T) {
+	gs := archiveTestServer(t)
+	body := &bytes.Buffer{}
+	pl := pktline.NewEncoder(body)
+	for _, arg := range []string{"--format=tar", "--prefix=x/", "master", "sub"} {
+		pl.EncodeString("argument " + arg + "\n")
+	}
+	pl.Flush()
+
+	req := httptest.NewRequest("POST", "/repo/git-upload-archive", body)
+	rr := httptest.NewRecorder()
+	gs.git(rr, req)
+	if rr.Code != 200 {
+		t.Fatalf("got %d %s", rr.Code, rr.Body)
+	}
+	s := pktline.NewScanner(rr.Body)
+	if !s.Scan() || string(s.Bytes()) != "ACK\n" {
+		t.Fatalf("expected ACK, got %q", s.Bytes())
+	}
+	if !s.Scan() || len(s.Bytes()) != 0 {
+		t.Fatalf("expected flush, got %q", s.Bytes())
+	}
+	demux := sideband.NewDemuxer(sideband.Sideband64k, rr.Body)
+	got := tarFiles(t, demux)
+	want := map[string]string{"x/": "", "x/sub/": "", "x/sub/a.txt": "a", "x/sub/link": "a.txt"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v", got)
+	}
+
+	body.Reset()
+	pl.EncodeString("argument --format=rar\n", "argument master\n")
+	pl.Flush()
+	rr = httptest.NewRecorder()
+	gs.git(rr, httptest.NewRequest("POST", "/repo/git-upload-archive", body))
+	s = pktline.NewScanner(rr.Body)
+	if !s.Scan() || string(s.Bytes()) != "NACK unknown archive format 'rar'\n" {
+		t.Errorf("bad format: got %q", s.Bytes())
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/andyleap/go-s3"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+)
+
+// AuditEvent is a single entry in the audit trail.
+type AuditEvent struct {
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	User    string    `json:"user,omitempty"`
+	Repo    string    `json:"repo,omitempty"`
+	IP      string    `json:"ip,omitempty"`
+	Success bool      `json:"success"`
+	Refs    []PushRef `json:"refs,omitempty"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+// AuditQuery filters audit events. Zero fields match everything.
+type AuditQuery struct {
+	User   string
+	Repo   string
+	Action string
+	Since  time.Time
+	Until  time.Time
+	Limit  int
+}
+
+func (q *AuditQuery) matches(ev *AuditEvent) bool {
+	return (q.User == "" || q.User == ev.User) &&
+		(q.Repo == "" || q.Repo == ev.Repo) &&
+		(q.Action == "" || q.Action == ev.Action) &&
+		(q.Since.IsZero() || !ev.Time.Before(q.Since)) &&
+		(q.Until.IsZero() || ev.Time.Before(q.Until))
+}
+
+// auditStore is somewhere audit events can be appended to and read back
+// from. Events are never modified or removed.
+type auditStore interface {
+	Append(events []*AuditEvent) error
+	Query(q *AuditQuery) ([]*AuditEvent, error)
+}
+
+// auditLog buffers events and flushes them to the store in batches, so
+// recording an event never blocks a request on storage.
+type auditLog struct {
+	store auditStore
+
+	mu      sync.Mutex
+	pending []*AuditEvent
+}
+
+const auditFlushInterval = 5 * time.Second
+
+func newAuditLog(store auditStore) *auditLog {
+	al := &auditLog{store: store}
+	go func() {
+		for {
+			time.Sleep(auditFlushInterval)
+			al.Flush()
+		}
+	}()
+	return al
+}
+
+func (al *auditLog) Record(ev *AuditEvent) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now().UTC()
+	}
+	al.mu.Lock()
+	al.pending = append(al.pending, ev)
+	al.mu.Unlock()
+}
+
+// Flush writes out any buffered events. Events that fail to write are kept
+// for the next flush.
+func (al *auditLog) Flush() error {
+	al.mu.Lock()
+	events := al.pending
+	al.pending = nil
+	al.mu.Unlock()
+	if len(events) == 0 {
+		return nil
+	}
+	err := al.store.Append(events)
+	if err != nil {
+		log.Println("audit flush error", err)
+		al.mu.Lock()
+		al.pending = append(events, al.pending...)
+		al.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Query flushes pending events and then searches the store, newest first.
+func (al *auditLog) Query(q *AuditQuery) ([]*AuditEvent, error) {
+	al.Flush()
+	events, err := al.store.Query(q)
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.After(events[j].Time)
+	})
+	if q.Limit > 0 && len(events) > q.Limit {
+		events = events[:q.Limit]
+	}
+	return events, nil
+}
+
+func encodeAuditEvents(events []*AuditEvent) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+	for _, ev := range events {
+		err := enc.Encode(ev)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeAuditEvents(r io.Reader, q *AuditQuery, events []*AuditEvent) ([]*AuditEvent, error) {
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, 1<<20)
+	for s.Scan() {
+		ev := &AuditEvent{}
+		err := json.Unmarshal(s.Bytes(), ev)
+		if err != nil {
+			return nil, err
+		}
+		if q.matches(ev) {
+			events = append(events, ev)
+		}
+	}
+	return events, s.Err()
+}
+
+// fileAuditStore appends JSON lines to a local file.
+type fileAuditStore struct {
+	mu   sync.Mutex
+	path string
+}
+
+func (fs *fileAuditStore) Append(events []*AuditEvent) error {
+	buf, err := encodeAuditEvents(events)
+	if err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f, err := os.OpenFile(fs.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (fs *fileAuditStore) Query(q *AuditQuery) ([]*AuditEvent, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f, err := os.Open(fs.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return decodeAuditEvents(f, q, nil)
+}
+
+// s3AuditStore writes each batch of events as a new object under
+// <prefix>/<day>/, so nothing is ever overwritten.
+type s3AuditStore struct {
+	s3     *s3.Client
+	prefix string
+}
+
+// auditQueryDays is how far back a query without Since looks.
+const auditQueryDays = 7
+
+func (ss *s3AuditStore) dayPrefix(t time.Time) string {
+	return path.Join(ss.prefix, t.UTC().Format("2006-01-02")) + "/"
+}
+
+func (ss *s3AuditStore) Append(events []*AuditEvent) error {
+	buf, err := encodeAuditEvents(events)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	key := ss.dayPrefix(now) + fmt.Sprintf("%020d.jsonl", now.UnixNano())
+	hdrs := &http.Header{}
+	hdrs.Set("Content-Type", "application/x-ndjson")
+	return ss.s3.Put(key, buf, hdrs)
+}
+
+func (ss *s3AuditStore) Query(q *AuditQuery) ([]*AuditEvent, error) {
+	until := q.Until
+	if until.IsZero() {
+		until = time.Now()
+	}
+	since := q.Since
+	if since.IsZero() {
+		since = until.AddDate(0, 0, -auditQueryDays)
+	}
+	events := []*AuditEvent{}
+	for day := since.UTC().Truncate(24 * time.Hour); !day.After(until); day = day.Add(24 * time.Hour) {
+		objs, err := ss.s3.List(ss.dayPrefix(day))
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range objs {
+			r, err := ss.s3.Get(o.Key)
+			if err != nil {
+				return nil, err
+			}
+			events, err = decodeAuditEvents(r, q, events)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return events, nil
+}
+
+// clientIP returns the address of the client that made req.
+func clientIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+func (gs *gitServe) audit(req *http.Request, ev *AuditEvent) {
+	if gs.auditLog == nil {
+		return
+	}
+	if req != nil && ev.IP == "" {
+		ev.IP = clientIP(req)
+	}
+	gs.auditLog.Record(ev)
+}
+
+func pushRefs(cmds []*packp.Command) []PushRef {
+	refs := []PushRef{}
+	for _, cmd := range cmds {
+		refs = append(refs, PushRef{
+			Ref:    cmd.Name.String(),
+			Before: cmd.Old.String(),
+			After:  cmd.New.String(),
+		})
+	}
+	return refs
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuthenticateAudit(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := newTestServer(&Config{Users: map[string]*User{"alice": {Password: hash}}}, nil)
+	gs.auditLog = &auditLog{}
+
+	tests := []struct {
+		pass    string
+		ok      bool
+		audited bool
+	}{
+		{"hunter2", true, false},
+		{"hunter3", false, true},
+	}
+	for _, test := range tests {
+		gs.auditLog.pending = nil
+		req := httptest.NewRequest("GET", "/repo/info/refs?service=git-upload-pack", nil)
+		req.SetBasicAuth("alice", test.pass)
+		user, _, ok := gs.authenticate(req)
+		if ok != test.ok || (ok && user != "alice") {
+			t.Errorf("password %q: got %q, %v", test.pass, user, ok)
+		}
+		if audited := len(gs.auditLog.pending) > 0; audited != test.audited {
+			t.Errorf("password %q: audited %v, want %v", test.pass, audited, test.audited)
+		}
+	}
+
+	gs.auditLog.pending = nil
+	rr := postLogin(gs, "alice", "hunter2")
+	if rr.Code != http.StatusSeeOther {
+		t.Fatalf("login: got %d", rr.Code)
+	}
+	if len(gs.auditLog.pending) != 1 || !gs.auditLog.pending[0].Success {
+		t.Errorf("login audit: got %+v", gs.auditLog.pending)
+	}
+}
+
+func TestAPIAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gitserve-audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	gs := newTestServer(&Config{Users: map[string]*User{
+		"root":  {Password: testUser(t, "pw").Password, Admin: true},
+		"alice": testUser(t, "pw"),
+	}}, nil)
+	gs.auditLog = &auditLog{store: &fileAuditStore{path: filepath.Join(dir, "audit.log")}}
+	for i := 0; i < auditMaxLimit+10; i++ {
+		gs.auditLog.Record(&AuditEvent{Action: "login"})
+	}
+
+	tests := []struct {
+		user   string
+		target string
+		code   int
+		events int
+	}{
+		{"", "/api/v1/audit", 401, 0},
+		{"alice", "/api/v1/audit", 403, 0},
+		{"root", "/api/v1/audit", 200, 100},
+		{"root", "/api/v1/audit?limit=5", 200, 5},
+		{"root", "/api/v1/audit?limit=100000", 200, auditMaxLimit},
+		{"root", "/api/v1/audit?limit=-1", 400, 0},
+	}
+	for _, test := range tests {
+		rr := get(http.HandlerFunc(gs.api), test.target, func(req *http.Request) {
+			if test.user != "" {
+				req.SetBasicAuth(test.user, "pw")
+			}
+		})
+		if rr.Code != test.code {
+			t.Errorf("%s as %q: got %d", test.target, test.user, rr.Code)
+			continue
+		}
+		if rr.Code != 200 {
+			continue
+		}
+		events := []*AuditEvent{}
+		err := json.Unmarshal(rr.Body.Bytes(), &events)
+		if err != nil || len(events) != test.events {
+			t.Errorf("%s: got %d events, want %d (%v)", test.target, len(events), test.events, err)
+		}
+	}
+}
+
+func TestGitUnauthorizedAudit(t *testing.T) {
+	tr := newTestRepo(t)
+	tr.branch("master", tr.commit("init", map[string]string{"a": "a"}))
+	gs := newTestServer(&Config{Repos: map[string]*RepoConfig{"repo": {}}}, map[string]*testRepo{"repo": tr})
+	gs.auditLog = &auditLog{}
+
+	for _, service := range []string{"git-upload-pack", "git-receive-pack"} {
+		gs.auditLog.pending = nil
+		rr := get(http.HandlerFunc(gs.git), "/repo/info/refs?service="+service)
+		if rr.Code != 401 {
+			t.Errorf("%s: got %d", service, rr.Code)
+		}
+		p := gs.auditLog.pending
+		if len(p) != 1 || p[0].Action != service || p[0].Repo != "repo" || p[0].User != "nobody" || p[0].Success {
+			t.Errorf("%s: audited %+v", service, p)
+		}
+	}
+}
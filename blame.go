@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/andyleap/go-s3"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// BlameLine is one line of a blamed file. Short, Author and Date are only
+// shown on the first of a run of lines from the same commit.
+type BlameLine struct {
+	Number int
+	Hash   string
+	Short  string
+	Author string
+	Date   time.Time
+	Text   string
+	First  bool
+}
+
+type BlameResult struct {
+	Commit string
+	Path   string
+	Lines  []BlameLine
+}
+
+// blameCachePath is where the blame of p at commit is kept. Both are
+// immutable, so cached results never need invalidating. It's under
+// metaPrefix so it can't collide with a repo named <repo>/blame.
+func blameCachePath(repo string, commit string, p string) string {
+	return path.Join(metaPrefix, "blame", repo, commit, p) + ".json"
+}
+
+// blame returns the blame of p at c, from the cache if it's been computed
+// before.
+func (gs *gitServe) blame(repo string, c *object.Commit, p string) (*BlameResult, error) {
+	key := blameCachePath(repo, c.Hash.String(), p)
+	if r, err := gs.s3.Get(key); err == nil {
+		br := &BlameResult{}
+		err = json.NewDecoder(r).Decode(br)
+		if c, ok := r.(io.Closer); ok {
+			c.Close()
+		}
+		if err == nil {
+			return br, nil
+		}
+		log.Println("blame cache error", key, err)
+	} else if s3err, ok := err.(s3.Error); !ok || s3err.Code != "NoSuchKey" {
+		log.Println("blame cache error", key, err)
+	}
+
+	res, err := git.Blame(c, p)
+	if err != nil {
+		return nil, err
+	}
+	br := &BlameResult{
+		Commit: c.Hash.String(),
+		Path:   p,
+	}
+	for i, l := range res.Lines {
+		bl := BlameLine{
+			Number: i + 1,
+			Hash:   l.Hash.String(),
+			Short:  l.Hash.String()[:7],
+			Author: l.Author,
+			Date:   l.Date,
+			Text:   l.Text,
+		}
+		bl.First = i == 0 || br.Lines[i-1].Hash != bl.Hash
+		br.Lines = append(br.Lines, bl)
+	}
+
+	buf := &bytes.Buffer{}
+	err = json.NewEncoder(buf).Encode(br)
+	if err == nil {
+		hdrs := &http.Header{}
+		hdrs.Set("Content-Type", "application/json")
+		err = gs.s3.Put(key, buf.Bytes(), hdrs)
+	}
+	if err != nil {
+		log.Println("blame cache error", key, err)
+	}
+	return br, nil
+}
+
+func (gs *gitServe) RenderBlame(br *BlameResult, ri *RequestInfo, rw http.ResponseWriter, req *http.Request) {
+	err := gs.tmpl.Render("blame.html", struct {
+		RequestInfo *RequestInfo
+		Blame       *BlameResult
+	}{
+		RequestInfo: ri,
+		Blame:       br,
+	}, rw)
+	if err != nil {
+		log.Println(err)
+	}
+}
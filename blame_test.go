@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBlame(t *testing.T) {
+	tr := newTestRepo(t)
+	first := tr.commit("first", map[string]string{"a.txt": "one\ntwo\n"})
+	second := tr.commit("second", map[string]string{"a.txt": "one\ntwo\nthree\nfour\n"}, first)
+	tr.branch("master", second)
+	gs := newTestServer(&Config{Repos: map[string]*RepoConfig{"repo": {Users: public}}}, map[string]*testRepo{"repo": tr})
+	client, f := newFakeS3(t)
+	gs.s3 = client
+
+	c, err := tr.r.CommitObject(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	br, err := gs.blame("repo", c, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		hash  string
+		first bool
+	}{
+		{first.String(), true},
+		{first.String(), false},
+		{second.String(), true},
+		{second.String(), false},
+	}
+	if len(br.Lines) != len(want) {
+		t.Fatalf("got %d lines", len(br.Lines))
+	}
+	for i, w := range want {
+		l := br.Lines[i]
+		if l.Number != i+1 || l.Hash != w.hash || l.First != w.first || l.Short != w.hash[:7] || l.Author != "test@example.com" {
+			t.Errorf("line %d: got %+v", i+1, l)
+		}
+	}
+
+	// the result is cached where no repo can be, and served from there
+	key := blameCachePath("repo", second.String(), "a.txt")
+	if !strings.HasPrefix(key, metaPrefix+"/") || len(f.keys(key)) != 1 {
+		t.Fatalf("not cached at %s: %v", key, f.keys(""))
+	}
+	cached := *br
+	cached.Path = "from cache"
+	b, _ := json.Marshal(cached)
+	err = client.Put(key, b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	br, err = gs.blame("repo", c, "a.txt")
+	if err != nil || br.Path != "from cache" {
+		t.Errorf("cache not used: %+v, %v", br, err)
+	}
+
+	_, err = gs.blame("repo", c, "missing")
+	if err == nil {
+		t.Error("blamed a missing file")
+	}
+}
+
+func TestBlameView(t *testing.T) {
+	tr := newTestRepo(t)
+	tr.branch("master", tr.commit("init", map[string]string{"a.txt": "hello <world>\n"}))
+	gs := newTestServer(&Config{Repos: map[string]*RepoConfig{
+		"repo":    {Users: public},
+		"private": {},
+	}}, map[string]*testRepo{"repo": tr, "private": tr})
+	gs.s3, _ = newFakeS3(t)
+
+	rr := get(http.HandlerFunc(gs.git), "/repo/blame/master/a.txt")
+	if rr.Code != 200 || !strings.Contains(rr.Body.String(), "hello &lt;world&gt;") {
+		t.Errorf("got %d:\n%s", rr.Code, rr.Body)
+	}
+	if rr := get(http.HandlerFunc(gs.git), "/repo/blame/master/missing"); rr.Code != 404 {
+		t.Errorf("missing file: got %d", rr.Code)
+	}
+	if rr := get(http.HandlerFunc(gs.git), "/private/blame/master/a.txt"); rr.Code == 200 {
+		t.Error("private repo blamed for anonymous user")
+	}
+}
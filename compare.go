@@ -0,0 +1,332 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	fdiff "github.com/go-git/go-git/v5/plumbing/format/diff"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+const (
+	// compareMaxCommits caps the commit list of a compare page.
+	compareMaxCommits = 250
+	// diffMaxLines caps how many diff lines a page renders.
+	diffMaxLines = 20000
+	// diffContext is how many unchanged lines are shown around changes.
+	diffContext = 3
+)
+
+// CommitInfo summarises a commit for commit lists.
+type CommitInfo struct {
+	Hash    string
+	Short   string
+	Author  string
+	Date    time.Time
+	Subject string
+	Message string
+	Parents []string
+}
+
+func commitInfo(c *object.Commit) CommitInfo {
+	ci := CommitInfo{
+		Hash:    c.Hash.String(),
+		Short:   c.Hash.String()[:7],
+		Author:  c.Author.Name,
+		Date:    c.Author.When,
+		Subject: strings.SplitN(c.Message, "\n", 2)[0],
+		Message: c.Message,
+	}
+	for _, p := range c.ParentHashes {
+		ci.Parents = append(ci.Parents, p.String())
+	}
+	return ci
+}
+
+// DiffLine is a line of a rendered diff. Type is one of context, add, del or
+// skip, the last standing in for unchanged lines that were left out.
+type DiffLine struct {
+	Type string
+	Text string
+}
+
+type FileDiff struct {
+	From      string
+	To        string
+	Binary    bool
+	Additions int
+	Deletions int
+	Lines     []DiffLine
+}
+
+// Name is the path the file has after the change, or had before it if it
+// was deleted.
+func (fd *FileDiff) Name() string {
+	if fd.To != "" {
+		return fd.To
+	}
+	return fd.From
+}
+
+type Diff struct {
+	Files     []*FileDiff
+	Additions int
+	Deletions int
+	// Truncated is set if the diff was too long to render in full.
+	Truncated bool
+}
+
+func chunkLines(content string) []string {
+	return strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+}
+
+// diffTrees renders the changes between two trees. from may be nil, for a
+// root commit.
+func diffTrees(ctx context.Context, from *object.Tree, to *object.Tree) (*Diff, error) {
+	changes, err := object.DiffTreeContext(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	patch, err := changes.PatchContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Diff{}
+	rendered := 0
+	for _, fp := range patch.FilePatches() {
+		fd := &FileDiff{Binary: fp.IsBinary()}
+		from, to := fp.Files()
+		if from != nil {
+			fd.From = from.Path()
+		}
+		if to != nil {
+			fd.To = to.Path()
+		}
+		chunks := fp.Chunks()
+		for i, chunk := range chunks {
+			lines := chunkLines(chunk.Content())
+			switch chunk.Type() {
+			case fdiff.Add:
+				fd.Additions += len(lines)
+				for _, l := range lines {
+					fd.Lines = append(fd.Lines, DiffLine{"add", l})
+				}
+			case fdiff.Delete:
+				fd.Deletions += len(lines)
+				for _, l := range lines {
+					fd.Lines = append(fd.Lines, DiffLine{"del", l})
+				}
+			case fdiff.Equal:
+				head, tail := diffContext, diffContext
+				if i == 0 {
+					head = 0
+				}
+				if i == len(chunks)-1 {
+					tail = 0
+				}
+				if head+tail >= len(lines) {
+					for _, l := range lines {
+						fd.Lines = append(fd.Lines, DiffLine{"context", l})
+					}
+					continue
+				}
+				for _, l := range lines[:head] {
+					fd.Lines = append(fd.Lines, DiffLine{"context", l})
+				}
+				fd.Lines = append(fd.Lines, DiffLine{"skip", fmt.Sprintf("%d unchanged lines", len(lines)-head-tail)})
+				for _, l := range lines[len(lines)-tail:] {
+					fd.Lines = append(fd.Lines, DiffLine{"context", l})
+				}
+			}
+		}
+		d.Additions += fd.Additions
+		d.Deletions += fd.Deletions
+		rendered += len(fd.Lines)
+		if rendered > diffMaxLines {
+			fd.Lines = nil
+			d.Truncated = true
+		}
+		d.Files = append(d.Files, fd)
+	}
+	return d, nil
+}
+
+// newCommits lists up to max commits reachable from head but not from any of
+// bases, newest first. Commits are walked in committer time order, so a commit
+// reachable from both is marked as a base before it's reached from head, and
+// the walk stops as soon as everything left is reachable from a base rather
+// than going through the whole history of the bases.
+func newCommits(r *git.Repository, head plumbing.Hash, bases []plumbing.Hash, max int) ([]*object.Commit, error) {
+	const (
+		fromNew = 1 << iota
+		fromBase
+	)
+	commits := []*object.Commit{}
+	if max <= 0 {
+		return commits, nil
+	}
+	marks := map[plumbing.Hash]int{}
+	queue := []*object.Commit{}
+	mark := func(h plumbing.Hash, m int) error {
+		old, queued := marks[h]
+		if old|m == old {
+			return nil
+		}
+		marks[h] = old | m
+		if queued {
+			return nil
+		}
+		c, err := r.CommitObject(h)
+		if err != nil {
+			return err
+		}
+		i := sort.Search(len(queue), func(i int) bool {
+			return queue[i].Committer.When.Before(c.Committer.When)
+		})
+		queue = append(queue, nil)
+		copy(queue[i+1:], queue[i:])
+		queue[i] = c
+		return nil
+	}
+	pending := func() bool {
+		for _, c := range queue {
+			if marks[c.Hash] == fromNew {
+				return true
+			}
+		}
+		return false
+	}
+
+	err := mark(head, fromNew)
+	if err != nil {
+		return nil, err
+	}
+	for _, h := range bases {
+		if h.IsZero() {
+			continue
+		}
+		err = mark(h, fromBase)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for len(commits) < max && pending() {
+		c := queue[0]
+		queue = queue[1:]
+		m := marks[c.Hash]
+		if m == fromNew {
+			commits = append(commits, c)
+		}
+		for _, p := range c.ParentHashes {
+			err = mark(p, m)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return commits, nil
+}
+
+// compareCommits lists the commits reachable from head but not from any of
+// the merge bases, newest first, and whether there were too many to list.
+func compareCommits(r *git.Repository, head *object.Commit, bases []*object.Commit) ([]CommitInfo, bool, error) {
+	hashes := []plumbing.Hash{}
+	for _, b := range bases {
+		hashes = append(hashes, b.Hash)
+	}
+	cs, err := newCommits(r, head.Hash, hashes, compareMaxCommits+1)
+	if err != nil {
+		return nil, false, err
+	}
+	commits := []CommitInfo{}
+	for _, c := range cs {
+		if len(commits) == compareMaxCommits {
+			return commits, true, nil
+		}
+		commits = append(commits, commitInfo(c))
+	}
+	return commits, false, nil
+}
+
+// splitCompare splits "<base>...<head>" as used by the compare view.
+func splitCompare(spec string) (base string, head string, ok bool) {
+	parts := strings.SplitN(spec, "...", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+type CompareInfo struct {
+	Base      string
+	Head      string
+	MergeBase string
+	Commits   []CommitInfo
+	// Truncated is set if there were too many commits to list.
+	Truncated bool
+}
+
+func (gs *gitServe) RenderCompare(ci *CompareInfo, d *Diff, ri *RequestInfo, rw http.ResponseWriter, req *http.Request) {
+	err := gs.tmpl.Render("diff.html", struct {
+		RequestInfo *RequestInfo
+		Compare     *CompareInfo
+		Commit      *CommitInfo
+		Diff        *Diff
+	}{
+		RequestInfo: ri,
+		Compare:     ci,
+		Diff:        d,
+	}, rw)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+// RenderCommit shows c and its changes against its first parent.
+func (gs *gitServe) RenderCommit(c *object.Commit, ri *RequestInfo, rw http.ResponseWriter, req *http.Request) {
+	tree, err := c.Tree()
+	if err != nil {
+		http.Error(rw, err.Error(), 400)
+		return
+	}
+	var parentTree *object.Tree
+	if c.NumParents() > 0 {
+		parent, err := c.Parent(0)
+		if err != nil {
+			http.Error(rw, err.Error(), 400)
+			return
+		}
+		parentTree, err = parent.Tree()
+		if err != nil {
+			http.Error(rw, err.Error(), 400)
+			return
+		}
+	}
+	d, err := diffTrees(req.Context(), parentTree, tree)
+	if err != nil {
+		http.Error(rw, err.Error(), 400)
+		return
+	}
+	ci := commitInfo(c)
+	err = gs.tmpl.Render("diff.html", struct {
+		RequestInfo *RequestInfo
+		Compare     *CompareInfo
+		Commit      *CommitInfo
+		Diff        *Diff
+	}{
+		RequestInfo: ri,
+		Commit:      &ci,
+		Diff:        d,
+	}, rw)
+	if err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// countingStorage counts object reads, each of which is an S3 GET in
+// production.
+type countingStorage struct {
+	*memory.Storage
+	reads int
+}
+
+func (cs *countingStorage) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	cs.reads++
+	return cs.Storage.EncodedObject(t, h)
+}
+
+func TestCompareCommits(t *testing.T) {
+	tr := newTestRepo(t)
+	a := tr.commit("a", map[string]string{"f": "a"})
+	side := tr.commit("side", map[string]string{"f": "side"}, a)
+	main := tr.commit("main", map[string]string{"f": "main"}, a, side)
+	work := tr.commit("work", map[string]string{"f": "work"}, main)
+	// merging side again reaches it without going through the merge base
+	merge := tr.commit("merge", map[string]string{"f": "merge"}, work, side)
+
+	commit := func(h plumbing.Hash) *object.Commit {
+		c, err := tr.r.CommitObject(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+	bases, err := commit(merge).MergeBase(commit(main))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bases) != 1 || bases[0].Hash != main {
+		t.Fatalf("unexpected merge bases %v", bases)
+	}
+	commits, truncated, err := compareCommits(tr.r, commit(merge), bases)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := []string{}
+	for _, c := range commits {
+		got = append(got, c.Subject)
+	}
+	if truncated || !equalStrings(got, []string{"merge", "work"}) {
+		t.Errorf("got %v, truncated %v", got, truncated)
+	}
+}
+
+func TestCompareCommitsWalk(t *testing.T) {
+	tr := newTestRepo(t)
+	base := tr.commit("0", map[string]string{"f": "0"})
+	for i := 0; i < 500; i++ {
+		base = tr.commit("base", map[string]string{"f": "base"}, base)
+	}
+	head := base
+	for i := 0; i < compareMaxCommits+5; i++ {
+		head = tr.commit("head", map[string]string{"f": "head"}, head)
+	}
+
+	cs := &countingStorage{Storage: tr.s}
+	r, err := git.Open(cs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headCommit, err := r.CommitObject(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseCommit, err := r.CommitObject(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs.reads = 0
+	commits, truncated, err := compareCommits(r, headCommit, []*object.Commit{baseCommit})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != compareMaxCommits || !truncated {
+		t.Errorf("got %d commits, truncated %v", len(commits), truncated)
+	}
+	if cs.reads > compareMaxCommits+10 {
+		t.Errorf("read %d commits to list %d", cs.reads, len(commits))
+	}
+
+	headCommit, _ = r.CommitObject(head)
+	short, _ := headCommit.Parent(0)
+	for i := 0; i < compareMaxCommits; i++ {
+		short, _ = short.Parent(0)
+	}
+	cs.reads = 0
+	commits, truncated, err = compareCommits(r, short, []*object.Commit{baseCommit})
+	if err != nil || len(commits) != 4 || truncated {
+		t.Errorf("got %d commits, truncated %v, %v", len(commits), truncated, err)
+	}
+	if cs.reads > 10 {
+		t.Errorf("read %d commits to list %d", cs.reads, len(commits))
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestConfigRetry(t *testing.T) {
+	os.Setenv("ADMIN_PASSWORD", "bootstrap")
+	defer os.Unsetenv("ADMIN_PASSWORD")
+	wait := configRetryWait
+	configRetryWait = 10 * time.Millisecond
+	defer func() { configRetryWait = wait }()
+
+	admin := newTestRepo(t)
+	broken := admin.commit("broken", map[string]string{"config.jsonnet": "{"})
+	admin.branch("master", broken)
+	gs := newTestServer(nil, nil)
+	gs.adminRepo = admin.r
+
+	if gs.loadConfig() == nil {
+		t.Fatal("broken config loaded")
+	}
+	c := gs.getConfig()
+	if c == nil || len(c.Users) != 0 || len(c.Repos) != 0 || gs.checkPassword("admin", "bootstrap") {
+		t.Fatalf("first failed load didn't deny everyone: %+v", c)
+	}
+
+	admin.branch("master", admin.commit("fixed", map[string]string{
+		"config.jsonnet": `{Users: {alice: {}}, Repos: {repo: {}}}`,
+	}, broken))
+	deadline := time.Now().Add(5 * time.Second)
+	for gs.getConfig().Users["alice"] == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("config load wasn't retried")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	gs.mu.Lock()
+	err := gs.configErr
+	gs.mu.Unlock()
+	if err != nil {
+		t.Errorf("configErr after retry: %v", err)
+	}
+}
+
+func TestBootstrapConfig(t *testing.T) {
+	os.Setenv("ADMIN_PASSWORD", "bootstrap")
+	defer os.Unsetenv("ADMIN_PASSWORD")
+
+	gs := newTestServer(nil, nil)
+	gs.adminRepo = newTestRepo(t).r
+	err := gs.loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gs.checkPassword("admin", "bootstrap") {
+		t.Error("empty admin repo didn't get the bootstrap config")
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := map[string]bool{
+		"repo":           true,
+		"team/repo":      true,
+		"_gitserve":      false,
+		"_gitserve/x":    false,
+		"_gitserve-repo": true,
+	}
+	for name, ok := range tests {
+		err := validateConfig(&Config{Repos: map[string]*RepoConfig{name: {}}})
+		if (err == nil) != ok {
+			t.Errorf("%s: got %v", name, err)
+		}
+	}
+}
+
+func TestValidateExternalURL(t *testing.T) {
+	tests := []struct {
+		c  Config
+		ok bool
+	}{
+		{Config{ExternalURL: "https://git.example.com"}, true},
+		{Config{ExternalURL: "git.example.com"}, false},
+		{Config{ExternalURL: "ftp://git.example.com"}, false},
+		{Config{TrustedProxies: []string{"10.0.0.1", "fd00::/8"}}, true},
+		{Config{TrustedProxies: []string{"proxy.local"}}, false},
+	}
+	for _, test := range tests {
+		err := validateConfig(&test.c)
+		if (err == nil) != test.ok {
+			t.Errorf("%+v: got %v", test.c, err)
+		}
+	}
+}
+
+func TestValidateJsonnetLibraries(t *testing.T) {
+	c := &Config{Repos: map[string]*RepoConfig{
+		"app": {Jsonnet: &JsonnetConfig{Libraries: map[string]*JsonnetLibrary{"x": nil}}},
+	}}
+	if err := validateConfig(c); err == nil {
+		t.Error("null library accepted")
+	}
+	c.Repos["app"].Jsonnet.Libraries["x"] = &JsonnetLibrary{Repo: "lib", Ref: "v1"}
+	if err := validateConfig(c); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+)
+
+// feedMaxEntries is how many commits or tags a feed lists.
+const feedMaxEntries = 50
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomPerson struct {
+	Name  string `xml:"name"`
+	Email string `xml:"email,omitempty"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	ID      string     `xml:"id"`
+	Title   string     `xml:"title"`
+	Updated string     `xml:"updated"`
+	Author  atomPerson `xml:"author"`
+	Link    atomLink   `xml:"link"`
+	Content atomText   `xml:"content"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+func atomTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// baseURL is the scheme and host clients reach the server at, for the
+// absolute links feeds and go-import tags need. ExternalURL wins if it's
+// set; otherwise it's the request's, as forwarded by a trusted proxy.
+func (gs *gitServe) baseURL(req *http.Request) string {
+	c := gs.getConfig()
+	if c.ExternalURL != "" {
+		return strings.TrimSuffix(c.ExternalURL, "/")
+	}
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	host := req.Host
+	if trustedProxy(c, req) {
+		switch proto := strings.TrimSpace(firstForwarded(req, "X-Forwarded-Proto")); proto {
+		case "http", "https":
+			scheme = proto
+		}
+		if fh := strings.TrimSpace(firstForwarded(req, "X-Forwarded-Host")); fh != "" {
+			host = fh
+		}
+	}
+	return scheme + "://" + host
+}
+
+// externalHost is the host part of baseURL, which Go import paths are named
+// under.
+func (gs *gitServe) externalHost(req *http.Request) string {
+	return strings.SplitN(gs.baseURL(req), "://", 2)[1]
+}
+
+// firstForwarded is the first value of a comma separated X-Forwarded header,
+// the one set by the proxy closest to the client.
+func firstForwarded(req *http.Request, name string) string {
+	return strings.SplitN(req.Header.Get(name), ",", 2)[0]
+}
+
+// trustedProxy reports whether req came directly from one of the configured
+// TrustedProxies.
+func trustedProxy(c *Config, req *http.Request) bool {
+	ip := net.ParseIP(clientIP(req))
+	if ip == nil {
+		return false
+	}
+	for _, p := range c.TrustedProxies {
+		if _, n, err := net.ParseCIDR(p); err == nil {
+			if n.Contains(ip) {
+				return true
+			}
+		} else if pip := net.ParseIP(p); pip != nil && pip.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func newFeed(base string, req *http.Request, title string, page string) *atomFeed {
+	return &atomFeed{
+		ID:    base + req.URL.Path,
+		Title: title,
+		Links: []atomLink{
+			{Href: base + req.URL.Path, Rel: "self", Type: "application/atom+xml"},
+			{Href: base + page, Rel: "alternate", Type: "text/html"},
+		},
+		Entries: []atomEntry{},
+	}
+}
+
+func writeFeed(rw http.ResponseWriter, f *atomFeed) {
+	if f.Updated == "" {
+		f.Updated = atomTime(time.Unix(0, 0))
+	}
+	rw.Header().Set("Content-Type", "application/atom+xml; charset=utf-8")
+	fmt.Fprint(rw, xml.Header)
+	enc := xml.NewEncoder(rw)
+	enc.Indent("", "  ")
+	err := enc.Encode(f)
+	if err != nil {
+		log.Println("feed encode error", err)
+	}
+}
+
+// feedUnauthorized asks feed readers for basic auth rather than sending them
+// to the login page, which they can't use.
+func feedUnauthorized(rw http.ResponseWriter) {
+	rw.Header().Set("WWW-Authenticate", "Basic")
+	http.Error(rw, "unauthorized", 401)
+}
+
+// logFeed serves the newest commits on ref, as requested by
+// /<repo>/log/<ref>.atom.
+func (gs *gitServe) logFeed(r *git.Repository, repo string, ref string, rw http.ResponseWriter, req *http.Request) {
+	c, err := resolveCommit(r, ref)
+	if err != nil {
+		http.Error(rw, "not found", 404)
+		return
+	}
+	base := gs.baseURL(req)
+	f := newFeed(base, req, fmt.Sprintf("%s: commits on %s", repo, ref), "/"+repo+"/blob/"+ref)
+	f.Updated = atomTime(c.Committer.When)
+
+	iter, err := r.Log(&git.LogOptions{From: c.Hash})
+	if err != nil {
+		log.Println(err)
+		http.Error(rw, "bad request", 400)
+		return
+	}
+	err = iter.ForEach(func(c *object.Commit) error {
+		if len(f.Entries) >= feedMaxEntries {
+			return storer.ErrStop
+		}
+		u := base + "/" + repo + "/commit/" + c.Hash.String()
+		f.Entries = append(f.Entries, atomEntry{
+			ID:      u,
+			Title:   strings.SplitN(c.Message, "\n", 2)[0],
+			Updated: atomTime(c.Committer.When),
+			Author:  atomPerson{Name: c.Author.Name, Email: c.Author.Email},
+			Link:    atomLink{Href: u},
+			Content: atomText{Type: "text", Body: c.Message},
+		})
+		return nil
+	})
+	if err != nil {
+		log.Println(err)
+		http.Error(rw, "bad request", 400)
+		return
+	}
+	writeFeed(rw, f)
+}
+
+// tagsFeed serves the newest tags of a repo, as requested by
+// /<repo>/tags.atom. Annotated tags are dated by their tagger, lightweight
+// ones by the commit they point at.
+func (gs *gitServe) tagsFeed(r *git.Repository, repo string, rw http.ResponseWriter, req *http.Request) {
+	ri, err := gs.repoInfo(r)
+	if err != nil {
+		log.Println(err)
+		http.Error(rw, "bad request", 400)
+		return
+	}
+	base := gs.baseURL(req)
+	f := newFeed(base, req, repo+": tags", "/"+repo+"/refs")
+
+	type datedTag struct {
+		entry atomEntry
+		when  time.Time
+	}
+	tags := []datedTag{}
+	for _, t := range ri.Tags {
+		c, err := resolveCommit(r, t.Commit)
+		if err != nil {
+			continue
+		}
+		dt := datedTag{
+			when: c.Committer.When,
+			entry: atomEntry{
+				ID:      base + "/" + repo + "/blob/" + t.Name,
+				Title:   t.Name,
+				Author:  atomPerson{Name: c.Author.Name, Email: c.Author.Email},
+				Link:    atomLink{Href: base + "/" + repo + "/blob/" + t.Name},
+				Content: atomText{Type: "text", Body: c.Message},
+			},
+		}
+		if t.Annotated {
+			dt.when = t.Tagger.When
+			dt.entry.Author = atomPerson{Name: t.Tagger.Name, Email: t.Tagger.Email}
+			dt.entry.Content.Body = t.Message
+		}
+		dt.entry.Updated = atomTime(dt.when)
+		tags = append(tags, dt)
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		return tags[i].when.After(tags[j].when)
+	})
+	if len(tags) > feedMaxEntries {
+		tags = tags[:feedMaxEntries]
+	}
+	for _, t := range tags {
+		f.Entries = append(f.Entries, t.entry)
+	}
+	if len(tags) > 0 {
+		f.Updated = atomTime(tags[0].when)
+	}
+	writeFeed(rw, f)
+}
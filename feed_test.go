@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"testing"
+)
+
+func getFeed(t *testing.T, gs *gitServe, target string, setup ...func(*http.Request)) *atomFeed {
+	rr := get(http.HandlerFunc(gs.git), target, setup...)
+	if rr.Code != 200 || rr.Header().Get("Content-Type") != "application/atom+xml; charset=utf-8" {
+		t.Fatalf("%s: got %d %q", target, rr.Code, rr.Header().Get("Content-Type"))
+	}
+	f := &atomFeed{}
+	err := xml.Unmarshal(rr.Body.Bytes(), f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func TestLogFeed(t *testing.T) {
+	tr := newTestRepo(t)
+	head := tr.commit("commit 0", map[string]string{"a": "0"})
+	for i := 1; i <= feedMaxEntries+5; i++ {
+		head = tr.commit(fmt.Sprintf("commit %d\n\nbody %d", i, i), map[string]string{"a": fmt.Sprint(i)}, head)
+	}
+	tr.branch("master", head)
+	gs := newTestServer(&Config{Repos: map[string]*RepoConfig{"repo": {Users: public}}}, map[string]*testRepo{"repo": tr})
+
+	f := getFeed(t, gs, "http://example.com/repo/log/master.atom")
+	if len(f.Entries) != feedMaxEntries {
+		t.Fatalf("got %d entries", len(f.Entries))
+	}
+	e := f.Entries[0]
+	last := feedMaxEntries + 5
+	if e.Title != fmt.Sprintf("commit %d", last) || e.Content.Body != fmt.Sprintf("commit %d\n\nbody %d", last, last) {
+		t.Errorf("newest entry: got %+v", e)
+	}
+	if want := "http://example.com/repo/commit/" + head.String(); e.ID != want || e.Link.Href != want {
+		t.Errorf("entry link: got %q", e.Link.Href)
+	}
+	if f.Updated != e.Updated || e.Author.Email != "test@example.com" {
+		t.Errorf("feed updated %q, entry %+v", f.Updated, e)
+	}
+	if f.Links[0].Href != "http://example.com/repo/log/master.atom" || f.Links[1].Href != "http://example.com/repo/blob/master" {
+		t.Errorf("feed links: got %+v", f.Links)
+	}
+
+	gs.c.ExternalURL = "https://git.example.com"
+	f = getFeed(t, gs, "http://internal:8080/repo/log/master.atom")
+	if f.Entries[0].Link.Href != "https://git.example.com/repo/commit/"+head.String() {
+		t.Errorf("external url: got %q", f.Entries[0].Link.Href)
+	}
+
+	for target, code := range map[string]int{
+		"/repo/log/master":       404,
+		"/repo/log/missing.atom": 404,
+	} {
+		if rr := get(http.HandlerFunc(gs.git), target); rr.Code != code {
+			t.Errorf("%s: got %d, want %d", target, rr.Code, code)
+		}
+	}
+}
+
+func TestTagsFeed(t *testing.T) {
+	tr := newTestRepo(t)
+	c1 := tr.commit("one", map[string]string{"a": "1"})
+	c2 := tr.commit("two", map[string]string{"a": "2"}, c1)
+	tr.branch("master", c2)
+	tr.tag("light", c2)
+	tr.annotatedTag("v1", c1, "release notes")
+	gs := newTestServer(&Config{Repos: map[string]*RepoConfig{"repo": {Users: public}}}, map[string]*testRepo{"repo": tr})
+
+	f := getFeed(t, gs, "http://example.com/repo/tags.atom")
+	if len(f.Entries) != 2 {
+		t.Fatalf("got %d entries", len(f.Entries))
+	}
+	// the annotated tag is dated by its tagger, after both commits
+	v1, light := f.Entries[0], f.Entries[1]
+	if v1.Title != "v1" || v1.Content.Body != "release notes" || v1.Link.Href != "http://example.com/repo/blob/v1" {
+		t.Errorf("annotated tag: got %+v", v1)
+	}
+	if light.Title != "light" || light.Content.Body != "two" {
+		t.Errorf("lightweight tag: got %+v", light)
+	}
+	if f.Updated != v1.Updated {
+		t.Errorf("feed updated %q, newest tag %q", f.Updated, v1.Updated)
+	}
+}
+
+func TestFeedAuth(t *testing.T) {
+	tr := newTestRepo(t)
+	tr.branch("master", tr.commit("init", map[string]string{"a": "a"}))
+	gs := newTestServer(&Config{
+		Users: map[string]*User{"alice": testUser(t, "pw")},
+		Repos: map[string]*RepoConfig{"private": {Users: map[string]UserAccess{
+			"alice": {Access: []string{"web"}},
+		}}},
+	}, map[string]*testRepo{"private": tr})
+
+	// feed readers can't use the login page, so they're asked for basic auth
+	for _, target := range []string{"/private/log/master.atom", "/private/tags.atom"} {
+		rr := get(http.HandlerFunc(gs.git), target)
+		if rr.Code != 401 || rr.Header().Get("WWW-Authenticate") != "Basic" {
+			t.Errorf("%s: got %d %v", target, rr.Code, rr.Header())
+		}
+		getFeed(t, gs, target, basicAuth("alice", "pw"))
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// repoForPath finds the configured repo that p is in, which may be the repo
+// itself or a directory inside it such as a Go subpackage. The longest
+// matching repo path wins.
+func (gs *gitServe) repoForPath(p string) (string, *RepoConfig) {
+	repos := gs.getConfig().Repos
+	for p != "." && p != "/" && p != "" {
+		if rc, ok := repos[p]; ok {
+			return p, rc
+		}
+		p = path.Dir(p)
+	}
+	return "", nil
+}
+
+// goGet answers `go get` discovery requests (?go-get=1) with go-import and
+// go-source meta tags pointing at the repo holding the requested package.
+// Repos the user can't clone are reported as not found.
+func (gs *gitServe) goGet(rw http.ResponseWriter, req *http.Request) {
+	user, groups, ok := gs.authenticate(req)
+	if !ok {
+		rw.Header().Set("WWW-Authenticate", "Basic")
+		http.Error(rw, "unauthorized", 401)
+		return
+	}
+	repo, rc := gs.repoForPath(strings.Trim(req.URL.Path, "/"))
+	if rc == nil || !gs.hasAccess(rc, user, groups, "git-upload-pack") {
+		http.Error(rw, "not found", 404)
+		return
+	}
+
+	base := gs.baseURL(req)
+	importPath := gs.externalHost(req) + "/" + repo
+	err := gs.tmpl.Render("goget.html", struct {
+		ImportPath string
+		RepoURL    string
+		WebURL     string
+	}{
+		ImportPath: importPath,
+		RepoURL:    base + "/" + repo,
+		WebURL:     base + "/" + repo,
+	}, rw)
+	if err != nil {
+		log.Println(err)
+	}
+}
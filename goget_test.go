@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestGoGet(t *testing.T) {
+	tr := newTestRepo(t)
+	tr.branch("master", tr.commit("init", map[string]string{"go.mod": "module example.com/repo\n"}))
+	gs := newTestServer(&Config{Repos: map[string]*RepoConfig{
+		"repo":    {Users: public},
+		"private": {},
+	}}, map[string]*testRepo{"repo": tr})
+
+	rr := get(http.HandlerFunc(gs.goGet), "http://example.com/repo/sub/pkg?go-get=1")
+	if rr.Code != 200 {
+		t.Fatalf("got %d", rr.Code)
+	}
+	body := rr.Body.String()
+	if !strings.Contains(body, `<meta name="go-import" content="example.com/repo git http://example.com/repo">`) {
+		t.Errorf("missing go-import:\n%s", body)
+	}
+	// the blob view is the raw file, so there are no line anchors to link
+	if !strings.Contains(body, `http://example.com/repo/blob/HEAD{/dir}/{file}">`) {
+		t.Errorf("go-source file link:\n%s", body)
+	}
+
+	rr = get(http.HandlerFunc(gs.goGet), "http://example.com/private?go-get=1")
+	if rr.Code != 404 {
+		t.Errorf("private repo: got %d", rr.Code)
+	}
+}
+
+func TestBaseURL(t *testing.T) {
+	forwarded := func(req *http.Request) {
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", "git.example.com")
+	}
+	tests := []struct {
+		c    *Config
+		want string
+	}{
+		// httptest requests come from 192.0.2.1
+		{&Config{}, "http://example.com"},
+		{&Config{TrustedProxies: []string{"192.0.2.2"}}, "http://example.com"},
+		{&Config{TrustedProxies: []string{"192.0.2.1"}}, "https://git.example.com"},
+		{&Config{TrustedProxies: []string{"192.0.2.0/24"}}, "https://git.example.com"},
+		{&Config{ExternalURL: "https://code.example.com/"}, "https://code.example.com"},
+	}
+	for _, test := range tests {
+		tr := newTestRepo(t)
+		tr.branch("master", tr.commit("init", map[string]string{"go.mod": "module x\n"}))
+		test.c.Repos = map[string]*RepoConfig{"repo": {Users: public}}
+		gs := newTestServer(test.c, map[string]*testRepo{"repo": tr})
+
+		rr := get(http.HandlerFunc(gs.goGet), "http://example.com/repo?go-get=1", forwarded)
+		host := strings.TrimPrefix(strings.TrimPrefix(test.want, "https://"), "http://")
+		want := `<meta name="go-import" content="` + host + `/repo git ` + test.want + `/repo">`
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("%+v: missing %s in:\n%s", test.c, want, rr.Body.String())
+		}
+	}
+}
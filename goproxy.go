@@ -0,0 +1,664 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage"
+)
+
+// goProxyPrefix is where the module proxy is mounted, so builds can use
+// GOPROXY=https://<host>/goproxy. Module paths are <host>/<repo>[/<dir>],
+// where host is the one the request came in on or one of
+// Config.ModuleHosts.
+const goProxyPrefix = "/goproxy/"
+
+// goProxyMaxWalk bounds the history searched for the commit named by a
+// pseudo-version.
+const goProxyMaxWalk = 10000
+
+var (
+	semverRE      = regexp.MustCompile(`^v(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)(?:-([0-9A-Za-z-]+(?:\.[0-9A-Za-z-]+)*))?$`)
+	pseudoRE      = regexp.MustCompile(`[-.]([0-9]{14})-([0-9a-f]{12})$`)
+	majorSuffixRE = regexp.MustCompile(`/v([2-9]|[1-9][0-9]+)$`)
+)
+
+type semver struct {
+	major, minor, patch int
+	pre                 []string
+}
+
+// parseSemver parses a canonical Go module version. Build metadata isn't
+// allowed.
+func parseSemver(v string) (semver, bool) {
+	m := semverRE.FindStringSubmatch(v)
+	if m == nil {
+		return semver{}, false
+	}
+	sv := semver{}
+	sv.major, _ = strconv.Atoi(m[1])
+	sv.minor, _ = strconv.Atoi(m[2])
+	sv.patch, _ = strconv.Atoi(m[3])
+	if m[4] != "" {
+		sv.pre = strings.Split(m[4], ".")
+	}
+	return sv, true
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareSemver orders versions by semver precedence.
+func compareSemver(a, b semver) int {
+	if c := compareInts(a.major, b.major); c != 0 {
+		return c
+	}
+	if c := compareInts(a.minor, b.minor); c != 0 {
+		return c
+	}
+	if c := compareInts(a.patch, b.patch); c != 0 {
+		return c
+	}
+	switch {
+	case len(a.pre) == 0 && len(b.pre) == 0:
+		return 0
+	case len(a.pre) == 0:
+		return 1
+	case len(b.pre) == 0:
+		return -1
+	}
+	for i := 0; i < len(a.pre) && i < len(b.pre); i++ {
+		an, aerr := strconv.Atoi(a.pre[i])
+		bn, berr := strconv.Atoi(b.pre[i])
+		switch {
+		case aerr == nil && berr == nil:
+			if c := compareInts(an, bn); c != 0 {
+				return c
+			}
+		case aerr == nil:
+			return -1
+		case berr == nil:
+			return 1
+		case a.pre[i] != b.pre[i]:
+			if a.pre[i] < b.pre[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	return compareInts(len(a.pre), len(b.pre))
+}
+
+// unescapeModulePath undoes the proxy protocol's case encoding, where
+// upper case letters are sent as '!' followed by the lower case letter.
+func unescapeModulePath(s string) (string, error) {
+	b := &strings.Builder{}
+	bang := false
+	for _, r := range s {
+		switch {
+		case bang:
+			if r < 'a' || r > 'z' {
+				return "", fmt.Errorf("invalid escaped path %q", s)
+			}
+			b.WriteRune(r - 'a' + 'A')
+			bang = false
+		case r == '!':
+			bang = true
+		case r >= 'A' && r <= 'Z':
+			return "", fmt.Errorf("invalid escaped path %q", s)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	if bang {
+		return "", fmt.Errorf("invalid escaped path %q", s)
+	}
+	return b.String(), nil
+}
+
+// goModule locates a module inside a hosted repo.
+type goModule struct {
+	Path string
+	Repo string
+	// CodeDir is the directory of the repo the module lives in, without
+	// any major version suffix. Its tags are prefixed with it.
+	CodeDir string
+	// Major is the /vN suffix of the module path, if any.
+	Major string
+}
+
+// goModuleFor finds the repo modPath lives in, for a request to host.
+// Modules named under other hosts belong to someone else, even if the rest
+// of the path matches a repo here.
+func (gs *gitServe) goModuleFor(modPath string, host string) *goModule {
+	parts := strings.SplitN(modPath, "/", 2)
+	if len(parts) != 2 || !gs.moduleHost(parts[0], host) {
+		return nil
+	}
+	rel := parts[1]
+	m := &goModule{Path: modPath}
+	if loc := majorSuffixRE.FindStringIndex(rel); loc != nil {
+		m.Major = rel[loc[0]+1:]
+		rel = rel[:loc[0]]
+	}
+	repo, rc := gs.repoForPath(rel)
+	if rc == nil {
+		return nil
+	}
+	m.Repo = repo
+	m.CodeDir = strings.Trim(strings.TrimPrefix(rel, repo), "/")
+	return m
+}
+
+// moduleHost reports whether modules named under name are served here.
+func (gs *gitServe) moduleHost(name string, host string) bool {
+	if strings.EqualFold(name, host) {
+		return true
+	}
+	for _, h := range gs.getConfig().ModuleHosts {
+		if strings.EqualFold(name, h) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *goModule) tagPrefix() string {
+	if m.CodeDir == "" {
+		return ""
+	}
+	return m.CodeDir + "/"
+}
+
+// allows reports whether version belongs to this major version of the
+// module.
+func (m *goModule) allows(sv semver) bool {
+	if m.Major == "" {
+		return sv.major <= 1
+	}
+	return "v"+strconv.Itoa(sv.major) == m.Major
+}
+
+// versions maps each tagged version of the module to its commit.
+func (m *goModule) versions(r *git.Repository) (map[string]plumbing.Hash, error) {
+	iter, err := r.Tags()
+	if err != nil {
+		return nil, err
+	}
+	versions := map[string]plumbing.Hash{}
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name().Short()
+		if !strings.HasPrefix(name, m.tagPrefix()) {
+			return nil
+		}
+		v := strings.TrimPrefix(name, m.tagPrefix())
+		sv, ok := parseSemver(v)
+		if !ok || !m.allows(sv) {
+			return nil
+		}
+		h := ref.Hash()
+		if t, err := r.TagObject(h); err == nil {
+			c, err := t.Commit()
+			if err != nil {
+				return nil
+			}
+			h = c.Hash
+		}
+		versions[v] = h
+		return nil
+	})
+	return versions, err
+}
+
+// dir is where the module's go.mod is in tree: a major version
+// subdirectory if there is one, otherwise CodeDir.
+func (m *goModule) dir(tree *object.Tree) string {
+	if m.Major != "" {
+		d := path.Join(m.CodeDir, m.Major)
+		if _, err := tree.File(path.Join(d, "go.mod")); err == nil {
+			return d
+		}
+	}
+	return m.CodeDir
+}
+
+// goMod returns the module's go.mod at tree, or a synthesized one if it
+// doesn't have one, as with direct fetches. A go.mod declaring a different
+// module path is an error, so the wrong module can't be served under
+// m.Path.
+func (m *goModule) goMod(tree *object.Tree) (string, error) {
+	f, err := tree.File(path.Join(m.dir(tree), "go.mod"))
+	if err != nil {
+		return fmt.Sprintf("module %s\n", m.Path), nil
+	}
+	contents, err := f.Contents()
+	if err != nil {
+		return "", err
+	}
+	if p := goModPath(contents); p != m.Path {
+		return "", fmt.Errorf("go.mod declares module %q, not %q", p, m.Path)
+	}
+	return contents, nil
+}
+
+// goModPath returns the path from a go.mod's module directive.
+func goModPath(contents string) string {
+	for _, line := range strings.Split(contents, "\n") {
+		if i := strings.Index(line, "//"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || fields[0] != "module" {
+			continue
+		}
+		if p, err := strconv.Unquote(fields[1]); err == nil {
+			return p
+		}
+		return fields[1]
+	}
+	return ""
+}
+
+// pseudoVersion names an untagged commit, building on the highest tagged
+// version it descends from as the go command does.
+func (m *goModule) pseudoVersion(c *object.Commit, r *git.Repository, versions map[string]plumbing.Hash) string {
+	base := ""
+	var baseSV semver
+	for v, h := range versions {
+		sv, _ := parseSemver(v)
+		if base != "" && compareSemver(sv, baseSV) <= 0 {
+			continue
+		}
+		tc, err := r.CommitObject(h)
+		if err != nil {
+			continue
+		}
+		if ok, _ := tc.IsAncestor(c); ok {
+			base, baseSV = v, sv
+		}
+	}
+	rev := c.Committer.When.UTC().Format("20060102150405") + "-" + c.Hash.String()[:12]
+	switch {
+	case base == "" && m.Major == "":
+		return "v0.0.0-" + rev
+	case base == "":
+		return m.Major + ".0.0-" + rev
+	case len(baseSV.pre) > 0:
+		return base + ".0." + rev
+	}
+	return fmt.Sprintf("v%d.%d.%d-0.%s", baseSV.major, baseSV.minor, baseSV.patch+1, rev)
+}
+
+// findCommitPrefix looks for a commit whose hash starts with prefix in the
+// history of every branch and tag.
+func findCommitPrefix(r *git.Repository, prefix string) (*object.Commit, error) {
+	refs, err := r.References()
+	if err != nil {
+		return nil, err
+	}
+	seen := map[plumbing.Hash]bool{}
+	var found *object.Commit
+	walked := 0
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference {
+			return nil
+		}
+		c, err := resolveCommit(r, ref.Hash().String())
+		if err != nil {
+			return nil
+		}
+		return object.NewCommitPreorderIter(c, seen, nil).ForEach(func(c *object.Commit) error {
+			seen[c.Hash] = true
+			walked++
+			if strings.HasPrefix(c.Hash.String(), prefix) {
+				found = c
+				return storer.ErrStop
+			}
+			if walked > goProxyMaxWalk {
+				return storer.ErrStop
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, plumbing.ErrObjectNotFound
+	}
+	return found, nil
+}
+
+// resolveVersion finds the commit for a version, which may be a tagged
+// version, a pseudo-version or, if query is set, any revision such as a
+// branch name. It returns the canonical version for the commit.
+func (m *goModule) resolveVersion(r *git.Repository, version string, query bool) (string, *object.Commit, error) {
+	versions, err := m.versions(r)
+	if err != nil {
+		return "", nil, err
+	}
+	if h, ok := versions[version]; ok {
+		c, err := r.CommitObject(h)
+		return version, c, err
+	}
+	if pm := pseudoRE.FindStringSubmatch(version); pm != nil {
+		if sv, ok := parseSemver(version); ok && m.allows(sv) {
+			c, err := findCommitPrefix(r, pm[2])
+			if err != nil {
+				return "", nil, err
+			}
+			// the timestamp is part of the version, so one naming the
+			// wrong time isn't the same version of this commit
+			if c.Committer.When.UTC().Format("20060102150405") != pm[1] {
+				return "", nil, plumbing.ErrObjectNotFound
+			}
+			return version, c, nil
+		}
+	}
+	if !query {
+		return "", nil, plumbing.ErrObjectNotFound
+	}
+	c, err := resolveCommit(r, version)
+	if err != nil {
+		return "", nil, err
+	}
+	for v, h := range versions {
+		if h == c.Hash {
+			return v, c, nil
+		}
+	}
+	return m.pseudoVersion(c, r, versions), c, nil
+}
+
+// latest picks the highest release, falling back to the highest
+// prerelease and then to a pseudo-version of HEAD.
+func (m *goModule) latest(r *git.Repository) (string, *object.Commit, error) {
+	versions, err := m.versions(r)
+	if err != nil {
+		return "", nil, err
+	}
+	best := ""
+	var bestSV semver
+	for v := range versions {
+		sv, _ := parseSemver(v)
+		better := best == "" ||
+			(len(sv.pre) == 0) != (len(bestSV.pre) == 0) && len(sv.pre) == 0 ||
+			(len(sv.pre) == 0) == (len(bestSV.pre) == 0) && compareSemver(sv, bestSV) > 0
+		if better {
+			best, bestSV = v, sv
+		}
+	}
+	if best != "" {
+		c, err := r.CommitObject(versions[best])
+		return best, c, err
+	}
+	c, err := headCommit(r)
+	if err != nil {
+		return "", nil, err
+	}
+	if c == nil {
+		return "", nil, plumbing.ErrReferenceNotFound
+	}
+	return m.pseudoVersion(c, r, versions), c, nil
+}
+
+type goProxyInfo struct {
+	Version string
+	Time    time.Time
+}
+
+func (gs *gitServe) goProxy(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	rw := &metricsWriter{ResponseWriter: w, code: 200}
+	service := "goproxy"
+	defer func() {
+		metrics.observeRequest(service, rw.code, start)
+	}()
+
+	user, groups, ok := gs.authenticate(req)
+	if !ok {
+		rw.Header().Set("WWW-Authenticate", "Basic")
+		http.Error(rw, "unauthorized", 401)
+		return
+	}
+
+	rest := strings.TrimPrefix(req.URL.Path, goProxyPrefix)
+	var escMod, file string
+	if i := strings.Index(rest, "/@v/"); i >= 0 {
+		escMod, file = rest[:i], rest[i+len("/@v/"):]
+	} else if strings.HasSuffix(rest, "/@latest") {
+		escMod, file = strings.TrimSuffix(rest, "/@latest"), "@latest"
+	} else {
+		http.Error(rw, "not found", 404)
+		return
+	}
+	modPath, err := unescapeModulePath(escMod)
+	if err != nil {
+		http.Error(rw, err.Error(), 400)
+		return
+	}
+
+	// Missing modules and ones the user can't read look the same, and a 404
+	// lets the go command fall back to the next proxy.
+	m := gs.goModuleFor(modPath, gs.externalHost(req))
+	if m == nil {
+		http.Error(rw, "not found", 404)
+		return
+	}
+	rc := gs.getConfig().Repos[m.Repo]
+	if !gs.hasAccess(rc, user, groups, "git-upload-pack") {
+		http.Error(rw, "not found", 404)
+		return
+	}
+	s, err := gs.storer(m.Repo, rc)
+	if err != nil {
+		log.Println("goproxy error", err)
+		http.Error(rw, "internal error", 500)
+		return
+	}
+	r, err := git.Open(s.(storage.Storer), nil)
+	if err != nil {
+		log.Println("goproxy error", err)
+		http.Error(rw, "internal error", 500)
+		return
+	}
+
+	if file == "list" {
+		service = "goproxy/list"
+		versions, err := m.versions(r)
+		if err != nil {
+			log.Println("goproxy error", err)
+			http.Error(rw, "internal error", 500)
+			return
+		}
+		list := []string{}
+		for v := range versions {
+			list = append(list, v)
+		}
+		sort.Slice(list, func(i, j int) bool {
+			a, _ := parseSemver(list[i])
+			b, _ := parseSemver(list[j])
+			return compareSemver(a, b) < 0
+		})
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, v := range list {
+			fmt.Fprintln(rw, v)
+		}
+		return
+	}
+
+	var version string
+	var c *object.Commit
+	ext := path.Ext(file)
+	if file == "@latest" {
+		service = "goproxy/latest"
+		version, c, err = m.latest(r)
+	} else {
+		service = "goproxy/" + strings.TrimPrefix(ext, ".")
+		version, err = unescapeModulePath(strings.TrimSuffix(file, ext))
+		if err == nil {
+			version, c, err = m.resolveVersion(r, version, ext == ".info")
+		}
+	}
+	if err != nil {
+		http.Error(rw, "not found", 404)
+		return
+	}
+	tree, err := c.Tree()
+	if err != nil {
+		log.Println("goproxy error", err)
+		http.Error(rw, "internal error", 500)
+		return
+	}
+	goMod, err := m.goMod(tree)
+	if err != nil {
+		http.Error(rw, err.Error(), 404)
+		return
+	}
+
+	switch {
+	case file == "@latest" || ext == ".info":
+		rw.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(rw).Encode(goProxyInfo{
+			Version: version,
+			Time:    c.Committer.When.UTC(),
+		})
+	case ext == ".mod":
+		rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(rw, goMod)
+	case ext == ".zip":
+		rw.Header().Set("Content-Type", "application/zip")
+		err = writeModuleZip(rw, m, version, c)
+		if err != nil {
+			log.Println("goproxy zip error", err)
+		}
+	default:
+		http.Error(rw, "not found", 404)
+	}
+}
+
+// isVendoredPackage reports whether name, a path relative to the module
+// root, is in a vendored package. It's copied from golang.org/x/mod/zip,
+// including its offset bug for vendor directories below the root: zips
+// have to match what the go command makes byte for byte, or their hashes
+// won't match go.sum.
+func isVendoredPackage(name string) bool {
+	var i int
+	if strings.HasPrefix(name, "vendor/") {
+		i += len("vendor/")
+	} else if j := strings.Index(name, "/vendor/"); j >= 0 {
+		i += len("/vendor/")
+	} else {
+		return false
+	}
+	return strings.Contains(name[i:], "/")
+}
+
+// writeModuleZip writes the module zip for version, built from the tree of
+// c. It leaves out the same files as golang.org/x/mod/zip: nested modules,
+// vendored packages, version control directories and symlinks. The repo's
+// root LICENSE is copied into modules in subdirectories that lack one.
+func writeModuleZip(w io.Writer, m *goModule, version string, c *object.Commit) error {
+	tree, err := c.Tree()
+	if err != nil {
+		return err
+	}
+	dir := m.dir(tree)
+	sub := tree
+	if dir != "" {
+		sub, err = tree.Tree(dir)
+		if err != nil {
+			return err
+		}
+	}
+
+	nested := map[string]bool{}
+	hasLicense := false
+	err = sub.Files().ForEach(func(f *object.File) error {
+		if path.Base(f.Name) == "go.mod" && f.Name != "go.mod" {
+			nested[path.Dir(f.Name)] = true
+		}
+		if f.Name == "LICENSE" {
+			hasLicense = true
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	excluded := func(name string) bool {
+		if isVendoredPackage(name) {
+			return true
+		}
+		for d := path.Dir(name); d != "."; d = path.Dir(d) {
+			switch path.Base(d) {
+			case ".bzr", ".git", ".hg", ".svn":
+				return true
+			}
+			if nested[d] {
+				return true
+			}
+		}
+		return false
+	}
+
+	prefix := m.Path + "@" + version + "/"
+	zw := zip.NewWriter(w)
+	add := func(name string, f *object.File) error {
+		zf, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     prefix + name,
+			Method:   zip.Deflate,
+			Modified: time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC),
+		})
+		if err != nil {
+			return err
+		}
+		rc, err := f.Reader()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		_, err = io.Copy(zf, rc)
+		return err
+	}
+	err = sub.Files().ForEach(func(f *object.File) error {
+		if f.Mode == filemode.Symlink || f.Mode == filemode.Submodule || excluded(f.Name) {
+			return nil
+		}
+		return add(f.Name, f)
+	})
+	if err != nil {
+		return err
+	}
+	if dir != "" && !hasLicense {
+		if f, err := tree.File("LICENSE"); err == nil {
+			err = add("LICENSE", f)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return zw.Close()
+}
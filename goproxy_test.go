@@ -0,0 +1,165 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestGoModuleFor(t *testing.T) {
+	gs := newTestServer(&Config{
+		Repos: map[string]*RepoConfig{
+			"repo":     {},
+			"repo/sub": {},
+		},
+		ModuleHosts: []string{"go.example.org"},
+	}, nil)
+
+	tests := []struct {
+		path    string
+		repo    string
+		codeDir string
+		major   string
+	}{
+		{"example.com/repo", "repo", "", ""},
+		{"example.com/repo/v2", "repo", "", "v2"},
+		{"example.com/repo/pkg", "repo", "pkg", ""},
+		{"example.com/repo/pkg/v3", "repo", "pkg", "v3"},
+		{"example.com/repo/sub/x", "repo/sub", "x", ""},
+		{"go.example.org/repo", "repo", "", ""},
+		{"EXAMPLE.com/repo", "repo", "", ""},
+		{"evil.com/repo", "", "", ""},
+		{"example.com/missing", "", "", ""},
+		{"example.com", "", "", ""},
+	}
+	for _, test := range tests {
+		m := gs.goModuleFor(test.path, "example.com")
+		if test.repo == "" {
+			if m != nil {
+				t.Errorf("%s: got %+v, want nothing", test.path, m)
+			}
+			continue
+		}
+		if m == nil || m.Repo != test.repo || m.CodeDir != test.codeDir || m.Major != test.major {
+			t.Errorf("%s: got %+v", test.path, m)
+		}
+	}
+}
+
+func TestGoProxy(t *testing.T) {
+	tr := newTestRepo(t)
+	v1 := tr.commit("v1", map[string]string{"go.mod": "module example.com/repo // the module\n"})
+	tr.tag("v1.0.0", v1)
+	head := tr.commit("head", map[string]string{"go.mod": "module example.com/repo\n", "a.go": "package repo\n"}, v1)
+	tr.branch("master", head)
+	other := newTestRepo(t)
+	other.branch("master", other.commit("init", map[string]string{"go.mod": "module github.com/someone/else\n"}))
+	gs := newTestServer(&Config{Repos: map[string]*RepoConfig{
+		"repo":  {Users: public},
+		"other": {Users: public},
+	}}, map[string]*testRepo{"repo": tr, "other": other})
+
+	pseudo := "v1.0.1-0.20200101000200-" + head.String()[:12]
+	tests := []struct {
+		target string
+		code   int
+		body   string
+	}{
+		{"/goproxy/example.com/repo/@v/list", 200, "v1.0.0\n"},
+		{"/goproxy/example.com/repo/@v/v1.0.0.info", 200, `"Version":"v1.0.0"`},
+		{"/goproxy/example.com/repo/@v/v1.0.0.mod", 200, "module example.com/repo // the module\n"},
+		{"/goproxy/example.com/repo/@v/master.info", 200, `"Version":"` + pseudo + `"`},
+		{"/goproxy/example.com/repo/@v/" + pseudo + ".mod", 200, "module example.com/repo\n"},
+		{"/goproxy/example.com/repo/@latest", 200, `"Version":"v1.0.0"`},
+		// right commit, wrong time
+		{"/goproxy/example.com/repo/@v/v1.0.1-0.20200101000300-" + head.String()[:12] + ".info", 404, ""},
+		{"/goproxy/example.com/repo/@v/v1.0.2.info", 404, ""},
+		{"/goproxy/evil.com/repo/@v/list", 404, ""},
+		{"/goproxy/example.com/other/@latest", 404, ""},
+		{"/goproxy/example.com/other/@v/master.mod", 404, ""},
+	}
+	for _, test := range tests {
+		rr := get(http.HandlerFunc(gs.goProxy), "http://example.com"+test.target)
+		if rr.Code != test.code {
+			t.Errorf("%s: got %d: %s", test.target, rr.Code, rr.Body)
+			continue
+		}
+		if !strings.Contains(rr.Body.String(), test.body) {
+			t.Errorf("%s: got %s, want %s", test.target, rr.Body, test.body)
+		}
+	}
+}
+
+func TestGoModPath(t *testing.T) {
+	tests := map[string]string{
+		"module example.com/a\n":                 "example.com/a",
+		"// comment\nmodule \"example.com/b\"\n": "example.com/b",
+		"module example.com/c // trailing\n":     "example.com/c",
+		"go 1.14\n":                              "",
+	}
+	for contents, want := range tests {
+		if got := goModPath(contents); got != want {
+			t.Errorf("%q: got %q, want %q", contents, got, want)
+		}
+	}
+}
+
+func TestModuleZip(t *testing.T) {
+	tr := newTestRepo(t)
+	head := tr.commit("init", map[string]string{
+		"LICENSE":                "license",
+		"go.mod":                 "module example.com/repo\n",
+		"a.go":                   "package repo\n",
+		"vendor/modules.txt":     "# example.com/x v1.0.0\n",
+		"vendor/x/y.go":          "package x\n",
+		"sub/vendor/modules.txt": "excluded by the offset bug\n",
+		"sub/s.go":               "package sub\n",
+		"nested/go.mod":          "module example.com/repo/nested\n",
+		"nested/n.go":            "package nested\n",
+		"link.go@":               "a.go",
+	})
+	c, err := tr.r.CommitObject(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	err = writeModuleZip(buf, &goModule{Path: "example.com/repo"}, "v1.0.0", c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, f := range zr.File {
+		names = append(names, strings.TrimPrefix(f.Name, "example.com/repo@v1.0.0/"))
+	}
+	sort.Strings(names)
+	want := []string{"LICENSE", "a.go", "go.mod", "sub/s.go", "vendor/modules.txt"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("got %v, want %v", names, want)
+	}
+}
+
+func TestIsVendoredPackage(t *testing.T) {
+	tests := map[string]bool{
+		"vendor/modules.txt":     false,
+		"vendor/x/y.go":          true,
+		"vendor.go":              false,
+		"a/vendor/modules.txt":   true,
+		"a/b/vendor/x.go":        true,
+		"abcdefgh/vendor/x.go":   true,
+		"notvendor/x.go":         false,
+		"pkg/vendorless/file.go": false,
+	}
+	for name, want := range tests {
+		if got := isVendoredPackage(name); got != want {
+			t.Errorf("%s: got %v, want %v", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func TestSetHead(t *testing.T) {
+	tr := newTestRepo(t)
+	c := tr.commit("init", map[string]string{"a": "a"})
+	tr.branch("master", c)
+	tr.branch("dev", c)
+	tr.tag("v1", c)
+	gs := newTestServer(&Config{}, nil)
+
+	err := gs.SetHead(tr.r, "dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := tr.r.Storer.Reference(plumbing.HEAD)
+	if err != nil || head.Target() != "refs/heads/dev" {
+		t.Errorf("HEAD is %v, %v", head, err)
+	}
+	for _, ref := range []string{"missing", "refs/tags/v1"} {
+		if gs.SetHead(tr.r, ref) == nil {
+			t.Errorf("%s: HEAD set", ref)
+		}
+	}
+	head, _ = tr.r.Storer.Reference(plumbing.HEAD)
+	if head.Target() != "refs/heads/dev" {
+		t.Errorf("failed SetHead moved HEAD to %s", head.Target())
+	}
+}
+
+func TestDefaultBranch(t *testing.T) {
+	client, _ := newFakeS3(t)
+	gs := newTestServer(&Config{}, nil)
+	gs.s3 = client
+
+	tests := map[string]string{
+		"main":    "refs/heads/main",
+		"":        "refs/heads/master",
+		"release": "refs/heads/release",
+	}
+	for branch, want := range tests {
+		s, err := gs.storer("repo-"+branch, &RepoConfig{DefaultBranch: branch})
+		if err != nil {
+			t.Fatal(err)
+		}
+		head, err := s.Reference(plumbing.HEAD)
+		if err != nil || head.Target().String() != want {
+			t.Errorf("DefaultBranch %q: HEAD is %v, %v", branch, head, err)
+		}
+	}
+}
+
+func TestConfigHead(t *testing.T) {
+	config := func(user string) map[string]string {
+		return map[string]string{"config.jsonnet": `{Users: {` + user + `: {}}}`}
+	}
+	tests := []struct {
+		name     string
+		env      string
+		branches map[string]string
+		want     string
+	}{
+		{"only branch", "", map[string]string{"main": "alice"}, "alice"},
+		{"default branch", "prod", map[string]string{"main": "alice", "prod": "bob"}, "bob"},
+		{"ambiguous", "", map[string]string{"main": "alice", "prod": "bob"}, ""},
+	}
+	for _, test := range tests {
+		if test.env != "" {
+			os.Setenv("ADMIN_DEFAULT_BRANCH", test.env)
+		} else {
+			os.Unsetenv("ADMIN_DEFAULT_BRANCH")
+		}
+		// HEAD is left pointing at master, which none of them have
+		admin := newTestRepo(t)
+		for branch, user := range test.branches {
+			admin.branch(branch, admin.commit(branch, config(user)))
+		}
+		gs := newTestServer(nil, nil)
+		gs.adminRepo = admin.r
+		_, _, err := gs.GetJsonnet(admin.r, "config.jsonnet")
+		if test.want == "" {
+			if err == nil {
+				t.Errorf("%s: loaded a config", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if gs.loadConfig() != nil || gs.getConfig().Users[test.want] == nil {
+			t.Errorf("%s: got %+v", test.name, gs.getConfig())
+		}
+	}
+	os.Unsetenv("ADMIN_DEFAULT_BRANCH")
+}
+
+func TestBootstrapAdminAccess(t *testing.T) {
+	gs := newTestServer(nil, nil)
+	gs.c = gs.bootstrapConfig()
+	if !gs.hasAccess(gs.c.Repos["admin"], "admin", nil, "admin") {
+		t.Error("bootstrap admin can't change the admin repo's HEAD")
+	}
+}
+
+func TestHeadViews(t *testing.T) {
+	tr := newTestRepo(t)
+	c := tr.commit("init", map[string]string{"a": "a"})
+	tr.branch("master", c)
+	tr.branch("dev", c)
+	gs := newTestServer(&Config{
+		Users: map[string]*User{"alice": testUser(t, "pw")},
+		Repos: map[string]*RepoConfig{"repo": {
+			Users: map[string]UserAccess{"alice": {Access: []string{"web", "admin"}}},
+		}},
+	}, map[string]*testRepo{"repo": tr})
+	alice := basicAuth("alice", "pw")
+
+	apiHead := func() string {
+		rr := get(http.HandlerFunc(gs.api), "/api/v1/repos/repo/head", alice)
+		body := struct{ Head string }{}
+		json.NewDecoder(rr.Body).Decode(&body)
+		return body.Head
+	}
+	if got := apiHead(); got != "refs/heads/master" {
+		t.Errorf("api head: got %q", got)
+	}
+
+	req := httptest.NewRequest("PUT", "/api/v1/repos/repo/head", strings.NewReader(`{"ref": "dev"}`))
+	alice(req)
+	rr := httptest.NewRecorder()
+	gs.api(rr, req)
+	if rr.Code != 200 || apiHead() != "refs/heads/dev" {
+		t.Errorf("set head: got %d %s", rr.Code, rr.Body)
+	}
+
+	// a detached HEAD is reported as its commit
+	tr.setRef(plumbing.HEAD, c)
+	if got := apiHead(); got != c.String() {
+		t.Errorf("detached api head: got %q", got)
+	}
+	rr = get(http.HandlerFunc(gs.api), "/api/v1/repos/repo", alice)
+	body := struct{ Head string }{}
+	json.NewDecoder(rr.Body).Decode(&body)
+	if body.Head != c.String() {
+		t.Errorf("detached api repo head: got %q", body.Head)
+	}
+	rr = get(http.HandlerFunc(gs.git), "/repo/head", alice)
+	if strings.TrimSpace(rr.Body.String()) != c.String() {
+		t.Errorf("detached web head: got %d %q", rr.Code, rr.Body)
+	}
+}
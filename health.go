@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// healthz reports that the process is up and serving requests.
+func (gs *gitServe) healthz(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(rw, "ok")
+}
+
+type readiness struct {
+	Ready  bool              `json:"ready"`
+	Checks map[string]string `json:"checks"`
+}
+
+// readyz reports whether this instance can serve real traffic: S3 must be
+// reachable, the admin repo open and the config loaded from config.jsonnet
+// rather than the built-in fallback. Anyone can ask, so checks only say ok
+// or failing; why they failed goes to the log.
+func (gs *gitServe) readyz(rw http.ResponseWriter, req *http.Request) {
+	r := readiness{
+		Ready:  true,
+		Checks: map[string]string{},
+	}
+	check := func(name string, err error) {
+		if err != nil {
+			log.Println("readiness check", name, "failing:", err)
+			r.Ready = false
+			r.Checks[name] = "failing"
+			return
+		}
+		r.Checks[name] = "ok"
+	}
+
+	_, err := gs.s3.List(path.Join("admin", "ref", "HEAD"))
+	check("s3", err)
+
+	if gs.adminRepo == nil {
+		err = fmt.Errorf("admin repo not open")
+	} else {
+		_, err = gs.adminRepo.Storer.Reference(plumbing.HEAD)
+	}
+	check("admin_repo", err)
+
+	gs.mu.Lock()
+	commit := gs.configCommit
+	err = gs.configErr
+	gs.mu.Unlock()
+	if err == nil && commit.IsZero() {
+		err = fmt.Errorf("using bootstrap config")
+	}
+	check("config", err)
+
+	code := 200
+	if !r.Ready {
+		code = 503
+	}
+	apiJSON(rw, code, r)
+}
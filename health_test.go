@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func TestReadyz(t *testing.T) {
+	client, _ := newFakeS3(t)
+	gs := newTestServer(&Config{}, nil)
+	gs.s3 = client
+	gs.configCommit = plumbing.NewHash("0123456789abcdef0123456789abcdef01234567")
+	gs.configErr = fmt.Errorf("config.jsonnet:3: secret detail")
+
+	rr := get(http.HandlerFunc(gs.readyz), "/readyz")
+	if rr.Code != 503 {
+		t.Errorf("got %d", rr.Code)
+	}
+	body := rr.Body.String()
+	if strings.Contains(body, "secret detail") || strings.Contains(body, "0123456789abcdef") {
+		t.Errorf("readiness leaks details:\n%s", body)
+	}
+	r := readiness{}
+	err := json.Unmarshal(rr.Body.Bytes(), &r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"s3": "ok", "admin_repo": "failing", "config": "failing"}
+	for name, status := range want {
+		if r.Checks[name] != status {
+			t.Errorf("%s: got %q, want %q", name, r.Checks[name], status)
+		}
+	}
+}
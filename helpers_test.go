@@ -0,0 +1,212 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// testRepo is an in-memory repo that tests build commits in directly.
+type testRepo struct {
+	t    *testing.T
+	s    *memory.Storage
+	r    *git.Repository
+	when time.Time
+}
+
+func newTestRepo(t *testing.T) *testRepo {
+	s := memory.NewStorage()
+	r, err := git.Init(s, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testRepo{
+		t:    t,
+		s:    s,
+		r:    r,
+		when: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+func (tr *testRepo) store(o interface {
+	Encode(plumbing.EncodedObject) error
+}) plumbing.Hash {
+	eo := tr.s.NewEncodedObject()
+	err := o.Encode(eo)
+	if err != nil {
+		tr.t.Fatal(err)
+	}
+	h, err := tr.s.SetEncodedObject(eo)
+	if err != nil {
+		tr.t.Fatal(err)
+	}
+	return h
+}
+
+// tree stores files, a map of slash separated paths to contents, as a tree.
+// Paths ending in "@" are stored as symlinks to their contents.
+func (tr *testRepo) tree(files map[string]string) plumbing.Hash {
+	blobs := map[string]object.TreeEntry{}
+	subdirs := map[string]map[string]string{}
+	for p, content := range files {
+		if i := strings.IndexByte(p, '/'); i >= 0 {
+			dir := p[:i]
+			if subdirs[dir] == nil {
+				subdirs[dir] = map[string]string{}
+			}
+			subdirs[dir][p[i+1:]] = content
+			continue
+		}
+		mode := filemode.Regular
+		if strings.HasSuffix(p, "@") {
+			p = strings.TrimSuffix(p, "@")
+			mode = filemode.Symlink
+		}
+		eo := tr.s.NewEncodedObject()
+		eo.SetType(plumbing.BlobObject)
+		w, _ := eo.Writer()
+		w.Write([]byte(content))
+		w.Close()
+		h, err := tr.s.SetEncodedObject(eo)
+		if err != nil {
+			tr.t.Fatal(err)
+		}
+		blobs[p] = object.TreeEntry{Name: p, Mode: mode, Hash: h}
+	}
+	entries := []object.TreeEntry{}
+	for _, e := range blobs {
+		entries = append(entries, e)
+	}
+	for dir, sub := range subdirs {
+		entries = append(entries, object.TreeEntry{Name: dir, Mode: filemode.Dir, Hash: tr.tree(sub)})
+	}
+	// git sorts directories as if their names ended in a slash
+	key := func(e object.TreeEntry) string {
+		if e.Mode == filemode.Dir {
+			return e.Name + "/"
+		}
+		return e.Name
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return key(entries[i]) < key(entries[j])
+	})
+	return tr.store(&object.Tree{Entries: entries})
+}
+
+// commit stores a commit of files with the given parents. Each commit is a
+// minute after the last.
+func (tr *testRepo) commit(msg string, files map[string]string, parents ...plumbing.Hash) plumbing.Hash {
+	tr.when = tr.when.Add(time.Minute)
+	sig := object.Signature{Name: "Test", Email: "test@example.com", When: tr.when}
+	return tr.store(&object.Commit{
+		Author:       sig,
+		Committer:    sig,
+		Message:      msg,
+		TreeHash:     tr.tree(files),
+		ParentHashes: parents,
+	})
+}
+
+func (tr *testRepo) setRef(name plumbing.ReferenceName, h plumbing.Hash) {
+	err := tr.s.SetReference(plumbing.NewHashReference(name, h))
+	if err != nil {
+		tr.t.Fatal(err)
+	}
+}
+
+func (tr *testRepo) branch(name string, h plumbing.Hash) {
+	tr.setRef(plumbing.NewBranchReferenceName(name), h)
+}
+
+func (tr *testRepo) tag(name string, h plumbing.Hash) {
+	tr.setRef(plumbing.NewTagReferenceName(name), h)
+}
+
+func (tr *testRepo) annotatedTag(name string, h plumbing.Hash, msg string) {
+	tr.when = tr.when.Add(time.Minute)
+	th := tr.store(&object.Tag{
+		Name:       name,
+		Tagger:     object.Signature{Name: "Test", Email: "test@example.com", When: tr.when},
+		Message:    msg,
+		TargetType: plumbing.CommitObject,
+		Target:     h,
+	})
+	tr.tag(name, th)
+}
+
+// newTestServer makes a gitServe with config c and repos served from memory
+// instead of S3.
+func newTestServer(c *Config, repos map[string]*testRepo) *gitServe {
+	gs := &gitServe{
+		storers: map[string]storer.Storer{},
+		search: searchIndexer{
+			running: map[string]bool{},
+			dirty:   map[string]bool{},
+		},
+		mirrors: mirrors{
+			status:  map[string]*MirrorStatus{},
+			running: map[string]bool{},
+		},
+		pages: pagesCache{
+			sites: map[string]*pagesSite{},
+		},
+		secretHashes: secretHashCache{
+			m: map[string]secretHash{},
+		},
+		tmpl: &templater{
+			path: "templates",
+		},
+		sessions: newSessions("test", time.Hour),
+		oidc: oidcState{
+			pending: map[string]*oidcPending{},
+		},
+		c: c,
+	}
+	for name, tr := range repos {
+		gs.storers[name] = tr.s
+	}
+	return gs
+}
+
+// get makes a request to h and returns the response.
+func get(h http.Handler, target string, setup ...func(*http.Request)) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", target, nil)
+	for _, f := range setup {
+		f(req)
+	}
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	return rr
+}
+
+// public grants everyone web access and clones.
+var public = map[string]UserAccess{
+	"nobody": {Access: []string{"web", "git-upload-pack"}},
+}
+
+// testUser makes a user logging in with pass.
+func testUser(t *testing.T, pass string) *User {
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &User{Password: hash}
+}
+
+// basicAuth is a get setup func logging in as user.
+func basicAuth(user string, pass string) func(*http.Request) {
+	return func(req *http.Request) {
+		req.SetBasicAuth(user, pass)
+	}
+}
@@ -1,17 +1,86 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
+	"io/ioutil"
+	"os"
 	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
 
+	"github.com/go-git/go-git/v5/plumbing/filemode"
 	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/google/go-jsonnet"
+	"github.com/google/go-jsonnet/ast"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh"
 )
 
-func processJsonnet(tree *object.Tree, path string) (string, error) {
+// defaultJsonnetLibPaths are searched for imports when a repo doesn't set
+// its own LibPaths.
+var defaultJsonnetLibPaths = []string{"lib", "vendor"}
+
+// JsonnetConfig sets how jsonnet files in a repo are evaluated.
+type JsonnetConfig struct {
+	// LibPaths are directories searched for imports that aren't found
+	// relative to the importing file. Defaults to lib and vendor; an empty
+	// list turns the search off.
+	LibPaths []string
+
+	// Libraries make other repos importable, so that
+	// import "<name>/x.libsonnet" reads x.libsonnet from the library.
+	Libraries map[string]*JsonnetLibrary
+}
+
+// JsonnetLibrary is a repo of shared jsonnet, pinned to a ref so that
+// changes to it don't silently change what importers render.
+type JsonnetLibrary struct {
+	Repo string
+	Ref  string
+}
+
+func (jc *JsonnetConfig) libPaths() []string {
+	if jc == nil || jc.LibPaths == nil {
+		return defaultJsonnetLibPaths
+	}
+	return jc.LibPaths
+}
+
+// newTreeImporter makes an importer reading from tree. Libraries are only
+// importable once openLibrary is set.
+func newTreeImporter(tree *object.Tree, jc *JsonnetConfig) *treeImporter {
+	ti := &treeImporter{
+		t:        tree,
+		prefixes: jc.libPaths(),
+		libTrees: map[string]*object.Tree{},
+		cache:    map[importLoc]*importResult{},
+		locs:     map[string]importLoc{},
+	}
+	if jc != nil {
+		ti.libraries = jc.Libraries
+	}
+	return ti
+}
+
+// newTreeVM makes a jsonnet VM that imports files with ti.
+func newTreeVM(ti *treeImporter) *jsonnet.VM {
 	vm := jsonnet.MakeVM()
-	ti := &treeImporter{t: tree}
 	vm.Importer(ti)
+	return vm
+}
+
+// processJsonnet evaluates the admin config at path in tree, with the
+// config natives and the instance ext var available.
+func (gs *gitServe) processJsonnet(tree *object.Tree, path string) (string, error) {
+	vm := newTreeVM(newTreeImporter(tree, nil))
+	vm.ExtVar("instance", instanceName())
+	for _, f := range gs.configNatives(tree) {
+		vm.NativeFunction(f)
+	}
 	ast, _, err := vm.ImportAST("", path)
 	if err != nil {
 		return "", err
@@ -19,9 +88,114 @@ func processJsonnet(tree *object.Tree, path string) (string, error) {
 	return vm.Evaluate(ast)
 }
 
+// importLoc is a file in the importing tree, or in a library if lib is set.
+type importLoc struct {
+	lib  string
+	path string
+}
+
+type importResult struct {
+	contents jsonnet.Contents
+	foundAt  string
+	err      error
+}
+
+// treeImporter imports files from a git tree. An importer is meant to be
+// used for a single evaluation: every lookup, found or not, is cached, and
+// libraries are only resolved to a commit once.
 type treeImporter struct {
 	t        *object.Tree
 	prefixes []string
+
+	libraries map[string]*JsonnetLibrary
+	// openLibrary loads the tree a library is pinned to.
+	openLibrary func(lib *JsonnetLibrary) (*object.Tree, error)
+	libTrees    map[string]*object.Tree
+
+	cache map[importLoc]*importResult
+	// locs maps the foundAt of every file imported so far back to where it
+	// is, so imports relative to it can be resolved.
+	locs map[string]importLoc
+}
+
+func (ti *treeImporter) tree(lib string) (*object.Tree, error) {
+	if lib == "" {
+		return ti.t, nil
+	}
+	if t, ok := ti.libTrees[lib]; ok {
+		return t, nil
+	}
+	if ti.openLibrary == nil {
+		return nil, fmt.Errorf("jsonnet libraries can't be imported here")
+	}
+	l := ti.libraries[lib]
+	if l == nil {
+		return nil, fmt.Errorf("jsonnet library %s isn't configured", lib)
+	}
+	t, err := ti.openLibrary(l)
+	if err != nil {
+		return nil, fmt.Errorf("jsonnet library %s: %w", lib, err)
+	}
+	ti.libTrees[lib] = t
+	return t, nil
+}
+
+// load reads the file at loc, remembering the result.
+func (ti *treeImporter) load(loc importLoc) *importResult {
+	if res, ok := ti.cache[loc]; ok {
+		return res
+	}
+	res := &importResult{foundAt: loc.path}
+	if lib := ti.libraries[loc.lib]; loc.lib != "" && lib != nil {
+		res.foundAt = lib.Repo + "@" + lib.Ref + "/" + loc.path
+	}
+	t, err := ti.tree(loc.lib)
+	if err == nil {
+		var f *object.File
+		f, err = t.File(loc.path)
+		if err == nil {
+			var data string
+			data, err = f.Contents()
+			res.contents = jsonnet.MakeContents(data)
+		}
+	}
+	res.err = err
+	ti.cache[loc] = res
+	if err == nil {
+		ti.locs[res.foundAt] = loc
+	}
+	return res
+}
+
+// candidates lists where importedPath might be, in the order they're tried:
+// relative to the importing file, in a library named by its first element,
+// under each library path and finally from the root of the tree the
+// importing file is in. Paths starting with / are only looked for at that
+// root. Paths that climb out of their tree are left out.
+func (ti *treeImporter) candidates(importedFrom string, importedPath string) []importLoc {
+	from := ti.locs[importedFrom]
+	var locs []importLoc
+	add := func(lib string, p string) {
+		if strings.HasPrefix(p, "../") || p == ".." {
+			return
+		}
+		locs = append(locs, importLoc{lib: lib, path: p})
+	}
+	if strings.HasPrefix(importedPath, "/") {
+		add(from.lib, strings.TrimPrefix(path.Clean(importedPath), "/"))
+		return locs
+	}
+	add(from.lib, path.Join(path.Dir(from.path), importedPath))
+	parts := strings.SplitN(importedPath, "/", 2)
+	if _, ok := ti.libraries[parts[0]]; ok && len(parts) == 2 {
+		add(parts[0], path.Clean(parts[1]))
+	}
+	for _, p := range ti.prefixes {
+		add(from.lib, path.Join(p, importedPath))
+	}
+	// imports used to always be from the root, so keep that working
+	add(from.lib, path.Clean(importedPath))
+	return locs
 }
 
 // Import fetches data from a given path. It may be relative
@@ -43,18 +217,221 @@ type treeImporter struct {
 // and shouldn't involve copying the whole file - the same buffer
 // should be returned.
 func (ti *treeImporter) Import(importedFrom string, importedPath string) (contents jsonnet.Contents, foundAt string, err error) {
-	f, err := ti.t.File(importedPath)
-	if err == nil {
-		data, err := f.Contents()
-		return jsonnet.MakeContents(data), importedPath, err
-	}
-	for _, p := range ti.prefixes {
-		ipath := path.Join(p, importedPath)
-		f, err := ti.t.File(importedPath)
-		if err == nil {
-			data, err := f.Contents()
-			return jsonnet.MakeContents(data), ipath, err
+	for _, loc := range ti.candidates(importedFrom, importedPath) {
+		res := ti.load(loc)
+		if res.err == nil {
+			return res.contents, res.foundAt, nil
+		}
+		if loc.lib != "" && res.err != object.ErrFileNotFound {
+			return jsonnet.Contents{}, "", res.err
 		}
 	}
 	return jsonnet.Contents{}, "", fmt.Errorf("Could not find %s", importedPath)
 }
+
+// instanceName identifies this server to the config, from INSTANCE_NAME or
+// else the hostname.
+func instanceName() string {
+	if name, ok := os.LookupEnv("INSTANCE_NAME"); ok {
+		return name
+	}
+	name, _ := os.Hostname()
+	return name
+}
+
+// secretsDir is where secretFile reads from, SECRETS_DIR or /run/secrets.
+func secretsDir() string {
+	if dir, ok := os.LookupEnv("SECRETS_DIR"); ok {
+		return dir
+	}
+	return "/run/secrets"
+}
+
+// readSecret reads a file from the secrets directory. Names can't climb out
+// of it, and a trailing newline is dropped.
+func readSecret(name string) (string, error) {
+	clean := path.Clean("/" + name)
+	b, err := ioutil.ReadFile(filepath.Join(secretsDir(), filepath.FromSlash(clean)))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(b), "\n"), nil
+}
+
+// parseSSHKeys parses authorized_keys style data, skipping blank lines and
+// comments, and returns each key in its canonical form.
+func parseSSHKeys(name string, data string) ([]interface{}, error) {
+	keys := []interface{}{}
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(line))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", name, i+1, err)
+		}
+		k := strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(key)), "\n")
+		if comment != "" {
+			k += " " + comment
+		}
+		keys = append(keys, k)
+	}
+	return keys, nil
+}
+
+// sshKeys loads the keys in p, a file of the admin repo, or in every .pub
+// file directly inside p if it's a directory.
+func sshKeys(tree *object.Tree, p string) ([]interface{}, error) {
+	p = strings.Trim(path.Clean(p), "/")
+	e, err := tree.FindEntry(p)
+	if err != nil {
+		return nil, err
+	}
+	files := []string{p}
+	if e.Mode == filemode.Dir {
+		dir, err := tree.Tree(p)
+		if err != nil {
+			return nil, err
+		}
+		files = nil
+		for _, e := range dir.Entries {
+			if e.Mode.IsFile() && strings.HasSuffix(e.Name, ".pub") {
+				files = append(files, path.Join(p, e.Name))
+			}
+		}
+		sort.Strings(files)
+	}
+	keys := []interface{}{}
+	for _, name := range files {
+		f, err := tree.File(name)
+		if err != nil {
+			return nil, err
+		}
+		data, err := f.Contents()
+		if err != nil {
+			return nil, err
+		}
+		fk, err := parseSSHKeys(name, data)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, fk...)
+	}
+	return keys, nil
+}
+
+// configEnvPrefix is the prefix of the only environment variables the
+// config can read, so it can't get at credentials meant for the server
+// itself.
+const configEnvPrefix = "GITSERVE_"
+
+type secretHash struct {
+	sum  [sha256.Size]byte
+	hash string
+}
+
+// secretHashCache remembers the bcrypt hash of each secret, so reloading
+// the config doesn't rehash every password, or change every hash.
+type secretHashCache struct {
+	mu sync.Mutex
+	m  map[string]secretHash
+}
+
+// bcryptSecret reads a password from the secrets directory and returns its
+// bcrypt hash, base64 encoded for User.Password. Hashing only secrets keeps
+// plain text passwords out of the admin repo.
+func (gs *gitServe) bcryptSecret(name string) (string, error) {
+	pass, err := readSecret(name)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(pass))
+	gs.secretHashes.mu.Lock()
+	defer gs.secretHashes.mu.Unlock()
+	if sh, ok := gs.secretHashes.m[name]; ok && sh.sum == sum {
+		return sh.hash, nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	if err != nil {
+		return "", err
+	}
+	// User.Password is bytes, which JSON carries as base64
+	sh := secretHash{sum: sum, hash: base64.StdEncoding.EncodeToString(hash)}
+	gs.secretHashes.m[name] = sh
+	return sh.hash, nil
+}
+
+// configNatives are the native functions config.jsonnet can call with
+// std.native:
+//
+//	env(name)            an environment variable starting with GITSERVE_,
+//	                     or null if it's unset
+//	secretFile(name)     a file from the secrets directory
+//	bcryptSecret(name)   a password hash for User.Password of a file from
+//	                     the secrets directory
+//	repos()              the repos that exist in storage
+//	sshKeys(path)        the SSH public keys in a file or directory of the
+//	                     admin repo
+func (gs *gitServe) configNatives(tree *object.Tree) []*jsonnet.NativeFunction {
+	return []*jsonnet.NativeFunction{
+		{
+			Name:   "env",
+			Params: ast.Identifiers{"name"},
+			Func: func(args []interface{}) (interface{}, error) {
+				name, ok := args[0].(string)
+				if !ok {
+					return nil, fmt.Errorf("env: name must be a string")
+				}
+				if !strings.HasPrefix(name, configEnvPrefix) {
+					return nil, fmt.Errorf("env: only %s variables can be read", configEnvPrefix)
+				}
+				v, ok := os.LookupEnv(name)
+				if !ok {
+					return nil, nil
+				}
+				return v, nil
+			},
+		},
+		{
+			Name:   "secretFile",
+			Params: ast.Identifiers{"name"},
+			Func: func(args []interface{}) (interface{}, error) {
+				name, ok := args[0].(string)
+				if !ok {
+					return nil, fmt.Errorf("secretFile: name must be a string")
+				}
+				return readSecret(name)
+			},
+		},
+		{
+			Name:   "bcryptSecret",
+			Params: ast.Identifiers{"name"},
+			Func: func(args []interface{}) (interface{}, error) {
+				name, ok := args[0].(string)
+				if !ok {
+					return nil, fmt.Errorf("bcryptSecret: name must be a string")
+				}
+				return gs.bcryptSecret(name)
+			},
+		},
+		{
+			Name:   "repos",
+			Params: ast.Identifiers{},
+			Func: func(args []interface{}) (interface{}, error) {
+				return gs.storedRepos()
+			},
+		},
+		{
+			Name:   "sshKeys",
+			Params: ast.Identifiers{"path"},
+			Func: func(args []interface{}) (interface{}, error) {
+				p, ok := args[0].(string)
+				if !ok {
+					return nil, fmt.Errorf("sshKeys: path must be a string")
+				}
+				return sshKeys(tree, p)
+			},
+		},
+	}
+}
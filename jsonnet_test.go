@@ -0,0 +1,336 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestImportCandidates(t *testing.T) {
+	ti := newTreeImporter(nil, &JsonnetConfig{
+		Libraries: map[string]*JsonnetLibrary{"k": {Repo: "klib", Ref: "v1"}},
+	})
+	ti.locs["app/main.jsonnet"] = importLoc{path: "app/main.jsonnet"}
+	ti.locs["klib@v1/sub/k.libsonnet"] = importLoc{lib: "k", path: "sub/k.libsonnet"}
+
+	tests := []struct {
+		from string
+		path string
+		want []importLoc
+	}{
+		{"app/main.jsonnet", "util.libsonnet", []importLoc{
+			{path: "app/util.libsonnet"},
+			{path: "lib/util.libsonnet"},
+			{path: "vendor/util.libsonnet"},
+			{path: "util.libsonnet"},
+		}},
+		{"app/main.jsonnet", "k/a.libsonnet", []importLoc{
+			{path: "app/k/a.libsonnet"},
+			{lib: "k", path: "a.libsonnet"},
+			{path: "lib/k/a.libsonnet"},
+			{path: "vendor/k/a.libsonnet"},
+			{path: "k/a.libsonnet"},
+		}},
+		{"app/main.jsonnet", "/x.libsonnet", []importLoc{
+			{path: "x.libsonnet"},
+		}},
+		{"app/main.jsonnet", "../x.libsonnet", []importLoc{
+			{path: "x.libsonnet"},
+			{path: "x.libsonnet"},
+			{path: "x.libsonnet"},
+		}},
+		{"app/main.jsonnet", "../../x.libsonnet", nil},
+		{"app/main.jsonnet", "/../x.libsonnet", []importLoc{
+			{path: "x.libsonnet"},
+		}},
+		// imports from a library stay inside it
+		{"klib@v1/sub/k.libsonnet", "util.libsonnet", []importLoc{
+			{lib: "k", path: "sub/util.libsonnet"},
+			{lib: "k", path: "lib/util.libsonnet"},
+			{lib: "k", path: "vendor/util.libsonnet"},
+			{lib: "k", path: "util.libsonnet"},
+		}},
+		{"klib@v1/sub/k.libsonnet", "/x.libsonnet", []importLoc{
+			{lib: "k", path: "x.libsonnet"},
+		}},
+		{"klib@v1/sub/k.libsonnet", "k/../../x.libsonnet", []importLoc{
+			{lib: "k", path: "x.libsonnet"},
+			{lib: "k", path: "x.libsonnet"},
+			{lib: "k", path: "x.libsonnet"},
+		}},
+	}
+	for _, test := range tests {
+		got := ti.candidates(test.from, test.path)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s from %s: got %+v, want %+v", test.path, test.from, got, test.want)
+		}
+	}
+}
+
+func TestTreeImporter(t *testing.T) {
+	tr := newTestRepo(t)
+	tree := func(files map[string]string) *object.Tree {
+		tree, err := tr.r.TreeObject(tr.tree(files))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tree
+	}
+	app := tree(map[string]string{
+		"app/main.jsonnet":   `[import "k/k.libsonnet", import "util.libsonnet", import "/root.libsonnet"]`,
+		"lib/util.libsonnet": `"app util"`,
+		"root.libsonnet":     `"app root"`,
+	})
+	lib := tree(map[string]string{
+		"k.libsonnet":        `[import "helper.libsonnet", import "util.libsonnet", import "/root.libsonnet"]`,
+		"helper.libsonnet":   `"lib helper"`,
+		"lib/util.libsonnet": `"lib util"`,
+		"root.libsonnet":     `"lib root"`,
+	})
+	ti := newTreeImporter(app, &JsonnetConfig{
+		Libraries: map[string]*JsonnetLibrary{"k": {Repo: "klib", Ref: "v1"}},
+	})
+	ti.openLibrary = func(*JsonnetLibrary) (*object.Tree, error) {
+		return lib, nil
+	}
+
+	vm := newTreeVM(ti)
+	node, _, err := vm.ImportAST("", "app/main.jsonnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := vm.Evaluate(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[["lib helper","lib util","lib root"],"app util","app root"]`
+	if got := strings.Join(strings.Fields(out), ""); got != strings.Join(strings.Fields(want), "") {
+		t.Errorf("got %s", out)
+	}
+
+	_, _, err = ti.Import("app/main.jsonnet", "../../etc/passwd")
+	if err == nil {
+		t.Error("import climbed out of the tree")
+	}
+
+	ti = newTreeImporter(app, &JsonnetConfig{Libraries: map[string]*JsonnetLibrary{"k": nil}})
+	ti.openLibrary = func(*JsonnetLibrary) (*object.Tree, error) {
+		return lib, nil
+	}
+	_, _, err = ti.Import("app/main.jsonnet", "k/k.libsonnet")
+	if err == nil {
+		t.Error("imported from a null library")
+	}
+}
+
+// secretsDirForTest points SECRETS_DIR at a new directory holding files,
+// with a file outside of it that secrets mustn't be able to reach.
+func secretsDirForTest(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "gitserve-secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	secrets := filepath.Join(dir, "secrets")
+	err = os.Mkdir(secrets, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "outside"), []byte("outside"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range files {
+		err = ioutil.WriteFile(filepath.Join(secrets, name), []byte(content), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	old, ok := os.LookupEnv("SECRETS_DIR")
+	os.Setenv("SECRETS_DIR", secrets)
+	t.Cleanup(func() {
+		if ok {
+			os.Setenv("SECRETS_DIR", old)
+		} else {
+			os.Unsetenv("SECRETS_DIR")
+		}
+	})
+	return secrets
+}
+
+func TestReadSecret(t *testing.T) {
+	secretsDirForTest(t, map[string]string{"token": "s3cret\n"})
+
+	v, err := readSecret("token")
+	if err != nil || v != "s3cret" {
+		t.Errorf("got %q, %v", v, err)
+	}
+	for _, name := range []string{"../outside", "/../outside", "a/../../outside"} {
+		v, err := readSecret(name)
+		if err == nil {
+			t.Errorf("%s: read %q from outside the secrets directory", name, v)
+		}
+	}
+}
+
+func testSSHKey(t *testing.T) string {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSuffix(string(ssh.MarshalAuthorizedKey(key)), "\n")
+}
+
+func TestParseSSHKeys(t *testing.T) {
+	a, b := testSSHKey(t), testSSHKey(t)
+	keys, err := parseSSHKeys("keys", "# alice\n\n  "+a+"   alice@laptop\n"+b+"\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []interface{}{a + " alice@laptop", b}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("got %v, want %v", keys, want)
+	}
+
+	_, err = parseSSHKeys("keys", a+"\nnot a key\n")
+	if err == nil || !strings.HasPrefix(err.Error(), "keys:2:") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestSSHKeys(t *testing.T) {
+	a, b, c := testSSHKey(t), testSSHKey(t), testSSHKey(t)
+	tr := newTestRepo(t)
+	tree, err := tr.r.TreeObject(tr.tree(map[string]string{
+		"keys/b.pub":     b,
+		"keys/a.pub":     a,
+		"keys/README":    "not a key",
+		"keys/old/c.pub": c,
+		"deploy.pub":     c + " deploy",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := sshKeys(tree, "/keys/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{a, b}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("directory: got %v, want %v", keys, want)
+	}
+	keys, err = sshKeys(tree, "deploy.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []interface{}{c + " deploy"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("file: got %v, want %v", keys, want)
+	}
+	_, err = sshKeys(tree, "missing")
+	if err == nil {
+		t.Error("missing path: no error")
+	}
+}
+
+func TestConfigNatives(t *testing.T) {
+	secrets := secretsDirForTest(t, map[string]string{"alice": "hunter2"})
+	os.Setenv("GITSERVE_TEST_VAR", "yes")
+	os.Setenv("OTHER_TEST_VAR", "no")
+	t.Cleanup(func() {
+		os.Unsetenv("GITSERVE_TEST_VAR")
+		os.Unsetenv("OTHER_TEST_VAR")
+	})
+	client, f := newFakeS3(t)
+	gs := newTestServer(&Config{}, nil)
+	gs.s3 = client
+	for _, key := range []string{"admin/ref/HEAD", "a/ref/HEAD", "b/sub/ref/HEAD", "b/sub/obj/x"} {
+		err := client.Put(key, []byte("x"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tr := newTestRepo(t)
+	tree, err := tr.r.TreeObject(tr.tree(map[string]string{"x": "x"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	eval := func(snippet string) (string, error) {
+		vm := newTreeVM(newTreeImporter(tree, nil))
+		for _, f := range gs.configNatives(tree) {
+			vm.NativeFunction(f)
+		}
+		out, err := vm.EvaluateSnippet("config.jsonnet", snippet)
+		return strings.Join(strings.Fields(out), ""), err
+	}
+
+	out, err := eval(`[std.native("env")("GITSERVE_TEST_VAR"), std.native("env")("GITSERVE_UNSET")]`)
+	if err != nil || out != `["yes",null]` {
+		t.Errorf("env: got %s, %v", out, err)
+	}
+	_, err = eval(`std.native("env")("OTHER_TEST_VAR")`)
+	if err == nil {
+		t.Error("env read a variable without the prefix")
+	}
+
+	first, err := eval(`std.native("bcryptSecret")("alice")`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := eval(`std.native("bcryptSecret")("alice")`)
+	if err != nil || again != first {
+		t.Errorf("hash wasn't reused: %s, %s, %v", first, again, err)
+	}
+	err = ioutil.WriteFile(filepath.Join(secrets, "alice"), []byte("correct horse"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed, err := eval(`std.native("bcryptSecret")("alice")`)
+	if err != nil || changed == first {
+		t.Errorf("hash didn't follow the secret: %s, %v", changed, err)
+	}
+	_, err = eval(`std.native("bcrypt")("hunter2")`)
+	if err == nil {
+		t.Error("bcrypt of a plain text password still works")
+	}
+
+	for i := 0; i < 2; i++ {
+		out, err = eval(`std.native("repos")()`)
+		if err != nil || out != `["a","b/sub"]` {
+			t.Errorf("repos: got %s, %v", out, err)
+		}
+	}
+	_, err = gs.storer("c", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = eval(`std.native("repos")()`)
+	if err != nil || out != `["a","b/sub","c"]` {
+		t.Errorf("repos after creating c: got %s, %v", out, err)
+	}
+	f.mu.Lock()
+	full := 0
+	for _, prefix := range f.lists {
+		if prefix == "" {
+			full++
+		} else if prefix != repoIndexPrefix {
+			t.Errorf("listed %q", prefix)
+		}
+	}
+	f.mu.Unlock()
+	if full != 1 {
+		t.Errorf("whole bucket listed %d times", full)
+	}
+}
@@ -2,15 +2,21 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/andyleap/go-s3"
 	"golang.org/x/crypto/bcrypt"
@@ -34,21 +40,76 @@ type gitServe struct {
 	storers    map[string]storer.Storer
 	storerlock sync.RWMutex
 
-	t transport.Transport
-
 	tmpl *templater
 
+	mirrors     mirrors
+	pushMirrors pushMirrors
+	search      searchIndexer
+	pages       pagesCache
+	hooks       webhookQueue
+
+	secretHashes secretHashCache
+
+	auditLog *auditLog
+
+	sessions *sessions
+	oidc     oidcState
+
+	// pushes tracks receive-packs in flight, so shutdown can wait for them.
+	pushes sync.WaitGroup
+
+	// loading serializes config loads. Config is evaluated without holding
+	// mu, which every request takes, and only swapped in under it.
+	loading sync.Mutex
+
 	mu sync.Mutex
 	c  *Config
+	// configCommit is the admin repo commit c was loaded from, or zero if
+	// c is the built-in fallback.
+	configCommit plumbing.Hash
+	// configErr is the error from the last config load, if it failed.
+	configErr error
+
+	bootstrapOnce     sync.Once
+	bootstrapPassword []byte
 }
 
 type Config struct {
 	Users map[string]*User
 	Repos map[string]*RepoConfig
+
+	Credentials map[string]*Credential
+
+	// OIDC enables single sign-on through an OpenID Connect provider.
+	OIDC *OIDCConfig
+
+	// ModuleHosts are hosts, besides the one a request came in on, that Go
+	// modules served by the GOPROXY endpoint may be named under.
+	ModuleHosts []string
+
+	// ExternalURL is the URL clients reach the server at, e.g.
+	// https://git.example.com, for absolute links such as go-import tags
+	// and feeds. Without it they're built from the request, which behind a
+	// TLS terminating proxy has the wrong scheme.
+	ExternalURL string
+
+	// TrustedProxies are the IPs or CIDR ranges of reverse proxies whose
+	// X-Forwarded-Proto and X-Forwarded-Host headers are believed.
+	TrustedProxies []string
 }
 
 type User struct {
 	Password []byte
+
+	// Admin users can use instance-wide admin endpoints such as the audit
+	// log.
+	Admin bool
+
+	// Email links the user to an OIDC identity with the same email claim.
+	Email string
+
+	// Groups the user is always a member of, on top of any from OIDC.
+	Groups []string
 }
 
 type UserAccess struct {
@@ -57,6 +118,82 @@ type UserAccess struct {
 
 type RepoConfig struct {
 	Users map[string]UserAccess
+
+	// Groups grants access to every member of a group, whether from
+	// User.Groups or an OIDC groups claim.
+	Groups map[string]UserAccess
+
+	Webhooks []*Webhook
+
+	// Mirror makes the repo a read-only mirror of another git server.
+	Mirror *MirrorConfig
+
+	// PushMirrors are replicated to after every push.
+	PushMirrors []*PushMirror
+
+	// DefaultBranch is the branch HEAD points at when the repo is first
+	// created. Defaults to master. The admin repo is created before any
+	// config exists, so it takes ADMIN_DEFAULT_BRANCH instead.
+	DefaultBranch string
+
+	Description string
+	Topics      []string
+	Homepage    string
+
+	// Visibility is public, internal or private. Public repos can be
+	// browsed and cloned by anyone, internal ones by any logged in user and
+	// private ones only by users and groups granted access. If it's unset,
+	// repos where nobody has web access are public and the rest private.
+	// Grants to nobody only apply to public repos.
+	Visibility string
+
+	// Pages serves a static site from a branch of the repo.
+	Pages *PagesConfig
+
+	// Jsonnet sets how the render view evaluates the repo's jsonnet.
+	Jsonnet *JsonnetConfig
+}
+
+const (
+	VisibilityPublic   = "public"
+	VisibilityInternal = "internal"
+	VisibilityPrivate  = "private"
+)
+
+// visibilityAccess is what public and internal visibility grant.
+var visibilityAccess = []string{"web", "git-upload-pack"}
+
+func (rc *RepoConfig) visibility() string {
+	switch rc.Visibility {
+	case VisibilityPublic, VisibilityInternal, VisibilityPrivate:
+		return rc.Visibility
+	case "":
+		for _, a := range rc.Users["nobody"].Access {
+			if a == "web" {
+				return VisibilityPublic
+			}
+		}
+	}
+	return VisibilityPrivate
+}
+
+// RepoMeta describes a repo for the index and tree pages.
+type RepoMeta struct {
+	Path        string
+	Description string
+	Topics      []string
+	Homepage    string
+	Visibility  string
+}
+
+func (rc *RepoConfig) meta(p string) RepoMeta {
+	return RepoMeta{
+		Path:        p,
+		Description: rc.Description,
+		Topics:      rc.Topics,
+		Homepage:    rc.Homepage,
+		Visibility:  rc.visibility(),
+	}
 }
 
 func New(s3 *s3.Client) (*gitServe, error) {
@@ -69,37 +206,100 @@ func New(s3 *s3.Client) (*gitServe, error) {
 		if err != nil {
 			return nil, err
 		}
+		if branch, ok := os.LookupEnv("ADMIN_DEFAULT_BRANCH"); ok {
+			err = adminstorer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, branchRefName(branch)))
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	gs := &gitServe{
 		s3:        s3,
 		adminRepo: adminrepo,
 		storers:   map[string]storer.Storer{},
+		mirrors: mirrors{
+			status:  map[string]*MirrorStatus{},
+			running: map[string]bool{},
+		},
+		pushMirrors: pushMirrors{
+			status:  map[pushMirrorKey]*PushMirrorStatus{},
+			dirty:   map[pushMirrorKey]bool{},
+			running: map[pushMirrorKey]bool{},
+		},
+		search: searchIndexer{
+			running: map[string]bool{},
+			dirty:   map[string]bool{},
+		},
+		pages: pagesCache{
+			sites: map[string]*pagesSite{},
+		},
+		secretHashes: secretHashCache{
+			m: map[string]secretHash{},
+		},
 		tmpl: &templater{
 			path: "templates",
 		},
+		sessions: newSessions("", 12*time.Hour),
+		oidc: oidcState{
+			pending: map[string]*oidcPending{},
+		},
 	}
-	gs.t = server.NewServer(gs)
 	return gs, nil
 }
 
-func (gs *gitServe) GetJsonnet(r *git.Repository, file string) (string, error) {
-	adminref, err := gs.adminRepo.Reference(plumbing.Master, true)
+// configHead finds the commit to load the config from: HEAD of r or, if
+// HEAD points at a branch that doesn't exist, ADMIN_DEFAULT_BRANCH or else
+// the only branch. That way an admin repo created with the wrong default
+// branch still loads, and can then be fixed through the head endpoint.
+func configHead(r *git.Repository) (*plumbing.Reference, error) {
+	ref, err := r.Head()
+	if err != plumbing.ErrReferenceNotFound {
+		return ref, err
+	}
+	if branch, ok := os.LookupEnv("ADMIN_DEFAULT_BRANCH"); ok {
+		if ref, berr := r.Reference(branchRefName(branch), true); berr == nil {
+			return ref, nil
+		}
+	}
+	iter, berr := r.Branches()
+	if berr != nil {
+		return nil, berr
+	}
+	branches := []*plumbing.Reference{}
+	berr = iter.ForEach(func(ref *plumbing.Reference) error {
+		branches = append(branches, ref)
+		return nil
+	})
+	if berr != nil {
+		return nil, berr
+	}
+	if len(branches) == 1 {
+		return branches[0], nil
+	}
+	return nil, err
+}
+
+// GetJsonnet evaluates file at the HEAD of r, also returning the commit it
+// was evaluated at.
+func (gs *gitServe) GetJsonnet(r *git.Repository, file string) (string, plumbing.Hash, error) {
+	adminref, err := configHead(r)
 	if err != nil {
-		return "", err
+		return "", plumbing.ZeroHash, err
 	}
 
-	c, err := gs.adminRepo.CommitObject(adminref.Hash())
+	c, err := r.CommitObject(adminref.Hash())
 	if err != nil {
-		return "", err
+		return "", plumbing.ZeroHash, err
 	}
 
 	tree, err := c.Tree()
 	if err != nil {
-		return "", err
+		return "", plumbing.ZeroHash, err
 	}
 
-	return processJsonnet(tree, file)
+	j, err := gs.processJsonnet(tree, file)
+	return j, c.Hash, err
 }
 
 func (gs *gitServe) getConfig() *Config {
@@ -108,63 +308,241 @@ func (gs *gitServe) getConfig() *Config {
 	return gs.c
 }
 
+// loadConfig evaluates config.jsonnet from the admin repo. If that fails the
+// last good config is kept; an empty admin repo, or one whose config has
+// never loaded, gets the bootstrap config so that the admin user can push a
+// working config.
 func (gs *gitServe) loadConfig() error {
-	gs.mu.Lock()
-	defer gs.mu.Unlock()
-	j, err := gs.GetJsonnet(gs.adminRepo, "config.jsonnet")
+	gs.loading.Lock()
+	defer gs.loading.Unlock()
+	j, commit, err := gs.GetJsonnet(gs.adminRepo, "config.jsonnet")
 	if err != nil {
-		p, _ := bcrypt.GenerateFromPassword([]byte("admin"), bcrypt.DefaultCost)
-		gs.c = &Config{
-			Users: map[string]*User{
-				"admin": {
-					Password: p,
-				},
-			},
-			Repos: map[string]*RepoConfig{
-				"admin": {
-					Users: map[string]UserAccess{
-						"admin": {
-							Access: []string{"git-upload-pack", "git-receive-pack"},
-						},
-					},
-				},
-			},
+		metrics.observeReload(err)
+		empty, eerr := gs.adminRepoEmpty()
+		if eerr == nil && empty {
+			gs.setConfig(gs.bootstrapConfig(), plumbing.ZeroHash)
+			gs.audit(nil, &AuditEvent{
+				Action:  "config-reload",
+				Success: true,
+				Detail:  "admin repo is empty, using bootstrap config",
+			})
+			return nil
 		}
-		return nil
+		return gs.configFailed(err)
 	}
 
 	c := &Config{}
 	err = json.Unmarshal([]byte(j), &c)
+	if err == nil {
+		err = validateConfig(c)
+	}
+	metrics.observeReload(err)
+	if err != nil {
+		return gs.configFailed(err)
+	}
+	gs.setConfig(c, commit)
+	gs.audit(nil, &AuditEvent{
+		Action:  "config-reload",
+		Success: true,
+		Detail:  commit.String(),
+	})
+	return nil
+}
+
+// validateConfig rejects configs that would be unsafe to run with.
+func validateConfig(c *Config) error {
+	if c.ExternalURL != "" {
+		u, err := url.Parse(c.ExternalURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("ExternalURL %q isn't an http or https URL", c.ExternalURL)
+		}
+	}
+	for _, p := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(p); err != nil && net.ParseIP(p) == nil {
+			return fmt.Errorf("TrustedProxies entry %q isn't an IP or CIDR range", p)
+		}
+	}
+	err := validatePages(c)
 	if err != nil {
 		return err
 	}
-	gs.c = c
+	for name, rc := range c.Repos {
+		if name == metaPrefix || strings.HasPrefix(name, metaPrefix+"/") {
+			return fmt.Errorf("repo name %s is reserved", name)
+		}
+		if rc == nil {
+			return fmt.Errorf("repo %s has no config", name)
+		}
+		if rc.Jsonnet != nil {
+			for lib, l := range rc.Jsonnet.Libraries {
+				if l == nil || l.Repo == "" {
+					return fmt.Errorf("repo %s: jsonnet library %s has no repo", name, lib)
+				}
+			}
+		}
+	}
 	return nil
 }
 
-func (gs *gitServe) Load(ep *transport.Endpoint) (storer.Storer, error) {
-	rc := gs.getConfig().Repos[ep.Path]
+// setConfig swaps in a successfully loaded config.
+func (gs *gitServe) setConfig(c *Config, commit plumbing.Hash) {
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.c = c
+	gs.configCommit = commit
+	gs.configErr = nil
+}
+
+// configFailed records a failed config load. The current config is kept.
+// If no config has loaded yet nobody gets access, since the failure may be
+// temporary and the admin repo may well hold a config, and the load is
+// retried until it works. Only an empty admin repo gets the bootstrap
+// config.
+func (gs *gitServe) configFailed(err error) error {
+	log.Println("config load failed, keeping previous config:", err)
+	gs.audit(nil, &AuditEvent{
+		Action: "config-reload",
+		Detail: err.Error(),
+	})
+	gs.mu.Lock()
+	defer gs.mu.Unlock()
+	gs.configErr = err
+	if gs.c == nil {
+		gs.c = &Config{}
+		go gs.retryConfig()
+	}
+	return err
+}
+
+// configRetryWait is how long to wait before first retrying a config that
+// failed to load. It doubles after each failure, up to configRetryMax.
+var configRetryWait = time.Second
+
+const configRetryMax = 5 * time.Minute
+
+// retryConfig reloads the config with exponential backoff until a load
+// succeeds.
+func (gs *gitServe) retryConfig() {
+	wait := configRetryWait
+	for {
+		time.Sleep(wait)
+		gs.mu.Lock()
+		failed := gs.configErr != nil
+		gs.mu.Unlock()
+		if !failed || gs.loadConfig() == nil {
+			return
+		}
+		wait *= 2
+		if wait > configRetryMax {
+			wait = configRetryMax
+		}
+	}
+}
+
+// adminRepoEmpty reports whether the admin repo has no branches at all, as
+// opposed to a config that can't currently be read.
+func (gs *gitServe) adminRepoEmpty() (bool, error) {
+	iter, err := gs.adminRepo.Branches()
+	if err != nil {
+		return false, err
+	}
+	empty := true
+	err = iter.ForEach(func(*plumbing.Reference) error {
+		empty = false
+		return storer.ErrStop
+	})
+	if err != nil {
+		return false, err
+	}
+	return empty, nil
+}
 
-	found := false
-	u := rc.Users[ep.User]
-	for _, a := range u.Access {
-		if ep.Password == a {
-			found = true
-			break
+// bootstrapConfig lets the admin user push to the admin repo. The password
+// comes from ADMIN_PASSWORD, or is generated once per process and logged.
+func (gs *gitServe) bootstrapConfig() *Config {
+	gs.bootstrapOnce.Do(func() {
+		pass, ok := os.LookupEnv("ADMIN_PASSWORD")
+		if !ok {
+			b := make([]byte, 18)
+			_, err := rand.Read(b)
+			if err != nil {
+				log.Fatal(err)
+			}
+			pass = base64.RawURLEncoding.EncodeToString(b)
+			log.Printf("no config loaded; push a config.jsonnet to the admin repo as user admin with one-time password %s", pass)
 		}
+		p, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+		if err != nil {
+			log.Fatal(err)
+		}
+		gs.bootstrapPassword = p
+	})
+	return &Config{
+		Users: map[string]*User{
+			"admin": {
+				Password: gs.bootstrapPassword,
+				Admin:    true,
+			},
+		},
+		Repos: map[string]*RepoConfig{
+			"admin": {
+				Users: map[string]UserAccess{
+					"admin": {
+						Access: []string{"git-upload-pack", "git-receive-pack", "web", "admin"},
+					},
+				},
+			},
+		},
 	}
-	if !found {
+}
+
+// loader opens repos for one request, authorizing ep.User along with the
+// groups their login claimed.
+type loader struct {
+	gs     *gitServe
+	groups []string
+}
+
+func (l loader) Load(ep *transport.Endpoint) (storer.Storer, error) {
+	rc := l.gs.getConfig().Repos[ep.Path]
+	if rc == nil {
+		return nil, fmt.Errorf("Not Authorized")
+	}
+
+	if !l.gs.hasAccess(rc, ep.User, l.groups, ep.Password) {
 		return nil, fmt.Errorf("Not Authorized")
 	}
 
+	return l.gs.storer(ep.Path, rc)
+}
+
+func (l loader) openRepo(ep *transport.Endpoint) (*git.Repository, error) {
+	s, err := l.Load(ep)
+	if err != nil {
+		return nil, err
+	}
+	return git.Open(s.(storage.Storer), nil)
+}
+
+// groupsOf returns the groups the config makes user a member of.
+func (gs *gitServe) groupsOf(user string) []string {
+	if u, ok := gs.getConfig().Users[user]; ok {
+		return u.Groups
+	}
+	return nil
+}
+
+// storer returns the storage for the repo at p, creating the repo if it
+// doesn't exist yet. It does no authorization.
+func (gs *gitServe) storer(p string, rc *RepoConfig) (storer.Storer, error) {
 	gs.storerlock.Lock()
 	defer gs.storerlock.Unlock()
-	if s, ok := gs.storers[ep.Path]; ok {
+	if s, ok := gs.storers[p]; ok {
 		return s, nil
 	}
 	s := &S3Storage{
 		s3:   gs.s3,
-		base: ep.Path,
+		base: p,
 	}
 
 	_, err := git.Open(s, nil)
@@ -173,13 +551,101 @@ func (gs *gitServe) Load(ep *transport.Endpoint) (storer.Storer, error) {
 		if err != nil {
 			return nil, err
 		}
+		if rc != nil && rc.DefaultBranch != "" {
+			err = s.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, branchRefName(rc.DefaultBranch)))
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = gs.indexRepo(p)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	gs.storers[p] = s
+	return gs.storers[p], nil
+}
+
+// existingStorer is storer for callers that only read: it returns nil
+// rather than creating a repo that doesn't exist.
+func (gs *gitServe) existingStorer(p string) (storer.Storer, error) {
+	gs.storerlock.Lock()
+	defer gs.storerlock.Unlock()
+	if s, ok := gs.storers[p]; ok {
+		return s, nil
+	}
+	s := &S3Storage{
+		s3:   gs.s3,
+		base: p,
+	}
+	_, err := git.Open(s, nil)
+	if err == git.ErrRepositoryNotExists {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	gs.storers[p] = s
+	return s, nil
+}
+
+// afterPush runs everything that should happen once cmds have been applied
+// to repo, whether by a push from pusher or by a mirror sync.
+func (gs *gitServe) afterPush(repo string, pusher string, cmds []*packp.Command) {
+	rc := gs.getConfig().Repos[repo]
+	if rc == nil {
+		return
+	}
+	s, err := gs.storer(repo, rc)
+	if err != nil {
+		log.Println("after push open error", err)
+		return
+	}
+	r, err := git.Open(s.(storage.Storer), nil)
+	if err != nil {
+		log.Println("after push open error", err)
+		return
+	}
+	gs.fireWebhooks(r, repo, pusher, cmds)
+	gs.queuePushMirrors(repo)
+	gs.queueSearchIndex(repo)
+	gs.invalidatePages(repo)
+}
+
+// branchRefName accepts either a short branch name or a full reference name.
+func branchRefName(branch string) plumbing.ReferenceName {
+	if strings.HasPrefix(branch, "refs/") {
+		return plumbing.ReferenceName(branch)
 	}
+	return plumbing.NewBranchReferenceName(branch)
+}
 
-	gs.storers[ep.Path] = s
-	return gs.storers[ep.Path], nil
+// headName describes HEAD: the reference it points at, or its commit if
+// it's detached.
+func headName(head *plumbing.Reference) string {
+	if head.Type() == plumbing.SymbolicReference {
+		return head.Target().String()
+	}
+	return head.Hash().String()
+}
+
+// SetHead points the HEAD of r at branch, which must already exist.
+func (gs *gitServe) SetHead(r *git.Repository, branch string) error {
+	name := branchRefName(branch)
+	if !name.IsBranch() {
+		return fmt.Errorf("%s is not a branch", branch)
+	}
+	_, err := r.Reference(name, false)
+	if err != nil {
+		return fmt.Errorf("Unknown branch %s: %w", branch, err)
+	}
+	return r.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, name))
 }
 
 func main() {
+	sc := loadServerConfig()
+
 	key, ok := os.LookupEnv("S3_KEY")
 	if !ok {
 		log.Fatal("Could not find S3_KEY, please assert it is set.")
@@ -205,51 +671,195 @@ func main() {
 		log.Fatal(err)
 	}
 
-	g.loadConfig()
+	if p, ok := os.LookupEnv("AUDIT_LOG_FILE"); ok {
+		g.auditLog = newAuditLog(&fileAuditStore{path: p})
+	} else {
+		prefix, ok := os.LookupEnv("AUDIT_LOG_PREFIX")
+		if !ok {
+			prefix = "audit"
+		}
+		g.auditLog = newAuditLog(&s3AuditStore{s3: client, prefix: prefix})
+	}
+
+	g.sessions = newSessions(os.Getenv("SESSION_KEY"), envDuration("SESSION_TTL", 12*time.Hour))
+
+	err = g.loadConfig()
+	if err != nil {
+		log.Println("could not load config:", err)
+	}
 
-	http.HandleFunc("/", g.git)
-	http.ListenAndServe(":8080", nil)
+	go g.runMirrors()
+	g.queueAllPushMirrors()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", g.healthz)
+	mux.HandleFunc("/readyz", g.readyz)
+	mux.HandleFunc("/metrics", g.serveMetrics)
+	mux.HandleFunc("/login", g.login)
+	mux.HandleFunc("/logout", g.logout)
+	mux.HandleFunc("/login/oidc", g.oidcLogin)
+	mux.HandleFunc("/login/oidc/callback", g.oidcCallback)
+	mux.HandleFunc("/search", g.searchPage)
+	mux.HandleFunc(goProxyPrefix, g.goProxy)
+	mux.HandleFunc("/api/v1/", g.api)
+	mux.HandleFunc("/", g.git)
+	err = g.serve(sc, g.pagesHandler(mux))
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// matches reports whether m passes the index page filters: q searches the
+// path, description and topics, topic and visibility must match exactly.
+func (m RepoMeta) matches(q string, topic string, visibility string) bool {
+	if visibility != "" && m.Visibility != visibility {
+		return false
+	}
+	if topic != "" {
+		found := false
+		for _, t := range m.Topics {
+			if strings.EqualFold(t, topic) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if q == "" {
+		return true
+	}
+	q = strings.ToLower(q)
+	if strings.Contains(strings.ToLower(m.Path), q) || strings.Contains(strings.ToLower(m.Description), q) {
+		return true
+	}
+	for _, t := range m.Topics {
+		if strings.Contains(strings.ToLower(t), q) {
+			return true
+		}
+	}
+	return false
 }
 
 func (gs *gitServe) index(rw http.ResponseWriter, req *http.Request) {
 	c := gs.getConfig()
 
-	publicRepos := []struct {
-		Path string
-		Repo *RepoConfig
-	}{}
+	user, groups, ok := gs.authenticate(req)
+	if !ok {
+		user = "nobody"
+	}
+	csrf := ""
+	if s, ok := gs.sessionUser(req); ok && s.User == user {
+		csrf = s.CSRF
+	}
 
+	q := req.FormValue("q")
+	topic := req.FormValue("topic")
+	visibility := req.FormValue("visibility")
+
+	repos := []RepoMeta{}
 	for name, repo := range c.Repos {
-		for _, access := range repo.Users["nobody"].Access {
-			if access == "web" {
-				publicRepos = append(publicRepos, struct {
-					Path string
-					Repo *RepoConfig
-				}{name, repo})
-			}
+		if !gs.hasAccess(repo, user, groups, "web") {
+			continue
+		}
+		m := repo.meta(name)
+		if m.matches(q, topic, visibility) {
+			repos = append(repos, m)
 		}
 	}
+	sort.Slice(repos, func(i, j int) bool {
+		return repos[i].Path < repos[j].Path
+	})
 
-	gs.tmpl.Render("index.html", struct {
-		PublicRepos []struct {
-			Path string
-			Repo *RepoConfig
-		}
+	err := gs.tmpl.Render("index.html", struct {
+		User  string
+		CSRF  string
+		Repos []RepoMeta
+
+		Query      string
+		Topic      string
+		Visibility string
 	}{
-		PublicRepos: publicRepos,
+		User:  user,
+		CSRF:  csrf,
+		Repos: repos,
+
+		Query:      q,
+		Topic:      topic,
+		Visibility: visibility,
 	}, rw)
-	return
+	if err != nil {
+		log.Println(err)
+	}
 }
 
 type RepoInfo struct {
+	Head     string
 	Branches []string
+	Tags     []*TagInfo
+}
+
+// TagInfo describes a tag for the refs page. Tagger and Message are only set
+// for annotated tags.
+type TagInfo struct {
+	Name      string
+	Commit    string
+	Annotated bool
+	Message   string
+	Tagger    object.Signature
 }
 
 type RequestInfo struct {
+	Meta     RepoMeta
 	RepoRoot string
 	Dir      string
 	Ref      string
 	RepoInfo *RepoInfo
+	Mirror   *MirrorStatus
+
+	PushMirrors []PushMirrorStatus
+}
+
+// refNames returns the short names of every branch and tag in ri.
+func (ri *RepoInfo) refNames() map[string]bool {
+	names := map[string]bool{}
+	for _, b := range ri.Branches {
+		names[b] = true
+	}
+	for _, t := range ri.Tags {
+		names[t.Name] = true
+	}
+	return names
+}
+
+// refNames returns the short names of every branch and tag of r.
+func refNames(r *git.Repository) (map[string]bool, error) {
+	iter, err := r.References()
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name().IsBranch() || ref.Name().IsTag() {
+			names[ref.Name().Short()] = true
+		}
+		return nil
+	})
+	return names, err
+}
+
+// splitRefPath splits "<ref>/<path>". Branch and tag names can contain
+// slashes, so the longest one in names that rest starts with wins; any other
+// ref, such as a commit hash, ends at the first slash.
+func splitRefPath(names map[string]bool, rest string) (ref string, p string) {
+	elems := strings.Split(rest, "/")
+	for i := len(elems); i > 1; i-- {
+		if name := strings.Join(elems[:i], "/"); names[name] {
+			return name, strings.Join(elems[i:], "/")
+		}
+	}
+	return elems[0], strings.Join(elems[1:], "/")
 }
 
 func (gs *gitServe) repoInfo(r *git.Repository) (*RepoInfo, error) {
@@ -265,19 +875,163 @@ func (gs *gitServe) repoInfo(r *git.Repository) (*RepoInfo, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	titer, err := r.Tags()
+	if err != nil {
+		return nil, err
+	}
+	err = titer.ForEach(func(p *plumbing.Reference) error {
+		ti := &TagInfo{
+			Name:   p.Name().Short(),
+			Commit: p.Hash().String(),
+		}
+		if t, err := r.TagObject(p.Hash()); err == nil {
+			ti.Annotated = true
+			ti.Message = t.Message
+			ti.Tagger = t.Tagger
+			ti.Commit = t.Target.String()
+		}
+		ri.Tags = append(ri.Tags, ti)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	head, err := r.Storer.Reference(plumbing.HEAD)
+	if err == nil && head.Type() == plumbing.SymbolicReference {
+		ri.Head = head.Target().Short()
+	} else if err == nil {
+		ri.Head = head.Hash().String()
+	} else if len(ri.Branches) > 0 {
+		ri.Head = ri.Branches[0]
+	}
 	return ri, nil
 }
 
-func (g *gitServe) git(rw http.ResponseWriter, req *http.Request) {
+// authenticate checks the credentials on req: basic auth, an OIDC ID token
+// or a web UI session cookie. Requests without credentials are treated as the user
+// "nobody"; ok is false if credentials were given but are wrong. groups are
+// those claimed by the OIDC login behind the request, which only count for
+// this request.
+//
+// Credentials are checked on every request, so only failures are audited;
+// successful logins are recorded when a session is started.
+func (g *gitServe) authenticate(req *http.Request) (user string, groups []string, ok bool) {
+	if auth := req.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		user, groups, err := g.bearerUser(strings.TrimPrefix(auth, "Bearer "))
+		if err != nil {
+			g.audit(req, &AuditEvent{
+				Action: "login",
+				User:   user,
+				Detail: "oidc token: " + err.Error(),
+			})
+			return "", nil, false
+		}
+		return user, groups, true
+	}
+	user, pass, ok := req.BasicAuth()
+	if !ok {
+		if s, ok := g.sessionUser(req); ok {
+			return s.User, s.Groups, true
+		}
+		return "nobody", nil, true
+	}
+	if !g.checkPassword(user, pass) {
+		g.audit(req, &AuditEvent{
+			Action: "login",
+			User:   user,
+		})
+		return "", nil, false
+	}
+	return user, nil, true
+}
+
+func (g *gitServe) checkPassword(user string, pass string) bool {
+	u, ok := g.getConfig().Users[user]
+	return ok && bcrypt.CompareHashAndPassword(u.Password, []byte(pass)) == nil
+}
+
+// webUnauthorized rejects a web UI request. Anonymous visitors are sent to
+// the login page rather than getting a basic auth prompt.
+func webUnauthorized(rw http.ResponseWriter, req *http.Request, user string) {
+	if user == "nobody" {
+		loginRedirect(rw, req)
+		return
+	}
+	http.Error(rw, "forbidden", 403)
+}
+
+type view struct {
+	Name   string
+	NoArgs bool
+}
+
+// webViews are the path segments that separate a repo path from the view
+// being requested, e.g. "andyleap/gitserve/blob/master/main.go". Views that
+// take no arguments only match at the end of the path.
+var webViews = []view{
+	{"blob", false},
+	{"commit", false},
+	{"blame", false},
+	{"compare", false},
+	{"log", false},
+	{"archive", false},
+	{"render", false},
+	{"refs", true},
+	{"tags.atom", true},
+	{"head", true},
+}
+
+// splitView splits a web request path into the repo path, the view name and
+// whatever follows the view. The earliest view segment wins, so repo paths
+// may not contain a directory named after a view.
+func splitView(p string, views []view) (repo string, name string, rest string) {
+	best := -1
+	for _, v := range views {
+		i := -1
+		if !v.NoArgs {
+			i = strings.Index(p, "/"+v.Name+"/")
+		}
+		if i < 0 && strings.HasSuffix(p, "/"+v.Name) {
+			i = len(p) - len(v.Name) - 1
+		}
+		if i >= 0 && (best < 0 || i < best) {
+			best = i
+			name = v.Name
+		}
+	}
+	if best < 0 {
+		return p, "", ""
+	}
+	rest = strings.TrimPrefix(p[best+len(name)+1:], "/")
+	return p[:best], name, rest
+}
+
+// git serves everything under a repo path: the smart HTTP protocol, the
+// web views and the feeds.
+func (g *gitServe) git(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	rw := &metricsWriter{ResponseWriter: w, code: 200}
+	service := "web/index"
+	defer func() {
+		metrics.observeRequest(service, rw.code, start)
+	}()
 
 	if req.URL.Path == "/" {
 		g.index(rw, req)
 		return
 	}
 
+	if req.FormValue("go-get") == "1" {
+		service = "web/go-get"
+		g.goGet(rw, req)
+		return
+	}
+
 	ep := &transport.Endpoint{}
 
-	service := req.FormValue("service")
+	service = req.FormValue("service")
 	p := req.URL.Path
 	p = strings.TrimPrefix(p, "/")
 	p = strings.TrimSuffix(p, "/")
@@ -288,69 +1042,64 @@ func (g *gitServe) git(rw http.ResponseWriter, req *http.Request) {
 	} else if strings.HasSuffix(p, "/git-receive-pack") {
 		service = "git-receive-pack"
 		p = strings.TrimSuffix(p, "/git-receive-pack")
+	} else if strings.HasSuffix(p, "/git-upload-archive") {
+		service = "git-upload-archive"
+		p = strings.TrimSuffix(p, "/git-upload-archive")
+	}
+	switch service {
+	case "", "git-upload-pack", "git-receive-pack", "git-upload-archive":
+	default:
+		// service can come from the query string, so it mustn't reach the
+		// metrics labels unchecked
+		service = "unknown"
+		http.Error(rw, "unknown service", 403)
+		return
 	}
 	ep.Password = service
+	if service == "git-upload-archive" {
+		// archives expose nothing a clone wouldn't
+		ep.Password = "git-upload-pack"
+	}
 
 	if service == "" {
 		ep.Password = "web"
-		parts := strings.SplitN(p, "/blob/", 2)
-		service = "web/blob"
-		if len(parts) != 2 {
-			parts = strings.SplitN(p, "/commit/", 2)
-			service = "web/commit"
-			if len(parts) != 2 {
-				_, ok := g.getConfig().Repos[p]
-				parts = []string{p, ""}
-				service = "web/blob"
-				if !ok {
-					log.Println(p)
-					http.Error(rw, "bad request", 400)
-					return
-				}
+		var view string
+		p, view, ep.Host = splitView(p, webViews)
+		service = "web/" + view
+		if view == "head" && req.Method != http.MethodGet {
+			ep.Password = "admin"
+		}
+		if view == "" {
+			_, ok := g.getConfig().Repos[p]
+			service = "web/blob"
+			if !ok {
+				log.Println(p)
+				http.Error(rw, "bad request", 400)
+				return
 			}
 		}
-		p = parts[0]
-		ep.Host = parts[1]
 	}
 
 	log.Println(service, p)
 
-	if user, pass, ok := req.BasicAuth(); ok {
-		u, ok := g.getConfig().Users[user]
-		if !ok {
-			rw.Header().Set("WWW-Authenticate", "Basic")
-			http.Error(rw, "unauthorized", 401)
-			return
-		}
-		if bcrypt.CompareHashAndPassword(u.Password, []byte(pass)) != nil {
-			rw.Header().Set("WWW-Authenticate", "Basic")
-			http.Error(rw, "unauthorized", 401)
-			return
-		}
-		ep.User = user
-	} else {
-		ep.User = "nobody"
+	user, groups, ok := g.authenticate(req)
+	if !ok {
+		rw.Header().Set("WWW-Authenticate", "Basic")
+		http.Error(rw, "unauthorized", 401)
+		return
 	}
+	ep.User = user
+	ld := loader{gs: g, groups: groups}
 
 	ep.Path = p
 
 	switch service {
-	case "web/blob", "web/commit":
-		s, err := g.Load(ep)
+	case "web/blob", "web/commit", "web/refs", "web/blame", "web/render":
+		s, err := ld.Load(ep)
 		if err != nil {
-			rw.Header().Set("WWW-Authenticate", "Basic")
-			http.Error(rw, "unauthorized", 401)
+			webUnauthorized(rw, req, ep.User)
 			return
 		}
-		refName := "master"
-		path := ""
-		if ep.Host != "" {
-			parts := strings.SplitN(ep.Host, "/", 2)
-			refName = parts[0]
-			if len(parts) == 2 {
-				path = parts[1]
-			}
-		}
 		r, err := git.Open(s.(storage.Storer), nil)
 		if err != nil {
 			log.Println(err)
@@ -364,12 +1113,29 @@ func (g *gitServe) git(rw http.ResponseWriter, req *http.Request) {
 			http.Error(rw, "bad request", 400)
 			return
 		}
+		refName, path := splitRefPath(repoInfo.refNames(), ep.Host)
+		if refName == "" {
+			refName = repoInfo.Head
+		}
 		ri := &RequestInfo{
+			Meta:     g.getConfig().Repos[p].meta(p),
 			RepoRoot: p,
 			Dir:      path,
 			Ref:      refName,
 			RepoInfo: repoInfo,
 		}
+		if rc := g.getConfig().Repos[p]; rc != nil && rc.Mirror != nil {
+			ri.Mirror = g.MirrorStatus(p)
+			if ri.Mirror == nil {
+				ri.Mirror = &MirrorStatus{URL: rc.Mirror.URL}
+			}
+		}
+		ri.PushMirrors = g.PushMirrorStatus(p)
+
+		if service == "web/refs" {
+			g.RenderRefs(ri, rw, req)
+			return
+		}
 
 		chash, err := r.ResolveRevision(plumbing.Revision(refName))
 		if err != nil {
@@ -386,7 +1152,18 @@ func (g *gitServe) git(rw http.ResponseWriter, req *http.Request) {
 		}
 
 		if service == "web/commit" {
-			//g.RenderCommit(c, rw, req)
+			g.RenderCommit(c, ri, rw, req)
+			return
+		}
+
+		if service == "web/blame" {
+			br, err := g.blame(p, c, path)
+			if err != nil {
+				log.Println(err)
+				http.Error(rw, "not found", 404)
+				return
+			}
+			g.RenderBlame(br, ri, rw, req)
 			return
 		}
 
@@ -397,6 +1174,15 @@ func (g *gitServe) git(rw http.ResponseWriter, req *http.Request) {
 			return
 		}
 
+		if service == "web/render" {
+			if path == "" {
+				http.Error(rw, "expected <ref>/<file>", 400)
+				return
+			}
+			g.RenderJsonnet(g.repoImporter(tree, g.getConfig().Repos[p], ep.User, groups), path, rw, req)
+			return
+		}
+
 		if path == "" {
 			g.RenderTree(tree, ri, rw, req)
 			return
@@ -428,12 +1214,161 @@ func (g *gitServe) git(rw http.ResponseWriter, req *http.Request) {
 		}
 		g.RenderTree(t, ri, rw, req)
 
+	case "web/compare":
+		r, err := ld.openRepo(ep)
+		if err != nil {
+			webUnauthorized(rw, req, ep.User)
+			return
+		}
+		base, head, ok := splitCompare(ep.Host)
+		if !ok {
+			http.Error(rw, "expected <base>...<head>", 400)
+			return
+		}
+		baseCommit, err := resolveCommit(r, base)
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("unknown revision %s", base), 404)
+			return
+		}
+		headCommit, err := resolveCommit(r, head)
+		if err != nil {
+			http.Error(rw, fmt.Sprintf("unknown revision %s", head), 404)
+			return
+		}
+		bases, err := headCommit.MergeBase(baseCommit)
+		if err != nil {
+			log.Println(err)
+			http.Error(rw, "bad request", 400)
+			return
+		}
+		if len(bases) == 0 {
+			http.Error(rw, fmt.Sprintf("%s and %s have no common history", base, head), 400)
+			return
+		}
+		ci := &CompareInfo{
+			Base:      base,
+			Head:      head,
+			MergeBase: bases[0].Hash.String(),
+		}
+		ci.Commits, ci.Truncated, err = compareCommits(r, headCommit, bases)
+		if err != nil {
+			log.Println(err)
+			http.Error(rw, "bad request", 400)
+			return
+		}
+		baseTree, err := bases[0].Tree()
+		if err != nil {
+			log.Println(err)
+			http.Error(rw, "bad request", 400)
+			return
+		}
+		headTree, err := headCommit.Tree()
+		if err != nil {
+			log.Println(err)
+			http.Error(rw, "bad request", 400)
+			return
+		}
+		d, err := diffTrees(req.Context(), baseTree, headTree)
+		if err != nil {
+			log.Println(err)
+			http.Error(rw, "bad request", 400)
+			return
+		}
+		ri := &RequestInfo{
+			Meta:     g.getConfig().Repos[p].meta(p),
+			RepoRoot: p,
+			Ref:      head,
+		}
+		g.RenderCompare(ci, d, ri, rw, req)
+
+	case "web/log", "web/tags.atom":
+		r, err := ld.openRepo(ep)
+		if err != nil {
+			feedUnauthorized(rw)
+			return
+		}
+		if service == "web/tags.atom" {
+			g.tagsFeed(r, p, rw, req)
+			return
+		}
+		if !strings.HasSuffix(ep.Host, ".atom") {
+			http.Error(rw, "not found", 404)
+			return
+		}
+		g.logFeed(r, p, strings.TrimSuffix(ep.Host, ".atom"), rw, req)
+
+	case "web/archive":
+		r, err := ld.openRepo(ep)
+		if err != nil {
+			webUnauthorized(rw, req, ep.User)
+			return
+		}
+		refName, format, contentType, ok := splitArchiveName(ep.Host)
+		if !ok {
+			http.Error(rw, "unknown archive format", 400)
+			return
+		}
+		c, err := resolveCommit(r, refName)
+		if err != nil {
+			log.Println(err)
+			http.Error(rw, "not found", 404)
+			return
+		}
+		tree, err := c.Tree()
+		if err != nil {
+			log.Println(err)
+			http.Error(rw, "bad request", 400)
+			return
+		}
+		prefix := archivePrefix(p, refName)
+		rw.Header().Set("Content-Type", contentType)
+		rw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", strings.TrimSuffix(prefix, "/")+strings.TrimPrefix(ep.Host, refName)))
+		err = writeArchive(rw, format, prefix, r, tree, c.Committer.When, nil)
+		if err != nil {
+			log.Println("archive error", err)
+		}
+
+	case "web/head":
+		r, err := ld.openRepo(ep)
+		if err != nil {
+			webUnauthorized(rw, req, ep.User)
+			return
+		}
+		if req.Method != http.MethodGet {
+			err = g.SetHead(r, req.FormValue("ref"))
+			g.audit(req, &AuditEvent{
+				Action:  "set-head",
+				User:    ep.User,
+				Repo:    p,
+				Success: err == nil,
+				Detail:  req.FormValue("ref"),
+			})
+			if err != nil {
+				http.Error(rw, err.Error(), 400)
+				return
+			}
+		}
+		head, err := r.Storer.Reference(plumbing.HEAD)
+		if err != nil {
+			http.Error(rw, err.Error(), 404)
+			return
+		}
+		rw.Header().Set("Content-Type", "text/plain")
+		fmt.Fprintln(rw, headName(head))
+
+	case "git-upload-archive":
+		r, err := ld.openRepo(ep)
+		if err != nil {
+			g.gitUnauthorized(service, ep, rw, req)
+			return
+		}
+		g.uploadArchive(r, rw, req)
+
 	case "git-upload-pack":
-		ups, err := g.t.NewUploadPackSession(ep, nil)
+		ups, err := server.NewServer(ld).NewUploadPackSession(ep, nil)
 
 		if err != nil {
-			rw.Header().Set("WWW-Authenticate", "Basic")
-			http.Error(rw, "unauthorized", 401)
+			g.gitUnauthorized(service, ep, rw, req)
 			return
 		}
 		if req.Method == http.MethodGet {
@@ -464,18 +1399,28 @@ func (g *gitServe) git(rw http.ResponseWriter, req *http.Request) {
 		fmt.Println(upreq)
 
 		upresp, err := ups.UploadPack(req.Context(), upreq)
+		g.audit(req, &AuditEvent{
+			Action:  service,
+			User:    ep.User,
+			Repo:    p,
+			Success: err == nil,
+		})
 		if err != nil {
 			http.Error(rw, err.Error(), 400)
 			return
 		}
 		rw.Header().Set("Content-Type", "application/x-"+service+"-result")
 		upresp.Encode(rw)
+		metrics.bytesPulled.Add(float64(rw.written), repoLabel(p, g.getConfig().Repos[p]))
 
 	case "git-receive-pack":
-		urp, err := g.t.NewReceivePackSession(ep, nil)
+		if rc := g.getConfig().Repos[p]; rc != nil && rc.Mirror != nil {
+			http.Error(rw, "repository is a read-only mirror", 403)
+			return
+		}
+		urp, err := server.NewServer(ld).NewReceivePackSession(ep, nil)
 		if err != nil {
-			rw.Header().Set("WWW-Authenticate", "Basic")
-			http.Error(rw, "unauthorized", 401)
+			g.gitUnauthorized(service, ep, rw, req)
 			return
 		}
 		if req.Method == http.MethodGet {
@@ -492,8 +1437,14 @@ func (g *gitServe) git(rw http.ResponseWriter, req *http.Request) {
 			advref.Encode(rw)
 			return
 		}
+		g.pushes.Add(1)
+		defer g.pushes.Done()
+		body := &countingReader{ReadCloser: req.Body}
+		defer func() {
+			metrics.bytesPushed.Add(float64(body.read), repoLabel(p, g.getConfig().Repos[p]))
+		}()
 		rureq := packp.NewReferenceUpdateRequest()
-		err = rureq.Decode(req.Body)
+		err = rureq.Decode(body)
 		if err != nil {
 			http.Error(rw, err.Error(), 400)
 			return
@@ -502,6 +1453,17 @@ func (g *gitServe) git(rw http.ResponseWriter, req *http.Request) {
 		fmt.Println(rureq)
 
 		rsresp, err := urp.ReceivePack(req.Context(), rureq)
+		ev := &AuditEvent{
+			Action:  service,
+			User:    ep.User,
+			Repo:    p,
+			Success: err == nil,
+			Refs:    pushRefs(rureq.Commands),
+		}
+		if err != nil {
+			ev.Detail = err.Error()
+		}
+		g.audit(req, ev)
 		if err != nil {
 			log.Println("Receive pack error", err)
 			http.Error(rw, err.Error(), 400)
@@ -511,9 +1473,23 @@ func (g *gitServe) git(rw http.ResponseWriter, req *http.Request) {
 		rsresp.Encode(rw)
 
 		g.loadConfig()
+		g.afterPush(ep.Path, ep.User, rureq.Commands)
 	}
 }
 
+// gitUnauthorized refuses a git request for a repo ep.User can't use with
+// service, and records the refusal in the audit log.
+func (g *gitServe) gitUnauthorized(service string, ep *transport.Endpoint, rw http.ResponseWriter, req *http.Request) {
+	g.audit(req, &AuditEvent{
+		Action: service,
+		User:   ep.User,
+		Repo:   ep.Path,
+		Detail: "not authorized",
+	})
+	rw.Header().Set("WWW-Authenticate", "Basic")
+	http.Error(rw, "unauthorized", 401)
+}
+
 type Entry struct {
 	Name string
 }
@@ -550,6 +1526,17 @@ func (gs *gitServe) RenderTree(t *object.Tree, ri *RequestInfo, rw http.Response
 	}
 }
 
+func (gs *gitServe) RenderRefs(ri *RequestInfo, rw http.ResponseWriter, req *http.Request) {
+	err := gs.tmpl.Render("refs.html", struct {
+		RequestInfo *RequestInfo
+	}{
+		RequestInfo: ri,
+	}, rw)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
 func (gs *gitServe) RenderBlob(b *object.Blob, rw http.ResponseWriter, req *http.Request) {
 	rc, err := b.Reader()
 	if err != nil {
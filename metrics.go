@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andyleap/go-s3"
+)
+
+// durationBuckets are the histogram buckets, in seconds, for request and S3
+// latencies. Git transfers can run for minutes, so they go well past what a
+// typical web service would need.
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 300}
+
+// counterVec is a Prometheus counter partitioned by label values.
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name string, help string, labels ...string) *counterVec {
+	return &counterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: map[string]float64{},
+	}
+}
+
+func (cv *counterVec) Add(v float64, labelValues ...string) {
+	k := strings.Join(labelValues, "\x00")
+	cv.mu.Lock()
+	cv.values[k] += v
+	cv.mu.Unlock()
+}
+
+func (cv *counterVec) Inc(labelValues ...string) {
+	cv.Add(1, labelValues...)
+}
+
+func (cv *counterVec) write(w io.Writer) {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", cv.name, cv.help, cv.name)
+	for _, k := range sortedKeys(cv.values) {
+		fmt.Fprintf(w, "%s%s %g\n", cv.name, formatLabels(cv.labels, k, "", ""), cv.values[k])
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// histogramVec is a Prometheus histogram partitioned by label values.
+type histogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+func newHistogramVec(name string, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  map[string]*histogram{},
+	}
+}
+
+func (hv *histogramVec) Observe(v float64, labelValues ...string) {
+	k := strings.Join(labelValues, "\x00")
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+	h, ok := hv.values[k]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(hv.buckets))}
+		hv.values[k] = h
+	}
+	for i, b := range hv.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+func (hv *histogramVec) write(w io.Writer) {
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", hv.name, hv.help, hv.name)
+	keys := make([]string, 0, len(hv.values))
+	for k := range hv.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h := hv.values[k]
+		for i, b := range hv.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name, formatLabels(hv.labels, k, "le", fmt.Sprint(b)), h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", hv.name, formatLabels(hv.labels, k, "le", "+Inf"), h.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", hv.name, formatLabels(hv.labels, k, "", ""), h.sum)
+		fmt.Fprintf(w, "%s_count%s %d\n", hv.name, formatLabels(hv.labels, k, "", ""), h.count)
+	}
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels renders the label set stored under key, plus an optional
+// extra label such as a histogram's le.
+func formatLabels(names []string, key string, extraName string, extraValue string) string {
+	pairs := []string{}
+	if len(names) > 0 {
+		values := strings.Split(key, "\x00")
+		for i, n := range names {
+			pairs = append(pairs, n+`="`+labelEscaper.Replace(values[i])+`"`)
+		}
+	}
+	if extraName != "" {
+		pairs = append(pairs, extraName+`="`+extraValue+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// serverMetrics holds everything exported on /metrics.
+type serverMetrics struct {
+	requests        *counterVec
+	requestDuration *histogramVec
+
+	s3Ops      *counterVec
+	s3Errors   *counterVec
+	s3Duration *histogramVec
+
+	bytesPushed *counterVec
+	bytesPulled *counterVec
+
+	configReloads *counterVec
+
+	mu               sync.Mutex
+	lastReload       time.Time
+	lastReloadResult string
+}
+
+var metrics = &serverMetrics{
+	requests:        newCounterVec("gitserve_requests_total", "HTTP requests by service and status code.", "service", "code"),
+	requestDuration: newHistogramVec("gitserve_request_duration_seconds", "HTTP request latency by service.", durationBuckets, "service"),
+
+	s3Ops:      newCounterVec("gitserve_s3_operations_total", "S3 operations made by repo storage.", "op"),
+	s3Errors:   newCounterVec("gitserve_s3_errors_total", "S3 operations made by repo storage that failed.", "op"),
+	s3Duration: newHistogramVec("gitserve_s3_operation_duration_seconds", "S3 operation latency.", durationBuckets, "op"),
+
+	bytesPushed: newCounterVec("gitserve_pushed_bytes_total", "Bytes received by git-receive-pack. Only public repos are named.", "repo"),
+	bytesPulled: newCounterVec("gitserve_pulled_bytes_total", "Bytes sent by git-upload-pack. Only public repos are named.", "repo"),
+
+	configReloads: newCounterVec("gitserve_config_reloads_total", "Config reloads by result.", "result"),
+}
+
+// hiddenRepoLabel stands in for the names of repos that aren't public in
+// per-repo metrics, since /metrics is served to anyone.
+const hiddenRepoLabel = "(not public)"
+
+// repoLabel is the repo label of per-repo metrics for the repo name.
+func repoLabel(name string, rc *RepoConfig) string {
+	if rc == nil || rc.visibility() != VisibilityPublic {
+		return hiddenRepoLabel
+	}
+	return name
+}
+
+// observeS3 records an S3 operation that started at start. Missing keys are
+// an expected outcome of lookups and aren't counted as errors.
+func (m *serverMetrics) observeS3(op string, start time.Time, err error) {
+	m.s3Ops.Inc(op)
+	m.s3Duration.Observe(time.Since(start).Seconds(), op)
+	if err == nil {
+		return
+	}
+	if s3err, ok := err.(s3.Error); ok && s3err.Code == "NoSuchKey" {
+		return
+	}
+	m.s3Errors.Inc(op)
+}
+
+func (m *serverMetrics) observeRequest(service string, code int, start time.Time) {
+	m.requests.Inc(service, fmt.Sprint(code))
+	m.requestDuration.Observe(time.Since(start).Seconds(), service)
+}
+
+func (m *serverMetrics) observeReload(err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+	m.configReloads.Inc(result)
+	m.mu.Lock()
+	m.lastReload = time.Now()
+	m.lastReloadResult = result
+	m.mu.Unlock()
+}
+
+// metricsWriter records the status code and size of a response.
+type metricsWriter struct {
+	http.ResponseWriter
+	code    int
+	written int64
+}
+
+func (mw *metricsWriter) WriteHeader(code int) {
+	mw.code = code
+	mw.ResponseWriter.WriteHeader(code)
+}
+
+func (mw *metricsWriter) Write(b []byte) (int, error) {
+	n, err := mw.ResponseWriter.Write(b)
+	mw.written += int64(n)
+	return n, err
+}
+
+func (mw *metricsWriter) Flush() {
+	if f, ok := mw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.ReadCloser
+	read int64
+}
+
+func (cr *countingReader) Read(b []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(b)
+	cr.read += int64(n)
+	return n, err
+}
+
+func (gs *gitServe) serveMetrics(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m := metrics
+	m.requests.write(rw)
+	m.requestDuration.write(rw)
+	m.s3Ops.write(rw)
+	m.s3Errors.write(rw)
+	m.s3Duration.write(rw)
+	m.bytesPushed.write(rw)
+	m.bytesPulled.write(rw)
+	m.configReloads.write(rw)
+
+	gs.storerlock.RLock()
+	storers := len(gs.storers)
+	gs.storerlock.RUnlock()
+	fmt.Fprintf(rw, "# HELP gitserve_cached_storers Repo storers held in memory.\n# TYPE gitserve_cached_storers gauge\ngitserve_cached_storers %d\n", storers)
+
+	m.mu.Lock()
+	lastReload, lastResult := m.lastReload, m.lastReloadResult
+	m.mu.Unlock()
+	if !lastReload.IsZero() {
+		success := 0
+		if lastResult == "success" {
+			success = 1
+		}
+		fmt.Fprintf(rw, "# HELP gitserve_config_last_reload_timestamp_seconds When the config was last reloaded.\n# TYPE gitserve_config_last_reload_timestamp_seconds gauge\ngitserve_config_last_reload_timestamp_seconds %d\n", lastReload.Unix())
+		fmt.Fprintf(rw, "# HELP gitserve_config_last_reload_success Whether the last config reload succeeded.\n# TYPE gitserve_config_last_reload_success gauge\ngitserve_config_last_reload_success %d\n", success)
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestUnknownServiceLabel(t *testing.T) {
+	tr := newTestRepo(t)
+	tr.branch("master", tr.commit("init", map[string]string{"a": "a"}))
+	gs := newTestServer(&Config{Repos: map[string]*RepoConfig{"repo": {Users: public}}}, map[string]*testRepo{"repo": tr})
+
+	rr := get(http.HandlerFunc(gs.git), "/repo/info/refs?service=evil-label")
+	if rr.Code != 403 {
+		t.Errorf("unknown service: got %d", rr.Code)
+	}
+	rr = get(http.HandlerFunc(gs.git), "/repo/info/refs?service=git-upload-pack")
+	if rr.Code != 200 {
+		t.Errorf("git-upload-pack: got %d", rr.Code)
+	}
+
+	buf := &strings.Builder{}
+	metrics.requests.write(buf)
+	if strings.Contains(buf.String(), "evil-label") {
+		t.Errorf("query string reached metrics labels:\n%s", buf)
+	}
+	if !strings.Contains(buf.String(), `service="unknown"`) {
+		t.Errorf("unknown service not counted:\n%s", buf)
+	}
+}
+
+func TestRepoLabel(t *testing.T) {
+	gs := newTestServer(&Config{Repos: map[string]*RepoConfig{
+		"open":     {Users: public},
+		"internal": {Visibility: VisibilityInternal},
+		"secret":   {},
+	}}, nil)
+	tests := map[string]string{
+		"open":     "open",
+		"internal": hiddenRepoLabel,
+		"secret":   hiddenRepoLabel,
+		"missing":  hiddenRepoLabel,
+	}
+	for name, want := range tests {
+		if got := repoLabel(name, gs.getConfig().Repos[name]); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
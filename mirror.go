@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	githttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage"
+)
+
+// Credential is a named set of credentials for talking to other git
+// servers. The password can be given inline or read from an environment
+// variable so it doesn't need to be committed to the admin repo.
+type Credential struct {
+	Username    string
+	Password    string
+	PasswordEnv string
+}
+
+// MirrorConfig makes a repo a read-only pull mirror of an upstream remote.
+type MirrorConfig struct {
+	URL string
+
+	// Credentials names an entry in Config.Credentials.
+	Credentials string
+
+	// Interval between syncs, as a Go duration. Defaults to an hour.
+	Interval string
+}
+
+func (mc *MirrorConfig) interval() time.Duration {
+	d, err := time.ParseDuration(mc.Interval)
+	if err != nil || d <= 0 {
+		return time.Hour
+	}
+	return d
+}
+
+// MirrorStatus records the outcome of the last sync of a pull mirror.
+type MirrorStatus struct {
+	URL         string
+	LastAttempt time.Time
+	LastSuccess time.Time
+	LastError   string
+}
+
+var mirrorRefSpecs = []config.RefSpec{
+	"+refs/heads/*:refs/heads/*",
+	"+refs/tags/*:refs/tags/*",
+}
+
+// mirrorTick is how often the scheduler checks for mirrors that are due.
+const mirrorTick = time.Minute
+
+type mirrors struct {
+	mu      sync.Mutex
+	status  map[string]*MirrorStatus
+	running map[string]bool
+}
+
+func mirrorStatusPath(repo string) string {
+	return path.Join(repo, "mirror.json")
+}
+
+// auth resolves a named credential from the config.
+func (c *Config) auth(name string) (transport.AuthMethod, error) {
+	if name == "" {
+		return nil, nil
+	}
+	cred, ok := c.Credentials[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown credentials %q", name)
+	}
+	pass := cred.Password
+	if cred.PasswordEnv != "" {
+		pass = os.Getenv(cred.PasswordEnv)
+	}
+	return &githttp.BasicAuth{
+		Username: cred.Username,
+		Password: pass,
+	}, nil
+}
+
+// MirrorStatus returns the last recorded sync status for repo, or nil if it
+// has never been synced.
+func (gs *gitServe) MirrorStatus(repo string) *MirrorStatus {
+	gs.mirrors.mu.Lock()
+	defer gs.mirrors.mu.Unlock()
+	if ms, ok := gs.mirrors.status[repo]; ok {
+		return ms
+	}
+	r, err := gs.s3.Get(mirrorStatusPath(repo))
+	if err != nil {
+		return nil
+	}
+	ms := &MirrorStatus{}
+	err = json.NewDecoder(r).Decode(ms)
+	if err != nil {
+		return nil
+	}
+	gs.mirrors.status[repo] = ms
+	return ms
+}
+
+func (gs *gitServe) setMirrorStatus(repo string, ms *MirrorStatus) {
+	gs.mirrors.mu.Lock()
+	gs.mirrors.status[repo] = ms
+	gs.mirrors.mu.Unlock()
+	buf, err := json.Marshal(ms)
+	if err != nil {
+		log.Println("mirror status error", err)
+		return
+	}
+	hdrs := &http.Header{}
+	hdrs.Set("Content-Type", "application/json")
+	err = gs.s3.Put(mirrorStatusPath(repo), buf, hdrs)
+	if err != nil {
+		log.Println("mirror status error", err)
+	}
+}
+
+// runMirrors syncs every configured pull mirror as it falls due. It never
+// returns.
+func (gs *gitServe) runMirrors() {
+	for {
+		gs.syncDueMirrors()
+		time.Sleep(mirrorTick)
+	}
+}
+
+func (gs *gitServe) syncDueMirrors() {
+	for repo, rc := range gs.getConfig().Repos {
+		if rc.Mirror == nil {
+			continue
+		}
+		ms := gs.MirrorStatus(repo)
+		if ms != nil && ms.URL == rc.Mirror.URL && time.Since(ms.LastAttempt) < rc.Mirror.interval() {
+			continue
+		}
+		gs.mirrors.mu.Lock()
+		if gs.mirrors.running[repo] {
+			gs.mirrors.mu.Unlock()
+			continue
+		}
+		gs.mirrors.running[repo] = true
+		gs.mirrors.mu.Unlock()
+
+		go func(repo string, rc *RepoConfig) {
+			defer func() {
+				gs.mirrors.mu.Lock()
+				delete(gs.mirrors.running, repo)
+				gs.mirrors.mu.Unlock()
+			}()
+			gs.syncMirror(repo, rc)
+		}(repo, rc)
+	}
+}
+
+// syncMirror fetches every branch and tag from the upstream of repo,
+// pruning local refs that no longer exist upstream and following the
+// upstream HEAD.
+func (gs *gitServe) syncMirror(repo string, rc *RepoConfig) {
+	ms := &MirrorStatus{
+		URL:         rc.Mirror.URL,
+		LastAttempt: time.Now(),
+	}
+	if old := gs.MirrorStatus(repo); old != nil {
+		ms.LastSuccess = old.LastSuccess
+	}
+	cmds, err := gs.fetchMirror(repo, rc)
+	if err != nil {
+		log.Println("mirror sync failed", repo, err)
+		ms.LastError = err.Error()
+	} else {
+		ms.LastSuccess = ms.LastAttempt
+	}
+	gs.setMirrorStatus(repo, ms)
+	if len(cmds) > 0 {
+		gs.afterPush(repo, "mirror", cmds)
+	}
+}
+
+func (gs *gitServe) fetchMirror(repo string, rc *RepoConfig) ([]*packp.Command, error) {
+	auth, err := gs.getConfig().auth(rc.Mirror.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	s, err := gs.storer(repo, rc)
+	if err != nil {
+		return nil, err
+	}
+	r, err := git.Open(s.(storage.Storer), nil)
+	if err != nil {
+		return nil, err
+	}
+	before, err := localRefs(r)
+	if err != nil {
+		return nil, err
+	}
+
+	remote := git.NewRemote(s.(storage.Storer), &config.RemoteConfig{
+		Name: "upstream",
+		URLs: []string{rc.Mirror.URL},
+	})
+	err = remote.Fetch(&git.FetchOptions{
+		RefSpecs: mirrorRefSpecs,
+		Auth:     auth,
+		Tags:     git.NoTags,
+		Force:    true,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return nil, err
+	}
+
+	upstream, err := remote.List(&git.ListOptions{Auth: auth})
+	if err != nil {
+		return nil, err
+	}
+	remoteRefs := map[plumbing.ReferenceName]bool{}
+	for _, ref := range upstream {
+		remoteRefs[ref.Name()] = true
+		if ref.Name() == plumbing.HEAD && ref.Type() == plumbing.SymbolicReference {
+			err = s.SetReference(ref)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	for name := range before {
+		if !remoteRefs[name] {
+			err = s.RemoveReference(name)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	after, err := localRefs(r)
+	if err != nil {
+		return nil, err
+	}
+	return refChanges(before, after), nil
+}
+
+// localRefs returns the hash of every branch and tag in r.
+func localRefs(r *git.Repository) (map[plumbing.ReferenceName]plumbing.Hash, error) {
+	refs := map[plumbing.ReferenceName]plumbing.Hash{}
+	iter, err := r.References()
+	if err != nil {
+		return nil, err
+	}
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference && (ref.Name().IsBranch() || ref.Name().IsTag()) {
+			refs[ref.Name()] = ref.Hash()
+		}
+		return nil
+	})
+	return refs, err
+}
+
+// refChanges describes the difference between two sets of refs as the
+// commands a push would have sent.
+func refChanges(before, after map[plumbing.ReferenceName]plumbing.Hash) []*packp.Command {
+	cmds := []*packp.Command{}
+	for name, h := range after {
+		if before[name] != h {
+			cmds = append(cmds, &packp.Command{Name: name, Old: before[name], New: h})
+		}
+	}
+	for name, h := range before {
+		if _, ok := after[name]; !ok {
+			cmds = append(cmds, &packp.Command{Name: name, Old: h, New: plumbing.ZeroHash})
+		}
+	}
+	return cmds
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage"
+)
+
+// upstreamRepo is an on disk repo for mirrors to fetch from over file://.
+type upstreamRepo struct {
+	t   *testing.T
+	dir string
+	r   *git.Repository
+}
+
+func newUpstreamRepo(t *testing.T) *upstreamRepo {
+	// file:// fetches run git-upload-pack
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir, err := ioutil.TempDir("", "gitserve-upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	r, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &upstreamRepo{t: t, dir: dir, r: r}
+}
+
+func (ur *upstreamRepo) commit(file string, content string) plumbing.Hash {
+	err := ioutil.WriteFile(filepath.Join(ur.dir, file), []byte(content), 0644)
+	if err != nil {
+		ur.t.Fatal(err)
+	}
+	w, err := ur.r.Worktree()
+	if err != nil {
+		ur.t.Fatal(err)
+	}
+	_, err = w.Add(file)
+	if err != nil {
+		ur.t.Fatal(err)
+	}
+	h, err := w.Commit(file, &git.CommitOptions{
+		Author: &object.Signature{Name: "Test", Email: "test@example.com"},
+	})
+	if err != nil {
+		ur.t.Fatal(err)
+	}
+	return h
+}
+
+func TestFetchMirror(t *testing.T) {
+	up := newUpstreamRepo(t)
+	first := up.commit("a.txt", "a")
+	err := up.r.Storer.SetReference(plumbing.NewHashReference("refs/heads/old", first))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = up.r.Storer.SetReference(plumbing.NewHashReference("refs/tags/v1", first))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc := &RepoConfig{Mirror: &MirrorConfig{URL: "file://" + up.dir}}
+	gs := newTestServer(&Config{Repos: map[string]*RepoConfig{"mirror": rc}}, nil)
+	gs.s3, _ = newFakeS3(t)
+
+	cmds, err := gs.fetchMirror("mirror", rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cmds) != 3 {
+		t.Errorf("first sync: got %d ref changes, want 3", len(cmds))
+	}
+
+	second := up.commit("b.txt", "b")
+	err = up.r.Storer.RemoveReference("refs/heads/old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmds, err = gs.fetchMirror("mirror", rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := map[plumbing.ReferenceName]plumbing.Hash{}
+	for _, cmd := range cmds {
+		changes[cmd.Name] = cmd.New
+	}
+	if len(cmds) != 2 || changes["refs/heads/master"] != second {
+		t.Errorf("second sync: got %v", changes)
+	}
+	if h, ok := changes["refs/heads/old"]; !ok || !h.IsZero() {
+		t.Errorf("second sync didn't prune old: %v", changes)
+	}
+
+	s, err := gs.storer("mirror", rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := git.Open(s.(storage.Storer), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := r.Head()
+	if err != nil || head.Hash() != second {
+		t.Fatalf("mirror HEAD: got %v, %v", head, err)
+	}
+	_, err = r.Remote("upstream")
+	if err != git.ErrRemoteNotFound {
+		t.Errorf("mirror remote was saved in the repo config: %v", err)
+	}
+
+	// every object was stored, and can be listed
+	iter, err := r.CommitObjects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	err = iter.ForEach(func(*object.Commit) error {
+		n++
+		return nil
+	})
+	if err != nil || n != 2 {
+		t.Errorf("mirror commits: got %d, %v", n, err)
+	}
+}
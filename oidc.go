@@ -0,0 +1,644 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OIDCConfig enables logging in through an OpenID Connect provider with the
+// authorization code flow. Identities are matched to Config.Users by email,
+// and their groups claim can be used in RepoConfig.Groups for as long as the
+// login lasts.
+type OIDCConfig struct {
+	// Issuer is the provider's issuer URL. Endpoints and keys are discovered
+	// from <Issuer>/.well-known/openid-configuration.
+	Issuer string
+
+	ClientID        string
+	ClientSecret    string
+	ClientSecretEnv string
+
+	// RedirectURL is gitserve's /login/oidc/callback URL, as registered
+	// with the provider.
+	RedirectURL string
+
+	// Scopes are requested along with openid. Defaults to email and profile.
+	Scopes []string
+
+	// GroupsClaim names the claim listing the user's groups. Defaults to
+	// groups.
+	GroupsClaim string
+
+	// AutoProvision lets anyone the provider authenticates log in as
+	// oidc:<email>, even without an entry in Config.Users.
+	AutoProvision bool
+
+	// AllowedGroups, if set, only lets members of one of these groups log
+	// in.
+	AllowedGroups []string
+}
+
+func (oc *OIDCConfig) clientSecret() string {
+	if oc.ClientSecretEnv != "" {
+		return os.Getenv(oc.ClientSecretEnv)
+	}
+	return oc.ClientSecret
+}
+
+func (oc *OIDCConfig) scopes() string {
+	scopes := oc.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"email", "profile"}
+	}
+	return strings.Join(append([]string{"openid"}, scopes...), " ")
+}
+
+func (oc *OIDCConfig) groupsClaim() string {
+	if oc.GroupsClaim == "" {
+		return "groups"
+	}
+	return oc.GroupsClaim
+}
+
+// oidcProvider is a provider's discovery document, plus the signing keys
+// fetched from its jwks_uri.
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	keys        map[string]crypto.PublicKey
+	keysFetched time.Time
+}
+
+// oidcPending is a login that has been sent to the provider and not come
+// back yet, keyed by its state parameter.
+type oidcPending struct {
+	Nonce    string
+	Verifier string
+	Next     string
+	Expires  time.Time
+}
+
+type oidcState struct {
+	mu       sync.Mutex
+	provider *oidcProvider
+	pending  map[string]*oidcPending
+}
+
+const (
+	oidcCookie = "gitserve_oidc"
+	// oidcUserPrefix namespaces auto-provisioned users, so they can't take
+	// over a configured user's grants.
+	oidcUserPrefix   = "oidc:"
+	oidcLoginTimeout = 10 * time.Minute
+	// oidcMaxPending caps the logins waiting on the provider. Starting one
+	// takes no credentials, so past this the oldest are dropped.
+	oidcMaxPending = 10000
+	// oidcKeyRefresh limits how often an unknown key ID makes us refetch the
+	// provider's keys.
+	oidcKeyRefresh = time.Minute
+	// oidcLeeway allows for clock skew when checking token expiry.
+	oidcLeeway = time.Minute
+)
+
+var oidcClient = &http.Client{Timeout: 30 * time.Second}
+
+func oidcGetJSON(u string, v interface{}) error {
+	resp, err := oidcClient.Get(u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return fmt.Errorf("GET %s: %s", u, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// oidcProvider returns the discovery document for oc's issuer, fetching it
+// the first time it's needed.
+func (gs *gitServe) oidcProvider(oc *OIDCConfig) (*oidcProvider, error) {
+	gs.oidc.mu.Lock()
+	p := gs.oidc.provider
+	gs.oidc.mu.Unlock()
+	if p != nil && p.Issuer == oc.Issuer {
+		return p, nil
+	}
+
+	p = &oidcProvider{}
+	err := oidcGetJSON(strings.TrimSuffix(oc.Issuer, "/")+"/.well-known/openid-configuration", p)
+	if err != nil {
+		return nil, err
+	}
+	if p.Issuer != oc.Issuer {
+		return nil, fmt.Errorf("provider claims to be issuer %q, not %q", p.Issuer, oc.Issuer)
+	}
+	gs.oidc.mu.Lock()
+	gs.oidc.provider = p
+	gs.oidc.mu.Unlock()
+	return p, nil
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func b64Int(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := b64Int(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64Int(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Crv)
+		}
+		x, err := b64Int(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64Int(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", k.Kty)
+}
+
+// oidcKey finds the provider's signing key with ID kid, refetching the keys
+// if it isn't known, since providers rotate them.
+func (gs *gitServe) oidcKey(p *oidcProvider, kid string) (crypto.PublicKey, error) {
+	gs.oidc.mu.Lock()
+	key, ok := p.keys[kid]
+	fresh := time.Since(p.keysFetched) < oidcKeyRefresh
+	gs.oidc.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+	if fresh {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	jwks := struct {
+		Keys []jsonWebKey `json:"keys"`
+	}{}
+	err := oidcGetJSON(p.JWKSURI, &jwks)
+	if err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pk, err := k.publicKey()
+		if err != nil {
+			log.Println("skipping oidc key", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = pk
+	}
+	gs.oidc.mu.Lock()
+	p.keys = keys
+	p.keysFetched = time.Now()
+	gs.oidc.mu.Unlock()
+
+	key, ok = keys[kid]
+	if !ok && kid == "" && len(keys) == 1 {
+		for _, k := range keys {
+			key, ok = k, true
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	return key, nil
+}
+
+// oidcAudience is the aud claim, which may be a single string or a list.
+type oidcAudience []string
+
+func (a *oidcAudience) UnmarshalJSON(b []byte) error {
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		*a = oidcAudience{s}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]string)(a))
+}
+
+type oidcClaims struct {
+	Issuer        string       `json:"iss"`
+	Subject       string       `json:"sub"`
+	Audience      oidcAudience `json:"aud"`
+	Expiry        int64        `json:"exp"`
+	Nonce         string       `json:"nonce"`
+	Email         string       `json:"email"`
+	EmailVerified *bool        `json:"email_verified"`
+
+	Groups []string `json:"-"`
+}
+
+// verifyIDToken checks the signature and claims of an ID token issued to
+// oc's client. nonce is only checked if it isn't empty.
+func (gs *gitServe) verifyIDToken(oc *OIDCConfig, p *oidcProvider, token string, nonce string) (*oidcClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed id token")
+	}
+	hdr := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	b, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &hdr)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	key, err := gs.oidcKey(p, hdr.Kid)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if hdr.Alg != "RS256" {
+			return nil, fmt.Errorf("unsupported signing algorithm %s", hdr.Alg)
+		}
+		err = rsa.VerifyPKCS1v15(k, crypto.SHA256, h[:], sig)
+		if err != nil {
+			return nil, err
+		}
+	case *ecdsa.PublicKey:
+		if hdr.Alg != "ES256" {
+			return nil, fmt.Errorf("unsupported signing algorithm %s", hdr.Alg)
+		}
+		if len(sig) != 64 {
+			return nil, fmt.Errorf("malformed signature")
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, h[:], r, s) {
+			return nil, fmt.Errorf("invalid signature")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	claims := &oidcClaims{}
+	err = json.Unmarshal(payload, claims)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]interface{}{}
+	err = json.Unmarshal(payload, &raw)
+	if err != nil {
+		return nil, err
+	}
+	switch groups := raw[oc.groupsClaim()].(type) {
+	case string:
+		claims.Groups = []string{groups}
+	case []interface{}:
+		for _, g := range groups {
+			if s, ok := g.(string); ok {
+				claims.Groups = append(claims.Groups, s)
+			}
+		}
+	}
+
+	if claims.Issuer != oc.Issuer {
+		return nil, fmt.Errorf("token issued by %q", claims.Issuer)
+	}
+	found := false
+	for _, aud := range claims.Audience {
+		if aud == oc.ClientID {
+			found = true
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("token not issued to this client")
+	}
+	if time.Now().After(time.Unix(claims.Expiry, 0).Add(oidcLeeway)) {
+		return nil, fmt.Errorf("token expired")
+	}
+	if nonce != "" && claims.Nonce != nonce {
+		return nil, fmt.Errorf("token nonce mismatch")
+	}
+	if claims.Email == "" {
+		return nil, fmt.Errorf("token has no email claim")
+	}
+	// providers that leave email_verified out aren't vouching for the
+	// address, so a missing claim counts as unverified
+	if claims.EmailVerified == nil || !*claims.EmailVerified {
+		return nil, fmt.Errorf("email %s is not verified", claims.Email)
+	}
+	return claims, nil
+}
+
+// oidcUser maps verified claims to a gitserve user: the configured user with
+// the same email, or oidc:<email> if auto-provisioning is on.
+func (gs *gitServe) oidcUser(oc *OIDCConfig, claims *oidcClaims) (string, error) {
+	if len(oc.AllowedGroups) > 0 {
+		allowed := false
+		for _, a := range oc.AllowedGroups {
+			for _, g := range claims.Groups {
+				if a == g {
+					allowed = true
+				}
+			}
+		}
+		if !allowed {
+			return "", fmt.Errorf("%s is not in an allowed group", claims.Email)
+		}
+	}
+
+	users := gs.getConfig().Users
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	user := ""
+	for _, name := range names {
+		if users[name].Email != "" && strings.EqualFold(users[name].Email, claims.Email) {
+			user = name
+			break
+		}
+	}
+	if user == "" {
+		if !oc.AutoProvision {
+			return "", fmt.Errorf("no user for %s", claims.Email)
+		}
+		user = oidcUserPrefix + strings.ToLower(claims.Email)
+		if _, ok := users[user]; ok {
+			return "", fmt.Errorf("%s is a configured user without email %s", user, claims.Email)
+		}
+	}
+	return user, nil
+}
+
+// knownUser reports whether user is configured, or was auto-provisioned by
+// an OIDC login while that is still enabled.
+func (gs *gitServe) knownUser(user string) bool {
+	c := gs.getConfig()
+	if _, ok := c.Users[user]; ok {
+		return true
+	}
+	return strings.HasPrefix(user, oidcUserPrefix) && c.OIDC != nil && c.OIDC.AutoProvision
+}
+
+// bearerUser authenticates an "Authorization: Bearer" header carrying an ID
+// token from the OIDC provider, so scripts and git can use SSO identities.
+// The token's groups are returned for use with this request only.
+func (gs *gitServe) bearerUser(token string) (string, []string, error) {
+	oc := gs.getConfig().OIDC
+	if oc == nil {
+		return "", nil, fmt.Errorf("oidc is not configured")
+	}
+	p, err := gs.oidcProvider(oc)
+	if err != nil {
+		return "", nil, err
+	}
+	claims, err := gs.verifyIDToken(oc, p, token, "")
+	if err != nil {
+		return "", nil, err
+	}
+	user, err := gs.oidcUser(oc, claims)
+	return user, claims.Groups, err
+}
+
+// oidcLogin sends the browser to the provider to log in. The state, nonce
+// and PKCE verifier are kept server side, with the state also in a cookie
+// so the callback must come back to the same browser.
+func (gs *gitServe) oidcLogin(rw http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	mw := &metricsWriter{ResponseWriter: rw, code: 200}
+	defer func() {
+		metrics.observeRequest("web/login", mw.code, start)
+	}()
+
+	oc := gs.getConfig().OIDC
+	if oc == nil {
+		http.Error(mw, "not found", 404)
+		return
+	}
+	p, err := gs.oidcProvider(oc)
+	if err != nil {
+		log.Println("oidc discovery error", err)
+		http.Error(mw, "identity provider unavailable", 502)
+		return
+	}
+
+	state := randomToken(24)
+	pending := &oidcPending{
+		Nonce:    randomToken(24),
+		Verifier: randomToken(32),
+		Next:     localRedirect(req.FormValue("next")),
+		Expires:  time.Now().Add(oidcLoginTimeout),
+	}
+	gs.oidc.mu.Lock()
+	oldest := ""
+	for s, old := range gs.oidc.pending {
+		if time.Now().After(old.Expires) {
+			delete(gs.oidc.pending, s)
+		} else if oldest == "" || old.Expires.Before(gs.oidc.pending[oldest].Expires) {
+			oldest = s
+		}
+	}
+	if len(gs.oidc.pending) >= oidcMaxPending {
+		delete(gs.oidc.pending, oldest)
+	}
+	gs.oidc.pending[state] = pending
+	gs.oidc.mu.Unlock()
+
+	http.SetCookie(mw, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    state,
+		Path:     "/login/oidc",
+		MaxAge:   int(oidcLoginTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(pending.Verifier))
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oc.ClientID},
+		"redirect_uri":          {oc.RedirectURL},
+		"scope":                 {oc.scopes()},
+		"state":                 {state},
+		"nonce":                 {pending.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	sep := "?"
+	if strings.Contains(p.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	http.Redirect(mw, req, p.AuthorizationEndpoint+sep+q.Encode(), http.StatusFound)
+}
+
+// oidcExchange trades an authorization code for an ID token.
+func oidcExchange(oc *OIDCConfig, p *oidcProvider, code string, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oc.RedirectURL},
+		"client_id":     {oc.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest(http.MethodPost, p.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if secret := oc.clientSecret(); secret != "" {
+		req.SetBasicAuth(url.QueryEscape(oc.ClientID), url.QueryEscape(secret))
+	}
+	resp, err := oidcClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	tr := struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&tr)
+	if err != nil {
+		return "", fmt.Errorf("token endpoint: %s: %w", resp.Status, err)
+	}
+	if tr.Error != "" {
+		return "", fmt.Errorf("token endpoint: %s %s", tr.Error, tr.ErrorDescription)
+	}
+	if tr.IDToken == "" {
+		return "", fmt.Errorf("token endpoint returned no id token")
+	}
+	return tr.IDToken, nil
+}
+
+func (gs *gitServe) oidcCallback(rw http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	mw := &metricsWriter{ResponseWriter: rw, code: 200}
+	defer func() {
+		metrics.observeRequest("web/login", mw.code, start)
+	}()
+
+	oc := gs.getConfig().OIDC
+	if oc == nil {
+		http.Error(mw, "not found", 404)
+		return
+	}
+
+	state := req.FormValue("state")
+	gs.oidc.mu.Lock()
+	pending := gs.oidc.pending[state]
+	delete(gs.oidc.pending, state)
+	gs.oidc.mu.Unlock()
+	http.SetCookie(mw, &http.Cookie{
+		Name:   oidcCookie,
+		Path:   "/login/oidc",
+		MaxAge: -1,
+	})
+	c, err := req.Cookie(oidcCookie)
+	if err != nil || state == "" || c.Value != state || pending == nil || time.Now().After(pending.Expires) {
+		gs.renderLogin(mw, req, "/", "", "Your login expired, please try again.", http.StatusBadRequest)
+		return
+	}
+	if e := req.FormValue("error"); e != "" {
+		gs.renderLogin(mw, req, pending.Next, "", "The identity provider refused the login: "+e, http.StatusUnauthorized)
+		return
+	}
+
+	var groups []string
+	user, err := func() (string, error) {
+		p, err := gs.oidcProvider(oc)
+		if err != nil {
+			return "", err
+		}
+		token, err := oidcExchange(oc, p, req.FormValue("code"), pending.Verifier)
+		if err != nil {
+			return "", err
+		}
+		claims, err := gs.verifyIDToken(oc, p, token, pending.Nonce)
+		if err != nil {
+			return "", err
+		}
+		groups = claims.Groups
+		return gs.oidcUser(oc, claims)
+	}()
+	ev := &AuditEvent{
+		Action:  "login",
+		User:    user,
+		Success: err == nil,
+		Detail:  "oidc",
+	}
+	if err != nil {
+		ev.Detail = "oidc: " + err.Error()
+	}
+	gs.audit(req, ev)
+	if err != nil {
+		log.Println("oidc login failed", err)
+		gs.renderLogin(mw, req, pending.Next, "", "Single sign-on failed.", http.StatusUnauthorized)
+		return
+	}
+
+	if old := gs.sessions.get(req); old != nil {
+		gs.sessions.remove(old)
+	}
+	gs.sessions.setCookie(mw, req, gs.sessions.create(user, groups))
+	http.Redirect(mw, req, pending.Next, http.StatusSeeOther)
+}
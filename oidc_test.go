@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubIssuer is an OIDC provider for tests, signing ID tokens with an RSA
+// key "rsa" and a P-256 key "ec".
+type stubIssuer struct {
+	t      *testing.T
+	srv    *httptest.Server
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+
+	// token is what the token endpoint hands out for any code.
+	token string
+}
+
+func newStubIssuer(t *testing.T) *stubIssuer {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	si := &stubIssuer{t: t, rsaKey: rsaKey, ecKey: ecKey}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(rw http.ResponseWriter, req *http.Request) {
+		json.NewEncoder(rw).Encode(map[string]string{
+			"issuer":                 si.srv.URL,
+			"authorization_endpoint": si.srv.URL + "/authorize",
+			"token_endpoint":         si.srv.URL + "/token",
+			"jwks_uri":               si.srv.URL + "/keys",
+		})
+	})
+	mux.HandleFunc("/keys", func(rw http.ResponseWriter, req *http.Request) {
+		b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+		json.NewEncoder(rw).Encode(map[string][]jsonWebKey{"keys": {
+			{Kty: "RSA", Kid: "rsa", Use: "sig", N: b64(rsaKey.N.Bytes()), E: b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{Kty: "EC", Kid: "ec", Crv: "P-256", X: b64(ecKey.X.Bytes()), Y: b64(ecKey.Y.Bytes())},
+		}})
+	})
+	mux.HandleFunc("/token", func(rw http.ResponseWriter, req *http.Request) {
+		if req.FormValue("grant_type") != "authorization_code" || req.FormValue("code_verifier") == "" {
+			rw.WriteHeader(400)
+			json.NewEncoder(rw).Encode(map[string]string{"error": "invalid_request"})
+			return
+		}
+		json.NewEncoder(rw).Encode(map[string]string{"id_token": si.token})
+	})
+	si.srv = httptest.NewServer(mux)
+	t.Cleanup(si.srv.Close)
+	return si
+}
+
+func (si *stubIssuer) config() *OIDCConfig {
+	return &OIDCConfig{
+		Issuer:      si.srv.URL,
+		ClientID:    "gitserve",
+		RedirectURL: "http://gitserve.test/login/oidc/callback",
+	}
+}
+
+// claims returns valid claims for email, to be modified and signed.
+func (si *stubIssuer) claims(email string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":            si.srv.URL,
+		"sub":            "sub-" + email,
+		"aud":            "gitserve",
+		"exp":            time.Now().Add(time.Hour).Unix(),
+		"email":          email,
+		"email_verified": true,
+	}
+}
+
+// sign makes a JWT of claims with alg (RS256 or ES256) and key ID kid.
+func (si *stubIssuer) sign(alg string, kid string, claims map[string]interface{}) string {
+	hdr, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		si.t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(hdr) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	h := sha256.Sum256([]byte(signed))
+	var sig []byte
+	switch alg {
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, si.rsaKey, crypto.SHA256, h[:])
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, si.ecKey, h[:])
+		sig = make([]byte, 64)
+		if err == nil {
+			rb, sb := r.Bytes(), s.Bytes()
+			copy(sig[32-len(rb):32], rb)
+			copy(sig[64-len(sb):], sb)
+		}
+	}
+	if err != nil {
+		si.t.Fatal(err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestVerifyIDToken(t *testing.T) {
+	si := newStubIssuer(t)
+	oc := si.config()
+	gs := newTestServer(&Config{OIDC: oc}, nil)
+	p, err := gs.oidcProvider(oc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	with := func(k string, v interface{}) map[string]interface{} {
+		c := si.claims("alice@example.com")
+		if v == nil {
+			delete(c, k)
+		} else {
+			c[k] = v
+		}
+		return c
+	}
+	valid := si.sign("RS256", "rsa", si.claims("alice@example.com"))
+	parts := strings.Split(valid, ".")
+	tampered := parts[0] + "." + base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"`+si.srv.URL+`","aud":"gitserve","exp":9999999999,"email":"mallory@example.com"}`)) + "." + parts[2]
+
+	tests := []struct {
+		name  string
+		token string
+		nonce string
+		ok    bool
+	}{
+		{"rs256", valid, "", true},
+		{"es256", si.sign("ES256", "ec", si.claims("alice@example.com")), "", true},
+		{"groups", si.sign("RS256", "rsa", with("groups", []string{"devs"})), "", true},
+		{"audience list", si.sign("RS256", "rsa", with("aud", []string{"other", "gitserve"})), "", true},
+		{"nonce", si.sign("RS256", "rsa", with("nonce", "n1")), "n1", true},
+		{"tampered", tampered, "", false},
+		{"malformed", "not.a-token", "", false},
+		{"unsigned", parts[0] + "." + parts[1] + ".", "", false},
+		{"alg mismatch", si.sign("ES256", "rsa", si.claims("alice@example.com")), "", false},
+		{"unknown key", si.sign("RS256", "other", si.claims("alice@example.com")), "", false},
+		{"wrong issuer", si.sign("RS256", "rsa", with("iss", "https://evil.example.com")), "", false},
+		{"wrong audience", si.sign("RS256", "rsa", with("aud", "other")), "", false},
+		{"expired", si.sign("RS256", "rsa", with("exp", time.Now().Add(-time.Hour).Unix())), "", false},
+		{"nonce mismatch", si.sign("RS256", "rsa", with("nonce", "n1")), "n2", false},
+		{"no email", si.sign("RS256", "rsa", with("email", nil)), "", false},
+		{"unverified email", si.sign("RS256", "rsa", with("email_verified", false)), "", false},
+		{"no email_verified", si.sign("RS256", "rsa", with("email_verified", nil)), "", false},
+	}
+	for _, test := range tests {
+		claims, err := gs.verifyIDToken(oc, p, test.token, test.nonce)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: got error %v, want ok %v", test.name, err, test.ok)
+			continue
+		}
+		if test.name == "groups" && (len(claims.Groups) != 1 || claims.Groups[0] != "devs") {
+			t.Errorf("groups: got %v", claims.Groups)
+		}
+	}
+}
+
+func TestOIDCUser(t *testing.T) {
+	si := newStubIssuer(t)
+	oc := si.config()
+	oc.AutoProvision = true
+	gs := newTestServer(&Config{
+		OIDC: oc,
+		Users: map[string]*User{
+			"alice":                {Email: "Alice@example.com"},
+			"bob@example.com":      {},
+			"oidc:eve@example.com": {},
+		},
+	}, nil)
+
+	tests := []struct {
+		email, user string
+	}{
+		{"alice@example.com", "alice"},
+		// an auto-provisioned user can't become a configured one by name
+		{"bob@example.com", "oidc:bob@example.com"},
+		{"Carol@Example.com", "oidc:carol@example.com"},
+		{"eve@example.com", ""},
+	}
+	for _, test := range tests {
+		user, err := gs.oidcUser(oc, &oidcClaims{Email: test.email})
+		if user != test.user || (err == nil) != (test.user != "") {
+			t.Errorf("%s: got %q, %v, want %q", test.email, user, err, test.user)
+		}
+	}
+	if !gs.knownUser("oidc:carol@example.com") {
+		t.Errorf("auto-provisioned user isn't known")
+	}
+	oc.AutoProvision = false
+	if gs.knownUser("oidc:carol@example.com") {
+		t.Errorf("auto-provisioned user is known after disabling auto-provisioning")
+	}
+}
+
+func TestOIDCLogin(t *testing.T) {
+	si := newStubIssuer(t)
+	oc := si.config()
+	oc.AutoProvision = true
+	tr := newTestRepo(t)
+	tr.branch("master", tr.commit("init", map[string]string{"a": "a"}))
+	repos := map[string]*RepoConfig{"repo": {
+		Groups: map[string]UserAccess{"devs": {Access: []string{"web"}}},
+	}}
+	gs := newTestServer(&Config{OIDC: oc, Repos: repos}, map[string]*testRepo{"repo": tr})
+
+	rr := get(http.HandlerFunc(gs.oidcLogin), "/login/oidc?next=/repo")
+	loc, err := url.Parse(rr.Header().Get("Location"))
+	if rr.Code != http.StatusFound || err != nil || !strings.HasPrefix(loc.String(), si.srv.URL+"/authorize") {
+		t.Fatalf("login redirect: got %d %q", rr.Code, rr.Header().Get("Location"))
+	}
+	state := loc.Query().Get("state")
+	claims := si.claims("dana@example.com")
+	claims["nonce"] = loc.Query().Get("nonce")
+	claims["groups"] = []string{"devs"}
+	si.token = si.sign("RS256", "rsa", claims)
+
+	rr = get(http.HandlerFunc(gs.oidcCallback), "/login/oidc/callback?code=c&state="+state, func(req *http.Request) {
+		req.AddCookie(&http.Cookie{Name: oidcCookie, Value: state})
+	})
+	sc := cookie(rr, sessionCookie)
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/repo" || sc == nil {
+		t.Fatalf("callback: got %d %q", rr.Code, rr.Body.String())
+	}
+
+	// the session carries the login's groups
+	rr = get(http.HandlerFunc(gs.git), "/repo/blob/master/a", func(req *http.Request) {
+		req.AddCookie(sc)
+	})
+	if rr.Code != 200 {
+		t.Errorf("group access with session: got %d", rr.Code)
+	}
+	// but they don't outlive it, or apply to other logins as the same user
+	req := httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(sc)
+	s := gs.sessions.get(req)
+	if s == nil || s.User != "oidc:dana@example.com" {
+		t.Fatalf("session: got %+v", s)
+	}
+	gs.sessions.remove(s)
+	if user, groups, _ := gs.authenticate(req); user != "nobody" || groups != nil {
+		t.Errorf("after logout: got %q %v", user, groups)
+	}
+	if access := gs.accessFor(repos["repo"], "oidc:dana@example.com", nil); len(access) != 0 {
+		t.Errorf("groups applied without the session: %v", access)
+	}
+
+	// a replayed callback is refused
+	rr = get(http.HandlerFunc(gs.oidcCallback), "/login/oidc/callback?code=c&state="+state, func(req *http.Request) {
+		req.AddCookie(&http.Cookie{Name: oidcCookie, Value: state})
+	})
+	if rr.Code != http.StatusBadRequest || cookie(rr, sessionCookie) != nil {
+		t.Errorf("replayed callback: got %d", rr.Code)
+	}
+}
+
+func TestBearerGroups(t *testing.T) {
+	si := newStubIssuer(t)
+	oc := si.config()
+	oc.AutoProvision = true
+	repos := map[string]*RepoConfig{"repo": {
+		Groups: map[string]UserAccess{"devs": {Access: []string{"web"}}},
+	}}
+	gs := newTestServer(&Config{OIDC: oc, Repos: repos}, nil)
+
+	claims := si.claims("dana@example.com")
+	claims["groups"] = []string{"devs"}
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+si.sign("ES256", "ec", claims))
+	user, groups, ok := gs.authenticate(req)
+	if !ok || user != "oidc:dana@example.com" || !gs.hasAccess(repos["repo"], user, groups, "web") {
+		t.Fatalf("bearer: got %q %v %v", user, groups, ok)
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+si.sign("ES256", "ec", si.claims("dana@example.com")))
+	user, groups, ok = gs.authenticate(req)
+	if !ok || gs.hasAccess(repos["repo"], user, groups, "web") {
+		t.Errorf("groups from an earlier token still apply: %q %v", user, groups)
+	}
+}
+
+func TestOIDCPendingCap(t *testing.T) {
+	si := newStubIssuer(t)
+	gs := newTestServer(&Config{OIDC: si.config()}, nil)
+	now := time.Now()
+	gs.oidc.pending["expired"] = &oidcPending{Expires: now.Add(-time.Second)}
+	gs.oidc.pending["oldest"] = &oidcPending{Expires: now.Add(time.Minute)}
+	for i := len(gs.oidc.pending) - 1; i < oidcMaxPending; i++ {
+		gs.oidc.pending[fmt.Sprint(i)] = &oidcPending{Expires: now.Add(oidcLoginTimeout)}
+	}
+
+	rr := get(http.HandlerFunc(gs.oidcLogin), "/login/oidc")
+	if rr.Code != http.StatusFound {
+		t.Fatalf("login: got %d", rr.Code)
+	}
+	if len(gs.oidc.pending) != oidcMaxPending {
+		t.Errorf("%d pending logins, want %d", len(gs.oidc.pending), oidcMaxPending)
+	}
+	if gs.oidc.pending["expired"] != nil || gs.oidc.pending["oldest"] != nil {
+		t.Error("expired or oldest login kept")
+	}
+}
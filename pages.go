@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/storage"
+)
+
+// pagesCacheTTL bounds how long a site's tree is reused without looking at
+// its branch again. Pushes through this server drop it straight away.
+const pagesCacheTTL = time.Minute
+
+// PagesConfig serves a static site from a branch of the repo.
+type PagesConfig struct {
+	// Branch the site is served from. Defaults to gh-pages.
+	Branch string
+	// Dir is the directory of the branch the site lives in, if it isn't
+	// the root.
+	Dir string
+	// Host is the virtual host the site is served on, e.g.
+	// docs.example.com. It's required, and has to be a host of its own:
+	// scripts on a site sharing an origin with the web UI could act as
+	// whoever is logged in.
+	Host string
+	// Prefix serves the site under a path of Host instead of its root.
+	Prefix string
+}
+
+func (pc *PagesConfig) branch() string {
+	if pc.Branch == "" {
+		return "gh-pages"
+	}
+	return pc.Branch
+}
+
+func (pc *PagesConfig) prefix() string {
+	if strings.Trim(pc.Prefix, "/") == "" {
+		return ""
+	}
+	return "/" + strings.Trim(pc.Prefix, "/")
+}
+
+// pagesTypes are content types for common web files, so they don't depend
+// on the system's mime tables.
+var pagesTypes = map[string]string{
+	".html":  "text/html; charset=utf-8",
+	".htm":   "text/html; charset=utf-8",
+	".css":   "text/css; charset=utf-8",
+	".js":    "text/javascript; charset=utf-8",
+	".mjs":   "text/javascript; charset=utf-8",
+	".json":  "application/json",
+	".map":   "application/json",
+	".xml":   "application/xml",
+	".txt":   "text/plain; charset=utf-8",
+	".md":    "text/markdown; charset=utf-8",
+	".svg":   "image/svg+xml",
+	".png":   "image/png",
+	".jpg":   "image/jpeg",
+	".jpeg":  "image/jpeg",
+	".gif":   "image/gif",
+	".webp":  "image/webp",
+	".ico":   "image/x-icon",
+	".woff":  "font/woff",
+	".woff2": "font/woff2",
+	".ttf":   "font/ttf",
+	".wasm":  "application/wasm",
+	".pdf":   "application/pdf",
+}
+
+func pagesContentType(name string) string {
+	ext := strings.ToLower(path.Ext(name))
+	if t, ok := pagesTypes[ext]; ok {
+		return t
+	}
+	return mime.TypeByExtension(ext)
+}
+
+// pagesSite is the tree a site was last served from.
+type pagesSite struct {
+	Branch  string
+	Dir     string
+	Tree    plumbing.Hash
+	When    time.Time
+	Expires time.Time
+}
+
+type pagesCache struct {
+	mu    sync.Mutex
+	sites map[string]*pagesSite
+
+	// hosts maps each lower cased Pages.Host of config to the repos with
+	// sites on it, so requests don't look through every repo's config.
+	config *Config
+	hosts  map[string][]string
+}
+
+// pagesHosts returns the repos with sites on each host in c, building the
+// map the first time c is asked about.
+func (gs *gitServe) pagesHosts(c *Config) map[string][]string {
+	gs.pages.mu.Lock()
+	defer gs.pages.mu.Unlock()
+	if gs.pages.config == c {
+		return gs.pages.hosts
+	}
+	hosts := map[string][]string{}
+	for name, rc := range c.Repos {
+		if rc != nil && rc.Pages != nil && rc.Pages.Host != "" {
+			host := strings.ToLower(rc.Pages.Host)
+			hosts[host] = append(hosts[host], name)
+		}
+	}
+	gs.pages.config, gs.pages.hosts = c, hosts
+	return hosts
+}
+
+// validatePages checks that no site shares a host with the web UI, as far
+// as the config tells what that is.
+func validatePages(c *Config) error {
+	urls := []string{c.ExternalURL}
+	if c.OIDC != nil {
+		urls = append(urls, c.OIDC.RedirectURL)
+	}
+	ui := map[string]bool{}
+	for _, u := range urls {
+		if pu, err := url.Parse(u); err == nil && pu.Hostname() != "" {
+			ui[strings.ToLower(pu.Hostname())] = true
+		}
+	}
+	for name, rc := range c.Repos {
+		if rc != nil && rc.Pages != nil && ui[strings.ToLower(rc.Pages.Host)] {
+			return fmt.Errorf("repo %s: Pages.Host %s is the web UI's host", name, rc.Pages.Host)
+		}
+	}
+	return nil
+}
+
+// invalidatePages makes the next request for repo's site look at its branch
+// again.
+func (gs *gitServe) invalidatePages(repo string) {
+	gs.pages.mu.Lock()
+	delete(gs.pages.sites, repo)
+	gs.pages.mu.Unlock()
+}
+
+// pagesFor finds the site req is for, and the path within it. Longer
+// prefixes win over shorter ones on the same host. Sites without a Host
+// aren't served at all.
+func (gs *gitServe) pagesFor(req *http.Request) (repo string, rc *RepoConfig, rest string, ok bool) {
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	best := -1
+	c := gs.getConfig()
+	for _, name := range gs.pagesHosts(c)[strings.ToLower(host)] {
+		prefix := c.Repos[name].Pages.prefix()
+		if req.URL.Path != prefix && !strings.HasPrefix(req.URL.Path, prefix+"/") {
+			continue
+		}
+		if len(prefix) > best {
+			best = len(prefix)
+			repo, rc = name, c.Repos[name]
+			rest = strings.TrimPrefix(req.URL.Path, prefix)
+		}
+	}
+	return repo, rc, rest, best >= 0
+}
+
+// pagesHandler serves pages sites, passing everything else on to next.
+func (gs *gitServe) pagesHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		repo, rc, rest, ok := gs.pagesFor(req)
+		if !ok {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		gs.servePages(repo, rc, rest, rw, req)
+	})
+}
+
+func (gs *gitServe) pagesSite(r *git.Repository, repo string, pc *PagesConfig) (*pagesSite, error) {
+	gs.pages.mu.Lock()
+	site, ok := gs.pages.sites[repo]
+	gs.pages.mu.Unlock()
+	if ok && site.Branch == pc.branch() && site.Dir == pc.Dir && time.Now().Before(site.Expires) {
+		return site, nil
+	}
+
+	ref, err := r.Reference(branchRefName(pc.branch()), true)
+	if err != nil {
+		return nil, err
+	}
+	c, err := r.CommitObject(ref.Hash())
+	if err != nil {
+		return nil, err
+	}
+	tree, err := c.Tree()
+	if err != nil {
+		return nil, err
+	}
+	if dir := strings.Trim(pc.Dir, "/"); dir != "" {
+		tree, err = tree.Tree(dir)
+		if err != nil {
+			return nil, err
+		}
+	}
+	site = &pagesSite{
+		Branch:  pc.branch(),
+		Dir:     pc.Dir,
+		Tree:    tree.Hash,
+		When:    c.Committer.When,
+		Expires: time.Now().Add(pagesCacheTTL),
+	}
+	gs.pages.mu.Lock()
+	gs.pages.sites[repo] = site
+	gs.pages.mu.Unlock()
+	return site, nil
+}
+
+// servePages serves p from repo's site. Directories are served from their
+// index.html, and a 404.html at the root of the site is used for missing
+// files. Every file is tagged with the hash of the site's tree, so caches
+// revalidate cheaply and see new content as soon as the branch changes.
+func (gs *gitServe) servePages(repo string, rc *RepoConfig, p string, w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	rw := &metricsWriter{ResponseWriter: w, code: 200}
+	defer func() {
+		metrics.observeRequest("pages", rw.code, start)
+	}()
+
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		http.Error(rw, "method not allowed", 405)
+		return
+	}
+
+	user, groups, ok := gs.authenticate(req)
+	if !ok {
+		rw.Header().Set("WWW-Authenticate", "Basic")
+		http.Error(rw, "unauthorized", 401)
+		return
+	}
+	if !gs.hasAccess(rc, user, groups, "web") {
+		// sites are on their own host, with no login page to send
+		// visitors to
+		if user == "nobody" {
+			rw.Header().Set("WWW-Authenticate", "Basic")
+			http.Error(rw, "unauthorized", 401)
+			return
+		}
+		webUnauthorized(rw, req, user)
+		return
+	}
+
+	s, err := gs.storer(repo, rc)
+	if err != nil {
+		log.Println("pages error", err)
+		http.Error(rw, "internal error", 500)
+		return
+	}
+	r, err := git.Open(s.(storage.Storer), nil)
+	if err != nil {
+		log.Println("pages error", err)
+		http.Error(rw, "internal error", 500)
+		return
+	}
+	site, err := gs.pagesSite(r, repo, rc.Pages)
+	if err != nil {
+		http.Error(rw, "not found", 404)
+		return
+	}
+	tree, err := r.TreeObject(site.Tree)
+	if err != nil {
+		log.Println("pages error", err)
+		http.Error(rw, "internal error", 500)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if strings.HasSuffix(p, "/") {
+		name = path.Join(name, "index.html")
+	} else if e, err := tree.FindEntry(name); name == "" || err == nil && e.Mode == filemode.Dir {
+		u := *req.URL
+		u.Path += "/"
+		http.Redirect(rw, req, u.String(), http.StatusMovedPermanently)
+		return
+	}
+
+	code := 200
+	f, err := tree.File(name)
+	if err != nil || f.Mode == filemode.Symlink {
+		code = 404
+		f, err = tree.File("404.html")
+		if err != nil {
+			http.Error(rw, "not found", 404)
+			return
+		}
+	}
+	fr, err := f.Reader()
+	if err != nil {
+		log.Println("pages error", err)
+		http.Error(rw, "internal error", 500)
+		return
+	}
+	content, err := ioutil.ReadAll(fr)
+	fr.Close()
+	if err != nil {
+		log.Println("pages error", err)
+		http.Error(rw, "internal error", 500)
+		return
+	}
+
+	if t := pagesContentType(f.Name); t != "" {
+		rw.Header().Set("Content-Type", t)
+	}
+	if rc.visibility() == VisibilityPublic {
+		rw.Header().Set("Cache-Control", "public, no-cache")
+	} else {
+		rw.Header().Set("Cache-Control", "private, no-cache")
+	}
+	if code != 200 {
+		rw.WriteHeader(code)
+		rw.Write(content)
+		return
+	}
+	rw.Header().Set("ETag", `"`+site.Tree.String()+`"`)
+	http.ServeContent(rw, req, f.Name, site.When, bytes.NewReader(content))
+}
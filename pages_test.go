@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestPagesFor(t *testing.T) {
+	tr := newTestRepo(t)
+	tr.branch("gh-pages", tr.commit("site", map[string]string{
+		"index.html":     "<h1>home</h1>",
+		"sub/index.html": "<h1>sub</h1>",
+	}))
+	gs := newTestServer(&Config{Repos: map[string]*RepoConfig{
+		"site": {Users: public, Pages: &PagesConfig{Host: "site.example.com"}},
+		"docs": {Users: public, Pages: &PagesConfig{Host: "site.example.com", Prefix: "/docs/"}},
+		// no host, so not served at all
+		"web": {Users: public, Pages: &PagesConfig{}},
+		"pre": {Users: public, Pages: &PagesConfig{Prefix: "pre"}},
+	}}, map[string]*testRepo{"site": tr})
+
+	tests := []struct {
+		target string
+		repo   string
+		rest   string
+	}{
+		{"http://site.example.com/", "site", "/"},
+		{"http://site.example.com:8080/a.css", "site", "/a.css"},
+		{"http://SITE.example.com/docs/x", "docs", "/x"},
+		{"http://site.example.com/docsx", "site", "/docsx"},
+		{"http://example.com/pages/web/", "", ""},
+		{"http://example.com/pre/", "", ""},
+		{"http://example.com/", "", ""},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest("GET", test.target, nil)
+		repo, _, rest, ok := gs.pagesFor(req)
+		if ok != (test.repo != "") || repo != test.repo || rest != test.rest {
+			t.Errorf("%s: got %q %q %v", test.target, repo, rest, ok)
+		}
+	}
+
+	h := gs.pagesHandler(http.NotFoundHandler())
+	rr := get(h, "http://site.example.com/")
+	if rr.Code != 200 || rr.Body.String() != "<h1>home</h1>" {
+		t.Errorf("site root: got %d %q", rr.Code, rr.Body)
+	}
+	rr = get(h, "http://site.example.com/sub")
+	if rr.Code != 301 {
+		t.Errorf("directory: got %d", rr.Code)
+	}
+
+	// a new config gets a new host map
+	gs.c = &Config{Repos: map[string]*RepoConfig{
+		"site": {Users: public, Pages: &PagesConfig{Host: "Other.example.com"}},
+	}}
+	req, _ := http.NewRequest("GET", "http://other.example.com/", nil)
+	if repo, _, _, ok := gs.pagesFor(req); !ok || repo != "site" {
+		t.Errorf("after config change: got %q %v", repo, ok)
+	}
+}
+
+func TestValidatePages(t *testing.T) {
+	tests := []struct {
+		c  Config
+		ok bool
+	}{
+		{Config{ExternalURL: "https://git.example.com"}, true},
+		{Config{ExternalURL: "https://git.example.com:8443/"}, false},
+		{Config{OIDC: &OIDCConfig{RedirectURL: "https://GIT.example.com/login/oidc/callback"}}, false},
+		{Config{}, true},
+	}
+	for _, test := range tests {
+		test.c.Repos = map[string]*RepoConfig{
+			"site": {Pages: &PagesConfig{Host: "git.example.com"}},
+		}
+		if test.ok {
+			test.c.Repos["site"].Pages.Host = "docs.example.com"
+		}
+		err := validateConfig(&test.c)
+		if (err == nil) != test.ok {
+			t.Errorf("%+v: got %v", test.c, err)
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/storage"
+)
+
+// PushMirror is a remote that a repo is replicated to after every push.
+type PushMirror struct {
+	URL string
+
+	// Credentials names an entry in Config.Credentials.
+	Credentials string
+
+	// Refs are the ref patterns to push, e.g. "refs/heads/*". Defaults to
+	// all branches and tags.
+	Refs []string
+
+	// Prune deletes refs on the remote that no longer exist locally.
+	Prune bool
+}
+
+func (pm *PushMirror) refSpecs() []config.RefSpec {
+	refs := pm.Refs
+	if len(refs) == 0 {
+		refs = []string{"refs/heads/*", "refs/tags/*"}
+	}
+	specs := []config.RefSpec{}
+	for _, r := range refs {
+		specs = append(specs, config.RefSpec("+"+r+":"+r))
+	}
+	return specs
+}
+
+// PushMirrorStatus tracks replication to a single push mirror. Behind is
+// set from the moment a push lands until it has been replicated.
+type PushMirrorStatus struct {
+	URL         string
+	Behind      bool
+	LastAttempt time.Time
+	LastSuccess time.Time
+	LastError   string
+	Failures    int
+}
+
+const pushMirrorMaxBackoff = time.Hour
+
+type pushMirrorKey struct {
+	repo string
+	url  string
+}
+
+type pushMirrors struct {
+	mu     sync.Mutex
+	status map[pushMirrorKey]*PushMirrorStatus
+	// dirty is set when a push lands while a sync is already running, so
+	// the worker knows to go round again.
+	dirty   map[pushMirrorKey]bool
+	running map[pushMirrorKey]bool
+}
+
+func pushMirrorBackoff(failures int) time.Duration {
+	d := time.Duration(1<<uint(failures)) * time.Second
+	if failures > 12 || d > pushMirrorMaxBackoff {
+		return pushMirrorMaxBackoff
+	}
+	return d
+}
+
+// PushMirrorStatus returns a snapshot of the status of every push mirror
+// configured on repo.
+func (gs *gitServe) PushMirrorStatus(repo string) []PushMirrorStatus {
+	rc := gs.getConfig().Repos[repo]
+	if rc == nil {
+		return nil
+	}
+	gs.pushMirrors.mu.Lock()
+	defer gs.pushMirrors.mu.Unlock()
+	statuses := []PushMirrorStatus{}
+	for _, pm := range rc.PushMirrors {
+		st, ok := gs.pushMirrors.status[pushMirrorKey{repo, pm.URL}]
+		if !ok {
+			statuses = append(statuses, PushMirrorStatus{URL: pm.URL})
+			continue
+		}
+		statuses = append(statuses, *st)
+	}
+	return statuses
+}
+
+// queuePushMirrors marks every push mirror of repo as behind and makes sure
+// a worker is replicating to it.
+func (gs *gitServe) queuePushMirrors(repo string) {
+	rc := gs.getConfig().Repos[repo]
+	if rc == nil {
+		return
+	}
+	gs.pushMirrors.mu.Lock()
+	defer gs.pushMirrors.mu.Unlock()
+	for _, pm := range rc.PushMirrors {
+		k := pushMirrorKey{repo, pm.URL}
+		st, ok := gs.pushMirrors.status[k]
+		if !ok {
+			st = &PushMirrorStatus{URL: pm.URL}
+			gs.pushMirrors.status[k] = st
+		}
+		st.Behind = true
+		gs.pushMirrors.dirty[k] = true
+		if !gs.pushMirrors.running[k] {
+			gs.pushMirrors.running[k] = true
+			go gs.pushMirrorWorker(k)
+		}
+	}
+}
+
+// queueAllPushMirrors schedules a sync of every push mirror, so targets
+// catch up on anything missed while gitserve wasn't running.
+func (gs *gitServe) queueAllPushMirrors() {
+	for repo, rc := range gs.getConfig().Repos {
+		if len(rc.PushMirrors) > 0 {
+			gs.queuePushMirrors(repo)
+		}
+	}
+}
+
+// pushMirrorWorker replicates to a single target until it is up to date,
+// backing off between failed attempts. It gives up if the target is removed
+// from the config.
+func (gs *gitServe) pushMirrorWorker(k pushMirrorKey) {
+	pm := gs.pushMirror(k)
+	for pm != nil {
+		gs.pushMirrors.mu.Lock()
+		delete(gs.pushMirrors.dirty, k)
+		st := gs.pushMirrors.status[k]
+		st.LastAttempt = time.Now()
+		gs.pushMirrors.mu.Unlock()
+
+		err := gs.pushToMirror(k.repo, pm)
+
+		gs.pushMirrors.mu.Lock()
+		var wait time.Duration
+		if err != nil {
+			log.Println("push mirror failed", k.repo, k.url, err)
+			st.LastError = err.Error()
+			st.Failures++
+			wait = pushMirrorBackoff(st.Failures)
+		} else {
+			st.LastError = ""
+			st.Failures = 0
+			st.LastSuccess = st.LastAttempt
+			if !gs.pushMirrors.dirty[k] {
+				st.Behind = false
+				delete(gs.pushMirrors.running, k)
+				gs.pushMirrors.mu.Unlock()
+				return
+			}
+		}
+		gs.pushMirrors.mu.Unlock()
+
+		time.Sleep(wait)
+		pm = gs.pushMirror(k)
+	}
+	gs.pushMirrors.mu.Lock()
+	delete(gs.pushMirrors.running, k)
+	delete(gs.pushMirrors.dirty, k)
+	delete(gs.pushMirrors.status, k)
+	gs.pushMirrors.mu.Unlock()
+}
+
+// pushMirror finds the current configuration for k.
+func (gs *gitServe) pushMirror(k pushMirrorKey) *PushMirror {
+	rc := gs.getConfig().Repos[k.repo]
+	if rc == nil {
+		return nil
+	}
+	for _, pm := range rc.PushMirrors {
+		if pm.URL == k.url {
+			return pm
+		}
+	}
+	return nil
+}
+
+func (gs *gitServe) pushToMirror(repo string, pm *PushMirror) error {
+	c := gs.getConfig()
+	auth, err := c.auth(pm.Credentials)
+	if err != nil {
+		return err
+	}
+	s, err := gs.storer(repo, c.Repos[repo])
+	if err != nil {
+		return err
+	}
+	remote := git.NewRemote(s.(storage.Storer), &config.RemoteConfig{
+		Name: "mirror",
+		URLs: []string{pm.URL},
+	})
+	specs := pm.refSpecs()
+	if pm.Prune {
+		deletes, err := mirrorPrunes(remote, s, specs, auth)
+		if err != nil {
+			return err
+		}
+		specs = append(specs, deletes...)
+	}
+	err = remote.Push(&git.PushOptions{
+		RemoteName: "mirror",
+		RefSpecs:   specs,
+		Auth:       auth,
+	})
+	if err == git.NoErrAlreadyUpToDate {
+		return nil
+	}
+	return err
+}
+
+// mirrorPrunes returns delete refspecs for the refs of remote that specs
+// cover but that no longer exist in s. go-git's own Prune can't be used: it
+// reverses the forced refspecs mirrors push with, keeping the + on the
+// wrong side, and then finds no local ref for anything and deletes it all.
+func mirrorPrunes(remote *git.Remote, s storer.Storer, specs []config.RefSpec, auth transport.AuthMethod) ([]config.RefSpec, error) {
+	refs, err := remote.List(&git.ListOptions{Auth: auth})
+	if err == transport.ErrEmptyRemoteRepository {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	deletes := []config.RefSpec{}
+	for _, ref := range refs {
+		if ref.Type() != plumbing.HashReference {
+			continue
+		}
+		for _, spec := range specs {
+			rev := config.RefSpec(strings.TrimPrefix(spec.String(), "+")).Reverse()
+			if !rev.Match(ref.Name()) {
+				continue
+			}
+			_, err := s.Reference(rev.Dst(ref.Name()))
+			if err == plumbing.ErrReferenceNotFound {
+				deletes = append(deletes, config.RefSpec(":"+ref.Name().String()))
+			} else if err != nil {
+				return nil, err
+			}
+			break
+		}
+	}
+	return deletes, nil
+}
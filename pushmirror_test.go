@@ -0,0 +1,163 @@
+package main
+
+import (
+	"os/exec"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+func TestPushMirrorRefSpecs(t *testing.T) {
+	pm := &PushMirror{}
+	want := []config.RefSpec{"+refs/heads/*:refs/heads/*", "+refs/tags/*:refs/tags/*"}
+	if got := pm.refSpecs(); !reflect.DeepEqual(got, want) {
+		t.Errorf("default: got %v", got)
+	}
+	pm.Refs = []string{"refs/heads/main"}
+	if got := pm.refSpecs(); !reflect.DeepEqual(got, []config.RefSpec{"+refs/heads/main:refs/heads/main"}) {
+		t.Errorf("refs: got %v", got)
+	}
+}
+
+func TestPushMirrorBackoff(t *testing.T) {
+	tests := map[int]time.Duration{
+		1:  2 * time.Second,
+		5:  32 * time.Second,
+		12: pushMirrorMaxBackoff,
+		40: pushMirrorMaxBackoff,
+	}
+	for failures, want := range tests {
+		if got := pushMirrorBackoff(failures); got != want {
+			t.Errorf("%d failures: got %v, want %v", failures, got, want)
+		}
+	}
+}
+
+// mirrorTarget is an empty bare repo on disk for push mirrors to push to.
+func mirrorTarget(t *testing.T) *upstreamRepo {
+	// file:// pushes run git-receive-pack
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	up := newUpstreamRepo(t)
+	r, err := git.PlainInit(up.dir+"/target.git", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up.dir += "/target.git"
+	up.r = r
+	return up
+}
+
+func refHashes(t *testing.T, r *git.Repository) map[string]plumbing.Hash {
+	refs := map[string]plumbing.Hash{}
+	iter, err := r.References()
+	if err != nil {
+		t.Fatal(err)
+	}
+	iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() == plumbing.HashReference {
+			refs[ref.Name().String()] = ref.Hash()
+		}
+		return nil
+	})
+	return refs
+}
+
+func TestPushToMirror(t *testing.T) {
+	target := mirrorTarget(t)
+	tr := newTestRepo(t)
+	c := tr.commit("init", map[string]string{"a": "a"})
+	tr.branch("master", c)
+	tr.branch("dev", c)
+	tr.tag("v1", c)
+	pm := &PushMirror{URL: "file://" + target.dir, Refs: []string{"refs/heads/*"}}
+	gs := newTestServer(&Config{Repos: map[string]*RepoConfig{
+		"repo": {PushMirrors: []*PushMirror{pm}},
+	}}, map[string]*testRepo{"repo": tr})
+
+	err := gs.pushToMirror("repo", pm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]plumbing.Hash{"refs/heads/master": c, "refs/heads/dev": c}
+	if got := refHashes(t, target.r); !reflect.DeepEqual(got, want) {
+		t.Errorf("only branches: got %v", got)
+	}
+	// nothing new is fine
+	err = gs.pushToMirror("repo", pm)
+	if err != nil {
+		t.Errorf("up to date push: %v", err)
+	}
+
+	err = tr.s.RemoveReference("refs/heads/dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm.Refs = nil
+	pm.Prune = true
+	err = gs.pushToMirror("repo", pm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]plumbing.Hash{"refs/heads/master": c, "refs/tags/v1": c}
+	if got := refHashes(t, target.r); !reflect.DeepEqual(got, want) {
+		t.Errorf("pruned with tags: got %v", got)
+	}
+}
+
+func TestPushMirrorStatus(t *testing.T) {
+	target := mirrorTarget(t)
+	tr := newTestRepo(t)
+	tr.branch("master", tr.commit("init", map[string]string{"a": "a"}))
+	good := &PushMirror{URL: "file://" + target.dir}
+	bad := &PushMirror{URL: "file://" + target.dir + "-missing"}
+	gs := newTestServer(&Config{Repos: map[string]*RepoConfig{
+		"repo": {PushMirrors: []*PushMirror{good, bad}},
+	}}, map[string]*testRepo{"repo": tr})
+	gs.pushMirrors = pushMirrors{
+		status:  map[pushMirrorKey]*PushMirrorStatus{},
+		dirty:   map[pushMirrorKey]bool{},
+		running: map[pushMirrorKey]bool{},
+	}
+
+	if st := gs.PushMirrorStatus("repo"); len(st) != 2 || st[0].Behind || !st[0].LastAttempt.IsZero() {
+		t.Errorf("before any push: got %+v", st)
+	}
+	gs.queuePushMirrors("repo")
+	deadline := time.Now().Add(10 * time.Second)
+	var st []PushMirrorStatus
+	for time.Now().Before(deadline) {
+		st = gs.PushMirrorStatus("repo")
+		if !st[0].Behind && st[1].Failures > 0 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st[0].Behind || st[0].LastSuccess.IsZero() || st[0].LastError != "" {
+		t.Errorf("good mirror: got %+v", st[0])
+	}
+	if !st[1].Behind || st[1].Failures == 0 || st[1].LastError == "" || !st[1].LastSuccess.IsZero() {
+		t.Errorf("bad mirror: got %+v", st[1])
+	}
+
+	// removing the mirror from the config stops its worker
+	gs.mu.Lock()
+	gs.c = &Config{Repos: map[string]*RepoConfig{"repo": {}}}
+	gs.mu.Unlock()
+	deadline = time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		gs.pushMirrors.mu.Lock()
+		n := len(gs.pushMirrors.running)
+		gs.pushMirrors.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("worker for a removed mirror kept running")
+}
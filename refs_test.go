@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSplitRefPath(t *testing.T) {
+	names := map[string]bool{
+		"master":      true,
+		"feature":     true,
+		"feature/x":   true,
+		"release/1.0": true,
+	}
+	tests := []struct {
+		rest, ref, path string
+	}{
+		{"", "", ""},
+		{"master", "master", ""},
+		{"master/docs/a.md", "master", "docs/a.md"},
+		{"feature/x", "feature/x", ""},
+		{"feature/x/main.go", "feature/x", "main.go"},
+		{"feature/y/main.go", "feature", "y/main.go"},
+		{"release/1.0/a/b", "release/1.0", "a/b"},
+		{"0123abcd/main.go", "0123abcd", "main.go"},
+	}
+	for _, test := range tests {
+		ref, p := splitRefPath(names, test.rest)
+		if ref != test.ref || p != test.path {
+			t.Errorf("splitRefPath(%q) = %q, %q, want %q, %q", test.rest, ref, p, test.ref, test.path)
+		}
+	}
+}
+
+func TestSlashedBranches(t *testing.T) {
+	tr := newTestRepo(t)
+	master := tr.commit("master", map[string]string{"main.go": "master"})
+	tr.branch("master", master)
+	tr.branch("feature/x", tr.commit("feature", map[string]string{"main.go": "feature", "docs/a.md": "docs"}, master))
+	gs := newTestServer(&Config{Repos: map[string]*RepoConfig{"repo": {Users: public}}}, map[string]*testRepo{"repo": tr})
+
+	rr := get(http.HandlerFunc(gs.git), "/repo/blob/feature/x/main.go")
+	if rr.Code != 200 || rr.Body.String() != "feature" {
+		t.Errorf("web blob: got %d %q", rr.Code, rr.Body.String())
+	}
+	rr = get(http.HandlerFunc(gs.git), "/repo/blob/feature/x/docs")
+	if rr.Code != 200 || !strings.Contains(rr.Body.String(), "a.md") {
+		t.Errorf("web tree: got %d", rr.Code)
+	}
+
+	rr = get(http.HandlerFunc(gs.api), "/api/v1/repos/repo/tree/feature/x/docs")
+	var tree apiTree
+	err := json.Unmarshal(rr.Body.Bytes(), &tree)
+	if err != nil || rr.Code != 200 {
+		t.Fatalf("api tree: got %d %v", rr.Code, err)
+	}
+	if tree.Ref != "feature/x" || tree.Path != "docs" || len(tree.Entries) != 1 {
+		t.Errorf("api tree: got %+v", tree)
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage"
+	"github.com/google/go-jsonnet"
+)
+
+// renderFormats maps the format query parameter of the render view to the
+// content type of its output. yaml-stream renders a top level array as a
+// stream of YAML documents, like jsonnet -y.
+var renderFormats = map[string]string{
+	"json":        "application/json",
+	"yaml":        "text/yaml; charset=utf-8",
+	"yaml-stream": "text/yaml; charset=utf-8",
+}
+
+// toYAML converts a JSON document with the jsonnet standard library, so
+// the output matches what jsonnet itself would produce.
+func toYAML(doc string, stream bool) (string, error) {
+	vm := jsonnet.MakeVM()
+	vm.StringOutput = true
+	vm.ExtCode("doc", doc)
+	fn := "std.manifestYamlDoc"
+	if stream {
+		fn = "std.manifestYamlStream"
+	}
+	return vm.EvaluateSnippet("yaml", fn+"(std.extVar('doc'))")
+}
+
+// setRenderVars passes ext vars and top level arguments from the query
+// string to vm, as ext.<name> and tla.<name>. They're only ever strings:
+// jsonnet code from a URL could run for as long as it liked.
+func setRenderVars(vm *jsonnet.VM, req *http.Request) {
+	for k, vs := range req.URL.Query() {
+		v := vs[len(vs)-1]
+		switch {
+		case strings.HasPrefix(k, "ext."):
+			vm.ExtVar(strings.TrimPrefix(k, "ext."), v)
+		case strings.HasPrefix(k, "tla."):
+			vm.TLAVar(strings.TrimPrefix(k, "tla."), v)
+		}
+	}
+}
+
+// repoImporter imports from tree, a commit of a repo configured by rc.
+// Libraries are read on behalf of user with the claimed groups, who needs web
+// access to them.
+func (gs *gitServe) repoImporter(tree *object.Tree, rc *RepoConfig, user string, groups []string) *treeImporter {
+	ti := newTreeImporter(tree, rc.Jsonnet)
+	ti.openLibrary = func(lib *JsonnetLibrary) (*object.Tree, error) {
+		if lib.Ref == "" {
+			return nil, fmt.Errorf("no ref to pin to")
+		}
+		lrc := gs.getConfig().Repos[lib.Repo]
+		if lrc == nil || !gs.hasAccess(lrc, user, groups, "web") {
+			return nil, fmt.Errorf("unknown repo %s", lib.Repo)
+		}
+		s, err := gs.storer(lib.Repo, lrc)
+		if err != nil {
+			return nil, err
+		}
+		r, err := git.Open(s.(storage.Storer), nil)
+		if err != nil {
+			return nil, err
+		}
+		c, err := resolveCommit(r, lib.Ref)
+		if err != nil {
+			return nil, err
+		}
+		return c.Tree()
+	}
+	return ti
+}
+
+// renderTimeout bounds how long a render may take. go-jsonnet can't be
+// interrupted, so an evaluation that runs over carries on in the background
+// until it finishes, holding one of renderSlots so that runaway ones can't
+// pile up.
+var renderTimeout = 10 * time.Second
+
+// renderMaxStack is the deepest a render's jsonnet may recurse, and
+// renderMaxOutput the most it may output.
+const (
+	renderMaxStack  = 200
+	renderMaxOutput = 16 << 20
+)
+
+var renderSlots = make(chan struct{}, 4)
+
+// RenderJsonnet evaluates the jsonnet file p, importing with ti, as
+// requested by /<repo>/render/<ref>/<path>. With multi=1 the file is
+// evaluated in multi file mode, like jsonnet -m, and the result is an object
+// of every output file, or only the one named by file=<name>.
+func (gs *gitServe) RenderJsonnet(ti *treeImporter, p string, rw http.ResponseWriter, req *http.Request) {
+	format := req.FormValue("format")
+	if format == "" {
+		format = "json"
+	}
+	contentType, ok := renderFormats[format]
+	if !ok {
+		http.Error(rw, "unknown format "+format, 400)
+		return
+	}
+
+	timeout := time.NewTimer(renderTimeout)
+	defer timeout.Stop()
+	select {
+	case renderSlots <- struct{}{}:
+	case <-timeout.C:
+		http.Error(rw, "too many renders in progress", http.StatusServiceUnavailable)
+		return
+	}
+
+	vm := newTreeVM(ti)
+	vm.MaxStack = renderMaxStack
+	setRenderVars(vm, req)
+	multi, file := req.FormValue("multi") == "1", req.FormValue("file")
+	type result struct {
+		out  string
+		code int
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		defer func() { <-renderSlots }()
+		out, code, err := renderJsonnet(vm, p, multi, file, format)
+		done <- result{out, code, err}
+	}()
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			http.Error(rw, res.err.Error(), res.code)
+			return
+		}
+		rw.Header().Set("Content-Type", contentType)
+		io.WriteString(rw, res.out)
+	case <-timeout.C:
+		http.Error(rw, "render timed out", http.StatusServiceUnavailable)
+	}
+}
+
+// renderJsonnet does the work of RenderJsonnet, returning the output or an
+// error and the status code to report it with.
+func renderJsonnet(vm *jsonnet.VM, p string, multi bool, file string, format string) (string, int, error) {
+	node, _, err := vm.ImportAST("", p)
+	if err != nil {
+		return "", http.StatusUnprocessableEntity, err
+	}
+
+	var out string
+	if multi {
+		// go-jsonnet v0.16 declares the result as interface{}, though it's
+		// always a map of file names to JSON documents.
+		res, err := vm.EvaluateMulti(node)
+		if err != nil {
+			return "", http.StatusUnprocessableEntity, err
+		}
+		files, ok := res.(map[string]string)
+		if !ok {
+			return "", 500, fmt.Errorf("unexpected multi file output %T", res)
+		}
+		docs := map[string]json.RawMessage{}
+		for name, doc := range files {
+			docs[name] = json.RawMessage(doc)
+		}
+		if file != "" {
+			doc, ok := docs[file]
+			if !ok {
+				return "", 404, fmt.Errorf("no output file %s", file)
+			}
+			out = string(doc)
+		} else {
+			b, err := json.MarshalIndent(docs, "", "   ")
+			if err != nil {
+				return "", 500, err
+			}
+			out = string(b) + "\n"
+		}
+	} else {
+		out, err = vm.Evaluate(node)
+		if err != nil {
+			return "", http.StatusUnprocessableEntity, err
+		}
+	}
+	if len(out) > renderMaxOutput {
+		return "", http.StatusUnprocessableEntity, fmt.Errorf("output is over %d bytes", renderMaxOutput)
+	}
+
+	if format != "json" {
+		out, err = toYAML(out, format == "yaml-stream")
+		if err != nil {
+			return "", http.StatusUnprocessableEntity, err
+		}
+	}
+	return out, 200, nil
+}
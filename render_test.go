@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-jsonnet"
+)
+
+func TestSetRenderVars(t *testing.T) {
+	eval := func(query string, snippet string) (string, error) {
+		vm := jsonnet.MakeVM()
+		setRenderVars(vm, httptest.NewRequest("GET", "/repo/render/master/x.jsonnet?"+query, nil))
+		return vm.EvaluateSnippet("x.jsonnet", snippet)
+	}
+
+	out, err := eval("ext.a=1&tla.b=2", "function(b) [std.extVar('a'), b]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(strings.Fields(out), "") != `["1","2"]` {
+		t.Errorf("got %s", out)
+	}
+
+	// code from the query string isn't evaluated
+	_, err = eval("ext-code.a=1%2B1", "std.extVar('a')")
+	if err == nil {
+		t.Error("ext-code var was set")
+	}
+	out, err = eval("tla-code.b=1%2B1", "function(b=0) b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.TrimSpace(out) != "0" {
+		t.Errorf("tla-code arg was set: %s", out)
+	}
+}
+
+func TestRenderJsonnetLimits(t *testing.T) {
+	tr := newTestRepo(t)
+	tree, err := tr.r.TreeObject(tr.tree(map[string]string{
+		"ok.jsonnet":    `{a: {b: 1}}`,
+		"deep.jsonnet":  `local f(n) = if n == 0 then 0 else 1 + f(n - 1); f(10000)`,
+		"slow.jsonnet":  `std.foldl(function(a, x) a + std.foldl(function(b, y) b + 1, std.range(1, 3000), 0), std.range(1, 3000), 0)`,
+		"multi.jsonnet": `{"a.json": {x: 1}}`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := newTestServer(&Config{}, nil)
+	render := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		rr := httptest.NewRecorder()
+		gs.RenderJsonnet(newTreeImporter(tree, nil), strings.TrimPrefix(req.URL.Path, "/"), rr, req)
+		return rr
+	}
+
+	if rr := render("/ok.jsonnet"); rr.Code != 200 {
+		t.Errorf("ok: got %d %s", rr.Code, rr.Body)
+	}
+	if rr := render("/multi.jsonnet?multi=1&file=a.json"); rr.Code != 200 || strings.TrimSpace(rr.Body.String()) != "{\n   \"x\": 1\n}" {
+		t.Errorf("multi: got %d %q", rr.Code, rr.Body)
+	}
+	if rr := render("/deep.jsonnet"); rr.Code != http.StatusUnprocessableEntity || !strings.Contains(rr.Body.String(), "stack") {
+		t.Errorf("deep recursion: got %d %s", rr.Code, rr.Body)
+	}
+
+	old := renderTimeout
+	renderTimeout = 50 * time.Millisecond
+	t.Cleanup(func() { renderTimeout = old })
+	start := time.Now()
+	if rr := render("/slow.jsonnet"); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("slow: got %d %s", rr.Code, rr.Body)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("slow render took %v", d)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/andyleap/go-s3"
+)
+
+// metaPrefix is where the server keeps data of its own in the bucket, apart
+// from any repo's. No repo can be named under it.
+const metaPrefix = "_gitserve"
+
+// repoIndexPrefix holds an empty marker object for every repo in storage,
+// so finding them takes one short listing instead of listing every object
+// of every repo.
+var repoIndexPrefix = path.Join(metaPrefix, "repos") + "/"
+
+// repoIndexDone marks that repos created before the index existed have
+// been added to it.
+var repoIndexDone = path.Join(metaPrefix, "repos-indexed")
+
+// indexRepo adds a newly created repo to the repo index.
+func (gs *gitServe) indexRepo(name string) error {
+	start := time.Now()
+	err := gs.s3.Put(repoIndexPrefix+name, []byte{}, nil)
+	metrics.observeS3("put", start, err)
+	return err
+}
+
+// storedRepos lists the repos that exist in storage, whether or not the
+// config knows about them. The first call on a bucket from before the repo
+// index scans the whole bucket once to fill it in.
+func (gs *gitServe) storedRepos() ([]interface{}, error) {
+	start := time.Now()
+	r, err := gs.s3.Get(repoIndexDone)
+	metrics.observeS3("get", start, err)
+	if c, ok := r.(io.Closer); ok {
+		c.Close()
+	}
+	if s3err, ok := err.(s3.Error); ok && s3err.Code == "NoSuchKey" {
+		err = gs.backfillRepoIndex()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	start = time.Now()
+	objs, err := gs.s3.List(repoIndexPrefix)
+	metrics.observeS3("list", start, err)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, o := range objs {
+		name := strings.TrimPrefix(o.Key, repoIndexPrefix)
+		if name != "admin" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	repos := []interface{}{}
+	for _, name := range names {
+		repos = append(repos, name)
+	}
+	return repos, nil
+}
+
+// backfillRepoIndex adds every repo already in the bucket to the repo
+// index.
+func (gs *gitServe) backfillRepoIndex() error {
+	start := time.Now()
+	objs, err := gs.s3.List("")
+	metrics.observeS3("list", start, err)
+	if err != nil {
+		return err
+	}
+	for _, o := range objs {
+		if !strings.HasSuffix(o.Key, "/ref/HEAD") || strings.HasPrefix(o.Key, metaPrefix+"/") {
+			continue
+		}
+		err = gs.indexRepo(strings.TrimSuffix(o.Key, "/ref/HEAD"))
+		if err != nil {
+			return err
+		}
+	}
+	start = time.Now()
+	err = gs.s3.Put(repoIndexDone, []byte{}, nil)
+	metrics.observeS3("put", start, err)
+	return err
+}
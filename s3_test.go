@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/andyleap/go-s3"
+)
+
+// fakeS3 is an in-memory S3 bucket, just enough of the API for go-s3.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	nextID  int
+
+	// lists records the prefix of every list request.
+	lists []string
+}
+
+// newFakeS3 starts a fake S3 server and returns a client for its bucket.
+func newFakeS3(t *testing.T) (*s3.Client, *fakeS3) {
+	f := &fakeS3{
+		objects: map[string][]byte{},
+		uploads: map[string]map[int][]byte{},
+	}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	c, err := s3.NewClient(&s3.Client{
+		AccessKeyID:     "key",
+		SecretAccessKey: "secret",
+		Region:          "us-east-1",
+		Bucket:          "test",
+		Domain:          strings.TrimPrefix(srv.URL, "http://"),
+		Protocol:        "http",
+		UsePathBuckets:  true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, f
+}
+
+func (f *fakeS3) keys(prefix string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	keys := []string{}
+	for k := range f.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeS3) error(rw http.ResponseWriter, code int, s3code string) {
+	rw.WriteHeader(code)
+	fmt.Fprintf(rw, "<Error><Code>%s</Code><Message>%s</Message></Error>", s3code, s3code)
+}
+
+func (f *fakeS3) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/test"), "/")
+	q := req.URL.Query()
+	body, _ := ioutil.ReadAll(req.Body)
+
+	switch {
+	case req.Method == "GET" && key == "":
+		prefix := q.Get("prefix")
+		f.lists = append(f.lists, prefix)
+		type content struct {
+			Key  string
+			ETag string
+			Size int
+		}
+		var res struct {
+			XMLName  xml.Name `xml:"ListBucketResult"`
+			Contents []content
+		}
+		keys := []string{}
+		for k := range f.objects {
+			if strings.HasPrefix(k, prefix) {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			res.Contents = append(res.Contents, content{Key: k, ETag: `"etag"`, Size: len(f.objects[k])})
+		}
+		xml.NewEncoder(rw).Encode(res)
+	case req.Method == "GET" || req.Method == "HEAD":
+		obj, ok := f.objects[key]
+		if !ok {
+			if req.Method == "HEAD" {
+				rw.WriteHeader(404)
+				return
+			}
+			f.error(rw, 404, "NoSuchKey")
+			return
+		}
+		rw.Header().Set("Content-Length", strconv.Itoa(len(obj)))
+		rw.Header().Set("ETag", `"etag"`)
+		if req.Method == "GET" {
+			rw.Write(obj)
+		}
+	case req.Method == "PUT" && q.Get("uploadId") != "":
+		parts, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			f.error(rw, 404, "NoSuchUpload")
+			return
+		}
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		parts[n] = body
+		rw.Header().Set("ETag", fmt.Sprintf(`"part%d"`, n))
+	case req.Method == "PUT":
+		f.objects[key] = body
+	case req.Method == "POST" && q["uploads"] != nil:
+		f.nextID++
+		id := strconv.Itoa(f.nextID)
+		f.uploads[id] = map[int][]byte{}
+		fmt.Fprintf(rw, "<InitiateMultipartUploadResult><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>", key, id)
+	case req.Method == "POST" && q.Get("uploadId") != "":
+		parts, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			f.error(rw, 404, "NoSuchUpload")
+			return
+		}
+		obj := []byte{}
+		for n := 1; n <= len(parts); n++ {
+			obj = append(obj, parts[n]...)
+		}
+		f.objects[key] = obj
+		delete(f.uploads, q.Get("uploadId"))
+	case req.Method == "DELETE":
+		delete(f.objects, key)
+		rw.WriteHeader(204)
+	default:
+		f.error(rw, 400, "InvalidRequest")
+	}
+}
@@ -0,0 +1,499 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andyleap/go-s3"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/storage"
+)
+
+const (
+	// searchMaxFileSize is the largest file that gets indexed.
+	searchMaxFileSize = 1 << 20
+	// searchMaxFiles and searchMaxLines cap the size of a result set.
+	searchMaxFiles = 100
+	searchMaxLines = 10
+	// searchMaxLineLength is how much of a matching line is returned.
+	searchMaxLineLength = 200
+	// searchMinQuery is the shortest query, in bytes, that has a trigram
+	// to look up.
+	searchMinQuery = 3
+)
+
+// searchCacheSize bounds the memory, roughly, that loaded indexes are kept
+// in.
+var searchCacheSize = 256 << 20
+
+var errSearchQueryTooShort = fmt.Errorf("search queries must be at least %d characters", searchMinQuery)
+
+// searchIndex is a trigram index of the text files in one commit of a repo.
+// Trigrams are taken from the lowercased contents, so searches are case
+// insensitive.
+type searchIndex struct {
+	Commit string
+	Files  []searchFile
+	// Trigrams maps each trigram to the indexes into Files that contain it,
+	// in ascending order.
+	Trigrams map[uint32][]uint32
+}
+
+type searchFile struct {
+	Path string
+	Hash string
+}
+
+// size estimates the memory idx takes up.
+func (idx *searchIndex) size() int {
+	n := len(idx.Commit)
+	for _, f := range idx.Files {
+		n += len(f.Path) + len(f.Hash) + 32
+	}
+	for _, postings := range idx.Trigrams {
+		n += 4*len(postings) + 48
+	}
+	return n
+}
+
+// searchIndexCache keeps the most recently used indexes, up to
+// searchCacheSize bytes of them. The zero value is ready to use.
+type searchIndexCache struct {
+	lru   *list.List
+	items map[string]*list.Element
+	size  int
+}
+
+type searchCacheEntry struct {
+	repo string
+	idx  *searchIndex
+	size int
+}
+
+func (c *searchIndexCache) get(repo string) (*searchIndex, bool) {
+	e, ok := c.items[repo]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(e)
+	return e.Value.(*searchCacheEntry).idx, true
+}
+
+func (c *searchIndexCache) add(repo string, idx *searchIndex) {
+	if c.lru == nil {
+		c.lru = list.New()
+		c.items = map[string]*list.Element{}
+	}
+	c.remove(repo)
+	ent := &searchCacheEntry{repo: repo, idx: idx, size: idx.size()}
+	if ent.size > searchCacheSize {
+		return
+	}
+	c.items[repo] = c.lru.PushFront(ent)
+	c.size += ent.size
+	for c.size > searchCacheSize {
+		c.remove(c.lru.Back().Value.(*searchCacheEntry).repo)
+	}
+}
+
+func (c *searchIndexCache) remove(repo string) {
+	e, ok := c.items[repo]
+	if !ok {
+		return
+	}
+	c.lru.Remove(e)
+	delete(c.items, repo)
+	c.size -= e.Value.(*searchCacheEntry).size
+}
+
+type searchIndexer struct {
+	mu      sync.Mutex
+	cache   searchIndexCache
+	running map[string]bool
+	// dirty is set when a push lands while the repo is being indexed, so the
+	// worker knows to go round again.
+	dirty map[string]bool
+}
+
+type SearchMatch struct {
+	Line int    `json:"line"`
+	Text string `json:"text"`
+}
+
+type SearchResult struct {
+	Repo    string        `json:"repo"`
+	Path    string        `json:"path"`
+	Commit  string        `json:"commit"`
+	Matches []SearchMatch `json:"matches"`
+}
+
+type SearchResults struct {
+	Query     string         `json:"query"`
+	Results   []SearchResult `json:"results"`
+	Truncated bool           `json:"truncated,omitempty"`
+}
+
+// searchIndexPath is where the index of repo is stored, under metaPrefix so
+// it can't collide with a repo named <repo>/search.
+func searchIndexPath(repo string) string {
+	return path.Join(metaPrefix, "search", repo, "index.json.gz")
+}
+
+func trigram(b []byte) uint32 {
+	return uint32(b[0])<<16 | uint32(b[1])<<8 | uint32(b[2])
+}
+
+// trigrams returns the distinct trigrams in b.
+func trigrams(b []byte) map[uint32]bool {
+	ts := map[uint32]bool{}
+	for i := 0; i+3 <= len(b); i++ {
+		ts[trigram(b[i:])] = true
+	}
+	return ts
+}
+
+// candidates returns the files that contain every trigram of q, which is
+// already lowercased. Queries too short to have trigrams match nothing.
+func (idx *searchIndex) candidates(q []byte) []uint32 {
+	var files []uint32
+	if len(q) < searchMinQuery {
+		return nil
+	}
+	first := true
+	for t := range trigrams(q) {
+		postings := idx.Trigrams[t]
+		if first {
+			files = postings
+			first = false
+			continue
+		}
+		merged := []uint32{}
+		i, j := 0, 0
+		for i < len(files) && j < len(postings) {
+			switch {
+			case files[i] < postings[j]:
+				i++
+			case files[i] > postings[j]:
+				j++
+			default:
+				merged = append(merged, files[i])
+				i++
+				j++
+			}
+		}
+		files = merged
+		if len(files) == 0 {
+			break
+		}
+	}
+	return files
+}
+
+// queueSearchIndex makes sure the search index of repo gets rebuilt from its
+// default branch.
+func (gs *gitServe) queueSearchIndex(repo string) {
+	gs.search.mu.Lock()
+	defer gs.search.mu.Unlock()
+	gs.search.dirty[repo] = true
+	if gs.search.running[repo] {
+		return
+	}
+	gs.search.running[repo] = true
+	go func() {
+		for {
+			gs.search.mu.Lock()
+			if !gs.search.dirty[repo] {
+				delete(gs.search.running, repo)
+				gs.search.mu.Unlock()
+				return
+			}
+			delete(gs.search.dirty, repo)
+			gs.search.mu.Unlock()
+
+			err := gs.buildSearchIndex(repo)
+			if err != nil {
+				log.Println("search index error", repo, err)
+			}
+		}
+	}()
+}
+
+// headCommit returns the commit HEAD of r points at, or nil if the repo is
+// empty.
+func headCommit(r *git.Repository) (*object.Commit, error) {
+	head, err := r.Head()
+	if err == plumbing.ErrReferenceNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return r.CommitObject(head.Hash())
+}
+
+// openSearchRepo opens repo, or returns nil if it's only in the config and
+// hasn't been pushed to yet. Searching never creates a repo.
+func (gs *gitServe) openSearchRepo(repo string) (*git.Repository, error) {
+	s, err := gs.existingStorer(repo)
+	if err != nil || s == nil {
+		return nil, err
+	}
+	return git.Open(s.(storage.Storer), nil)
+}
+
+func (gs *gitServe) buildSearchIndex(repo string) error {
+	if gs.getConfig().Repos[repo] == nil {
+		return nil
+	}
+	r, err := gs.openSearchRepo(repo)
+	if err != nil || r == nil {
+		return err
+	}
+	c, err := headCommit(r)
+	if err != nil || c == nil {
+		return err
+	}
+	if old, _ := gs.loadSearchIndex(repo); old != nil && old.Commit == c.Hash.String() {
+		return nil
+	}
+
+	tree, err := c.Tree()
+	if err != nil {
+		return err
+	}
+	idx := &searchIndex{
+		Commit:   c.Hash.String(),
+		Files:    []searchFile{},
+		Trigrams: map[uint32][]uint32{},
+	}
+	err = tree.Files().ForEach(func(f *object.File) error {
+		if f.Mode == filemode.Symlink || f.Mode == filemode.Submodule || f.Size > searchMaxFileSize {
+			return nil
+		}
+		rc, err := f.Reader()
+		if err != nil {
+			return err
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		if bytes.IndexByte(b, 0) >= 0 {
+			return nil
+		}
+		id := uint32(len(idx.Files))
+		idx.Files = append(idx.Files, searchFile{Path: f.Name, Hash: f.Hash.String()})
+		for t := range trigrams(bytes.ToLower(b)) {
+			idx.Trigrams[t] = append(idx.Trigrams[t], id)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	err = json.NewEncoder(zw).Encode(idx)
+	if err != nil {
+		return err
+	}
+	err = zw.Close()
+	if err != nil {
+		return err
+	}
+	hdrs := &http.Header{}
+	hdrs.Set("Content-Type", "application/gzip")
+	err = gs.s3.Put(searchIndexPath(repo), buf.Bytes(), hdrs)
+	if err != nil {
+		return err
+	}
+
+	gs.search.mu.Lock()
+	gs.search.cache.add(repo, idx)
+	gs.search.mu.Unlock()
+	return nil
+}
+
+// loadSearchIndex returns the stored search index of repo, or nil if it
+// hasn't been built.
+func (gs *gitServe) loadSearchIndex(repo string) (*searchIndex, error) {
+	gs.search.mu.Lock()
+	idx, ok := gs.search.cache.get(repo)
+	gs.search.mu.Unlock()
+	if ok {
+		return idx, nil
+	}
+	r, err := gs.s3.Get(searchIndexPath(repo))
+	if s3err, ok := err.(s3.Error); ok && s3err.Code == "NoSuchKey" {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	idx = &searchIndex{}
+	err = json.NewDecoder(zr).Decode(idx)
+	if err != nil {
+		return nil, err
+	}
+	gs.search.mu.Lock()
+	gs.search.cache.add(repo, idx)
+	gs.search.mu.Unlock()
+	return idx, nil
+}
+
+// searchRepo greps the indexed files of repo for q, which is lowercased.
+// Repos whose index is missing or behind their default branch get queued
+// for reindexing; until then the old index is searched.
+func (gs *gitServe) searchRepo(repo string, q []byte, results *SearchResults) error {
+	r, err := gs.openSearchRepo(repo)
+	if err != nil || r == nil {
+		return err
+	}
+	idx, err := gs.loadSearchIndex(repo)
+	if err != nil {
+		return err
+	}
+	c, err := headCommit(r)
+	if err != nil {
+		return err
+	}
+	if c != nil && (idx == nil || idx.Commit != c.Hash.String()) {
+		gs.queueSearchIndex(repo)
+	}
+	if idx == nil {
+		return nil
+	}
+
+	for _, id := range idx.candidates(q) {
+		if len(results.Results) >= searchMaxFiles {
+			results.Truncated = true
+			return nil
+		}
+		f := idx.Files[id]
+		b, err := r.BlobObject(plumbing.NewHash(f.Hash))
+		if err != nil {
+			return err
+		}
+		rc, err := b.Reader()
+		if err != nil {
+			return err
+		}
+		res := SearchResult{
+			Repo:   repo,
+			Path:   f.Path,
+			Commit: idx.Commit,
+		}
+		s := bufio.NewScanner(rc)
+		s.Buffer(nil, searchMaxFileSize)
+		for line := 1; s.Scan(); line++ {
+			if !bytes.Contains(bytes.ToLower(s.Bytes()), q) {
+				continue
+			}
+			if len(res.Matches) >= searchMaxLines {
+				break
+			}
+			text := s.Text()
+			if len(text) > searchMaxLineLength {
+				text = text[:searchMaxLineLength]
+			}
+			res.Matches = append(res.Matches, SearchMatch{Line: line, Text: text})
+		}
+		rc.Close()
+		if len(res.Matches) > 0 {
+			results.Results = append(results.Results, res)
+		}
+	}
+	return nil
+}
+
+// Search looks for q in every repo user, with the claimed groups, has web
+// access to, or just in repo if it's given. Queries too short to narrow
+// down with the index are refused.
+func (gs *gitServe) Search(user string, groups []string, q string, repo string) (*SearchResults, error) {
+	results := &SearchResults{
+		Query:   q,
+		Results: []SearchResult{},
+	}
+	if q == "" {
+		return results, nil
+	}
+	if len(q) < searchMinQuery {
+		return results, errSearchQueryTooShort
+	}
+	repos := []string{}
+	for name, rc := range gs.getConfig().Repos {
+		if (repo == "" || repo == name) && gs.hasAccess(rc, user, groups, "web") {
+			repos = append(repos, name)
+		}
+	}
+	sort.Strings(repos)
+	lq := bytes.ToLower([]byte(q))
+	for _, name := range repos {
+		err := gs.searchRepo(name, lq, results)
+		if err != nil {
+			log.Println("search error", name, err)
+		}
+		if results.Truncated {
+			break
+		}
+	}
+	return results, nil
+}
+
+func (gs *gitServe) searchPage(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	rw := &metricsWriter{ResponseWriter: w, code: 200}
+	defer func() {
+		metrics.observeRequest("web/search", rw.code, start)
+	}()
+
+	user, groups, ok := gs.authenticate(req)
+	if !ok {
+		rw.Header().Set("WWW-Authenticate", "Basic")
+		http.Error(rw, "unauthorized", 401)
+		return
+	}
+	q := strings.TrimSpace(req.FormValue("q"))
+	repo := req.FormValue("repo")
+	results, err := gs.Search(user, groups, q, repo)
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+		rw.WriteHeader(400)
+	}
+	err = gs.tmpl.Render("search.html", struct {
+		User    string
+		Repo    string
+		Results *SearchResults
+		Error   string
+	}{
+		User:    user,
+		Repo:    repo,
+		Results: results,
+		Error:   msg,
+	}, rw)
+	if err != nil {
+		log.Println(err)
+	}
+}
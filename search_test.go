@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	tr := newTestRepo(t)
+	tr.branch("master", tr.commit("init", map[string]string{
+		"main.go":   "package main\n\nfunc needle() {}\n",
+		"README.md": "nothing to see\n",
+	}))
+	gs := newTestServer(&Config{Repos: map[string]*RepoConfig{"repo": {Users: public}}}, map[string]*testRepo{"repo": tr})
+	client, f := newFakeS3(t)
+	gs.s3 = client
+
+	err := gs.buildSearchIndex("repo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := f.keys(searchIndexPath("repo")); len(keys) != 1 {
+		t.Fatalf("index not stored: %v", keys)
+	}
+
+	results, err := gs.Search("nobody", nil, "Needle", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results.Results) != 1 || results.Results[0].Path != "main.go" {
+		t.Errorf("got %+v", results.Results)
+	}
+
+	for _, q := range []string{"a", "ne"} {
+		_, err := gs.Search("nobody", nil, q, "")
+		if err != errSearchQueryTooShort {
+			t.Errorf("%q: got %v", q, err)
+		}
+		rr := get(http.HandlerFunc(gs.searchPage), "/search?q="+q)
+		if rr.Code != 400 {
+			t.Errorf("%q: search page got %d", q, rr.Code)
+		}
+		rr = get(http.HandlerFunc(gs.api), "/api/v1/search?q="+q)
+		if rr.Code != 400 {
+			t.Errorf("%q: api got %d", q, rr.Code)
+		}
+	}
+	rr := get(http.HandlerFunc(gs.searchPage), "/search?q=needle")
+	if rr.Code != 200 || !strings.Contains(rr.Body.String(), "main.go") {
+		t.Errorf("search page got %d:\n%s", rr.Code, rr.Body)
+	}
+}
+
+func TestSearchIndexCache(t *testing.T) {
+	idx := func(files int) *searchIndex {
+		x := &searchIndex{Trigrams: map[uint32][]uint32{}}
+		for i := 0; i < files; i++ {
+			x.Files = append(x.Files, searchFile{Path: "f", Hash: "h"})
+		}
+		return x
+	}
+	one := idx(1).size()
+	old := searchCacheSize
+	searchCacheSize = 3 * one
+	t.Cleanup(func() { searchCacheSize = old })
+
+	c := &searchIndexCache{}
+	c.add("a", idx(1))
+	c.add("b", idx(1))
+	c.add("c", idx(1))
+	c.get("a")
+	c.add("d", idx(1))
+	for repo, want := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		if _, ok := c.get(repo); ok != want {
+			t.Errorf("%s cached: %v, want %v", repo, ok, want)
+		}
+	}
+	c.add("big", idx(10))
+	if _, ok := c.get("big"); ok || c.size > searchCacheSize {
+		t.Errorf("index bigger than the cache was kept, size %d", c.size)
+	}
+}
+
+func TestSearchConfigOnlyRepo(t *testing.T) {
+	gs := newTestServer(&Config{Repos: map[string]*RepoConfig{"ghost": {Users: public}}}, nil)
+	client, f := newFakeS3(t)
+	gs.s3 = client
+
+	err := gs.buildSearchIndex("ghost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	results, err := gs.Search("nobody", nil, "needle", "")
+	if err != nil || len(results.Results) != 0 {
+		t.Errorf("got %+v, %v", results, err)
+	}
+	if keys := f.keys(""); len(keys) != 0 {
+		t.Errorf("searching created objects: %v", keys)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// serverConfig controls how gitserve listens, read from the environment:
+//
+//	LISTEN_ADDR       address to listen on, default :8080
+//	TLS_CERT_FILE     certificate to serve TLS with, along with TLS_KEY_FILE
+//	TLS_KEY_FILE
+//	READ_TIMEOUT      maximum time to read a request, including a pushed pack
+//	WRITE_TIMEOUT     maximum time to write a response, including a fetched pack
+//	SHUTDOWN_TIMEOUT  how long to wait for in-flight requests on SIGTERM
+type serverConfig struct {
+	Addr            string
+	CertFile        string
+	KeyFile         string
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	ShutdownTimeout time.Duration
+}
+
+func envDuration(name string, def time.Duration) time.Duration {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Fatalf("Could not parse %s: %s", name, err)
+	}
+	return d
+}
+
+func loadServerConfig() *serverConfig {
+	sc := &serverConfig{
+		Addr:     os.Getenv("LISTEN_ADDR"),
+		CertFile: os.Getenv("TLS_CERT_FILE"),
+		KeyFile:  os.Getenv("TLS_KEY_FILE"),
+
+		// Git transfers of large repos over slow links take a long time,
+		// so these are generous; they mostly exist to reap dead clients.
+		ReadTimeout:     envDuration("READ_TIMEOUT", time.Hour),
+		WriteTimeout:    envDuration("WRITE_TIMEOUT", time.Hour),
+		ShutdownTimeout: envDuration("SHUTDOWN_TIMEOUT", 10*time.Minute),
+	}
+	if sc.Addr == "" {
+		sc.Addr = ":8080"
+	}
+	if (sc.CertFile == "") != (sc.KeyFile == "") {
+		log.Fatal("TLS_CERT_FILE and TLS_KEY_FILE must be set together.")
+	}
+	return sc
+}
+
+// serve runs the HTTP server until it receives SIGTERM or SIGINT, then stops
+// accepting connections and waits for in-flight requests and pushes to
+// finish before returning.
+func (gs *gitServe) serve(sc *serverConfig, h http.Handler) error {
+	srv := &http.Server{
+		Addr:              sc.Addr,
+		Handler:           h,
+		ReadHeaderTimeout: 30 * time.Second,
+		ReadTimeout:       sc.ReadTimeout,
+		WriteTimeout:      sc.WriteTimeout,
+		IdleTimeout:       2 * time.Minute,
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		log.Println("listening on", sc.Addr)
+		if sc.CertFile != "" {
+			errs <- srv.ListenAndServeTLS(sc.CertFile, sc.KeyFile)
+		} else {
+			errs <- srv.ListenAndServe()
+		}
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-sigs:
+		log.Println("received", sig, "- draining")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sc.ShutdownTimeout)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	if err != nil {
+		log.Println("shutdown error", err)
+	}
+
+	// pushes finish their post-receive work after the response is sent
+	done := make(chan struct{})
+	go func() {
+		gs.pushes.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Println("gave up waiting for pushes to finish")
+	}
+
+	if gs.auditLog != nil {
+		gs.auditLog.Flush()
+	}
+	return nil
+}
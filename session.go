@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCookie = "gitserve_session"
+	loginCookie   = "gitserve_login"
+)
+
+// session is a web UI login. Sessions are kept in memory, so they don't
+// survive a restart; the cookie only carries the session ID and a signature
+// over it.
+type session struct {
+	ID   string
+	User string
+	// Groups are claimed by the OIDC login that started the session.
+	Groups  []string
+	CSRF    string
+	Expires time.Time
+}
+
+type sessions struct {
+	key []byte
+	ttl time.Duration
+
+	mu sync.Mutex
+	m  map[string]*session
+}
+
+func randomToken(n int) string {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// newSessions creates a session store signing cookies with key. An empty key
+// is replaced with a random one, which logs everyone out on restart.
+func newSessions(key string, ttl time.Duration) *sessions {
+	if key == "" {
+		key = randomToken(32)
+	}
+	return &sessions{
+		key: []byte(key),
+		ttl: ttl,
+		m:   map[string]*session{},
+	}
+}
+
+func (ss *sessions) sign(id string) string {
+	mac := hmac.New(sha256.New, ss.key)
+	mac.Write([]byte(id))
+	return id + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// create starts a new session for user, dropping any that have expired.
+func (ss *sessions) create(user string, groups []string) *session {
+	s := &session{
+		ID:      randomToken(24),
+		User:    user,
+		Groups:  groups,
+		CSRF:    randomToken(24),
+		Expires: time.Now().Add(ss.ttl),
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	for id, old := range ss.m {
+		if time.Now().After(old.Expires) {
+			delete(ss.m, id)
+		}
+	}
+	ss.m[s.ID] = s
+	return s
+}
+
+// verify returns the ID in a value made by sign, if the signature is good.
+func (ss *sessions) verify(value string) (string, bool) {
+	i := strings.IndexByte(value, '.')
+	if i < 0 || !hmac.Equal([]byte(value), []byte(ss.sign(value[:i]))) {
+		return "", false
+	}
+	return value[:i], true
+}
+
+// get returns the live session req's cookie refers to, or nil.
+func (ss *sessions) get(req *http.Request) *session {
+	c, err := req.Cookie(sessionCookie)
+	if err != nil {
+		return nil
+	}
+	id, ok := ss.verify(c.Value)
+	if !ok {
+		return nil
+	}
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	s, ok := ss.m[id]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(s.Expires) {
+		delete(ss.m, s.ID)
+		return nil
+	}
+	return s
+}
+
+func (ss *sessions) remove(s *session) {
+	ss.mu.Lock()
+	delete(ss.m, s.ID)
+	ss.mu.Unlock()
+}
+
+func (ss *sessions) setCookie(rw http.ResponseWriter, req *http.Request, s *session) {
+	http.SetCookie(rw, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    ss.sign(s.ID),
+		Path:     "/",
+		Expires:  s.Expires,
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+func clearSessionCookie(rw http.ResponseWriter, req *http.Request) {
+	http.SetCookie(rw, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// loginToken returns the CSRF token for the login form, setting a cookie
+// carrying it if req doesn't already have one. There's no session to keep
+// the token in before logging in, so the form has to send back the same
+// token as the cookie, which other sites can't read or set.
+func (ss *sessions) loginToken(rw http.ResponseWriter, req *http.Request) string {
+	if c, err := req.Cookie(loginCookie); err == nil {
+		if token, ok := ss.verify(c.Value); ok {
+			return token
+		}
+	}
+	token := randomToken(24)
+	http.SetCookie(rw, &http.Cookie{
+		Name:     loginCookie,
+		Value:    ss.sign(token),
+		Path:     "/login",
+		HttpOnly: true,
+		Secure:   req.TLS != nil,
+		SameSite: http.SameSiteStrictMode,
+	})
+	return token
+}
+
+// checkLoginToken reports whether a login form post carries the token from
+// its login cookie.
+func (ss *sessions) checkLoginToken(req *http.Request) bool {
+	c, err := req.Cookie(loginCookie)
+	if err != nil {
+		return false
+	}
+	token, ok := ss.verify(c.Value)
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(req.PostFormValue("csrf_token"))) == 1
+}
+
+// safeMethod reports whether method can't change anything, and so doesn't
+// need a CSRF token.
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// checkCSRF reports whether req carries s's CSRF token, either as the
+// csrf_token form value or the X-CSRF-Token header.
+func (s *session) checkCSRF(req *http.Request) bool {
+	token := req.Header.Get("X-CSRF-Token")
+	if token == "" {
+		token = req.FormValue("csrf_token")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.CSRF)) == 1
+}
+
+// sessionUser returns the user logged in with req's session cookie. Mutating
+// requests without the session's CSRF token don't count as logged in.
+func (gs *gitServe) sessionUser(req *http.Request) (*session, bool) {
+	s := gs.sessions.get(req)
+	if s == nil {
+		return nil, false
+	}
+	if !gs.knownUser(s.User) {
+		gs.sessions.remove(s)
+		return nil, false
+	}
+	if !safeMethod(req.Method) && !s.checkCSRF(req) {
+		return s, false
+	}
+	return s, true
+}
+
+// loginRedirect sends anonymous web visitors to the login page, coming back
+// to the page they asked for afterwards.
+func loginRedirect(rw http.ResponseWriter, req *http.Request) {
+	http.Redirect(rw, req, "/login?next="+url.QueryEscape(req.URL.RequestURI()), http.StatusSeeOther)
+}
+
+// localRedirect only allows redirects to paths on this server, so the login
+// form can't be used to bounce users elsewhere.
+func localRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+func (gs *gitServe) renderLogin(rw http.ResponseWriter, req *http.Request, next string, user string, msg string, code int) {
+	token := gs.sessions.loginToken(rw, req)
+	rw.WriteHeader(code)
+	err := gs.tmpl.Render("login.html", struct {
+		Next  string
+		User  string
+		Error string
+		OIDC  bool
+		CSRF  string
+	}{
+		Next:  next,
+		User:  user,
+		Error: msg,
+		OIDC:  gs.getConfig().OIDC != nil,
+		CSRF:  token,
+	}, rw)
+	if err != nil {
+		log.Println(err)
+	}
+}
+
+func (gs *gitServe) login(rw http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	mw := &metricsWriter{ResponseWriter: rw, code: 200}
+	defer func() {
+		metrics.observeRequest("web/login", mw.code, start)
+	}()
+
+	next := localRedirect(req.FormValue("next"))
+	if req.Method != http.MethodPost {
+		gs.renderLogin(mw, req, next, "", "", 200)
+		return
+	}
+	if !gs.sessions.checkLoginToken(req) {
+		gs.renderLogin(mw, req, next, "", "Your login form expired, please try again.", http.StatusForbidden)
+		return
+	}
+
+	user := req.PostFormValue("user")
+	ok := gs.checkPassword(user, req.PostFormValue("password"))
+	gs.audit(req, &AuditEvent{
+		Action:  "login",
+		User:    user,
+		Success: ok,
+		Detail:  "web",
+	})
+	if !ok {
+		gs.renderLogin(mw, req, next, user, "Incorrect username or password.", http.StatusUnauthorized)
+		return
+	}
+	if old := gs.sessions.get(req); old != nil {
+		gs.sessions.remove(old)
+	}
+	gs.sessions.setCookie(mw, req, gs.sessions.create(user, nil))
+	http.Redirect(mw, req, next, http.StatusSeeOther)
+}
+
+// logout ends the current session. It has to be a POST carrying the CSRF
+// token, so other sites can't log users out.
+func (gs *gitServe) logout(rw http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	mw := &metricsWriter{ResponseWriter: rw, code: 200}
+	defer func() {
+		metrics.observeRequest("web/logout", mw.code, start)
+	}()
+
+	if req.Method != http.MethodPost {
+		mw.Header().Set("Allow", http.MethodPost)
+		http.Error(mw, "method not allowed", 405)
+		return
+	}
+	s, ok := gs.sessionUser(req)
+	if s != nil && !ok {
+		http.Error(mw, "invalid csrf token", 403)
+		return
+	}
+	if s != nil {
+		gs.sessions.remove(s)
+		gs.audit(req, &AuditEvent{
+			Action:  "logout",
+			User:    s.User,
+			Success: true,
+		})
+	}
+	clearSessionCookie(mw, req)
+	http.Redirect(mw, req, "/", http.StatusSeeOther)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var csrfField = regexp.MustCompile(`name="csrf_token" value="([^"]*)"`)
+
+// postLogin logs in through the login form, as a browser would.
+func postLogin(gs *gitServe, user string, pass string) *httptest.ResponseRecorder {
+	rr := get(http.HandlerFunc(gs.login), "/login")
+	m := csrfField.FindStringSubmatch(rr.Body.String())
+	if m == nil {
+		return rr
+	}
+	form := url.Values{"user": {user}, "password": {pass}, "csrf_token": {m[1]}}
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	for _, c := range rr.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	rr = httptest.NewRecorder()
+	gs.login(rr, req)
+	return rr
+}
+
+func cookie(rr *httptest.ResponseRecorder, name string) *http.Cookie {
+	for _, c := range rr.Result().Cookies() {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func TestSessionCookie(t *testing.T) {
+	ss := newSessions("key", time.Hour)
+	s := ss.create("alice", nil)
+	withCookie := func(value string) *http.Request {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookie, Value: value})
+		return req
+	}
+	if got := ss.get(withCookie(ss.sign(s.ID))); got != s {
+		t.Errorf("signed cookie: got %v", got)
+	}
+	if got := ss.get(withCookie(s.ID + ".forged")); got != nil {
+		t.Errorf("forged signature: got %v", got)
+	}
+	if got := ss.get(withCookie(newSessions("other", time.Hour).sign(s.ID))); got != nil {
+		t.Errorf("signed with another key: got %v", got)
+	}
+
+	s.Expires = time.Now().Add(-time.Second)
+	if got := ss.get(withCookie(ss.sign(s.ID))); got != nil {
+		t.Errorf("expired session: got %v", got)
+	}
+}
+
+func TestSessionCSRF(t *testing.T) {
+	gs := newTestServer(&Config{Users: map[string]*User{"alice": {}}}, nil)
+	s := gs.sessions.create("alice", nil)
+	tests := []struct {
+		method, header, form string
+		ok                   bool
+	}{
+		{"GET", "", "", true},
+		{"POST", "", "", false},
+		{"POST", "wrong", "", false},
+		{"POST", s.CSRF, "", true},
+		{"POST", "", s.CSRF, true},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, "/", strings.NewReader(url.Values{"csrf_token": {test.form}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&http.Cookie{Name: sessionCookie, Value: gs.sessions.sign(s.ID)})
+		if test.header != "" {
+			req.Header.Set("X-CSRF-Token", test.header)
+		}
+		if _, ok := gs.sessionUser(req); ok != test.ok {
+			t.Errorf("%s header %q form %q: got %v, want %v", test.method, test.header, test.form, ok, test.ok)
+		}
+	}
+}
+
+func TestLoginCSRF(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gs := newTestServer(&Config{Users: map[string]*User{"alice": {Password: hash}}}, nil)
+
+	rr := postLogin(gs, "alice", "hunter2")
+	if rr.Code != http.StatusSeeOther || cookie(rr, sessionCookie) == nil {
+		t.Fatalf("login: got %d", rr.Code)
+	}
+
+	// a form posted from another site has neither the cookie nor its token
+	form := url.Values{"user": {"alice"}, "password": {"hunter2"}, "csrf_token": {"guess"}}
+	req := httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rr = httptest.NewRecorder()
+	gs.login(rr, req)
+	if rr.Code != http.StatusForbidden || cookie(rr, sessionCookie) != nil {
+		t.Errorf("login without token: got %d", rr.Code)
+	}
+
+	// nor can it reuse a token without the cookie it belongs to
+	token := gs.sessions.loginToken(httptest.NewRecorder(), httptest.NewRequest("GET", "/login", nil))
+	form.Set("csrf_token", token)
+	req = httptest.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&http.Cookie{Name: loginCookie, Value: gs.sessions.sign("other")})
+	rr = httptest.NewRecorder()
+	gs.login(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("login with another cookie's token: got %d", rr.Code)
+	}
+}
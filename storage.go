@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"path"
 	"strings"
+	"time"
 
 	"github.com/andyleap/go-s3"
 	"github.com/go-git/go-git/v5/config"
@@ -59,19 +60,25 @@ func (s *S3Storage) SetEncodedObject(p plumbing.EncodedObject) (plumbing.Hash, e
 	}
 	hdrs := &http.Header{}
 	hdrs.Set("Content-Type", "application/x-git-"+p.Type().String())
-	upload, err := s.s3.NewUpload(s.ObjectPath(p.Hash()), hdrs)
+	start := time.Now()
+	err = s.upload(s.ObjectPath(p.Hash()), buf.Bytes(), hdrs)
+	metrics.observeS3("upload", start, err)
 	if err != nil {
 		return plumbing.ZeroHash, err
 	}
-	err = upload.Write(buf.Bytes())
+	return ow.Hash(), nil
+}
+
+func (s *S3Storage) upload(key string, buf []byte, hdrs *http.Header) error {
+	upload, err := s.s3.NewUpload(key, hdrs)
 	if err != nil {
-		return plumbing.ZeroHash, err
+		return err
 	}
-	err = upload.Done()
+	err = upload.Write(buf)
 	if err != nil {
-		return plumbing.ZeroHash, err
+		return err
 	}
-	return ow.Hash(), nil
+	return upload.Done()
 }
 
 // EncodedObject gets an object by hash with the given
@@ -83,7 +90,9 @@ func (s *S3Storage) SetEncodedObject(p plumbing.EncodedObject) (plumbing.Hash, e
 // TreeObject and AnyObject. If plumbing.AnyObject is given, the object must
 // be looked up regardless of its type.
 func (s *S3Storage) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumbing.EncodedObject, error) {
+	start := time.Now()
 	r, err := s.s3.Get(s.ObjectPath(h))
+	metrics.observeS3("get", start, err)
 	if err != nil {
 		if s3err, ok := err.(s3.Error); ok && s3err.Code == "NoSuchKey" {
 			return nil, plumbing.ErrObjectNotFound
@@ -113,14 +122,57 @@ func (s *S3Storage) EncodedObject(t plumbing.ObjectType, h plumbing.Hash) (plumb
 // on the storage.
 //
 // Valid plumbing.ObjectType values are CommitObject, BlobObject, TagObject,
+//
+// Objects are listed from S3 and fetched one at a time, so this is slow on
+// big repos; nothing serving requests should need it.
 func (s *S3Storage) IterEncodedObjects(t plumbing.ObjectType) (storer.EncodedObjectIter, error) {
-	panic("not implemented")
+	start := time.Now()
+	objs, err := s.s3.List(path.Join(s.base, "obj") + "/")
+	metrics.observeS3("list", start, err)
+	if err != nil {
+		return nil, err
+	}
+	return &EncodedObjectIter{
+		s:    s,
+		t:    t,
+		objs: objs,
+	}, nil
+}
+
+type EncodedObjectIter struct {
+	s    *S3Storage
+	t    plumbing.ObjectType
+	objs []s3.Object
+}
+
+func (oi *EncodedObjectIter) Next() (plumbing.EncodedObject, error) {
+	for len(oi.objs) > 0 {
+		h := plumbing.NewHash(path.Base(oi.objs[0].Key))
+		oi.objs = oi.objs[1:]
+		obj, err := oi.s.EncodedObject(oi.t, h)
+		if err == plumbing.ErrObjectNotFound {
+			continue
+		}
+		return obj, err
+	}
+	return nil, io.EOF
+}
+
+func (oi *EncodedObjectIter) ForEach(cb func(plumbing.EncodedObject) error) error {
+	return storer.ForEachIterator(oi, cb)
+}
+
+func (oi *EncodedObjectIter) Close() {
 }
 
 // HasEncodedObject returns ErrObjNotFound if the object doesn't
 // exist.  If the object does exist, it returns nil.
 func (s *S3Storage) HasEncodedObject(h plumbing.Hash) error {
+	start := time.Now()
 	_, err := s.s3.Head(s.ObjectPath(h))
+	// a failed HEAD carries no error body, so misses can't be told apart
+	// from failures; don't count them as errors.
+	metrics.observeS3("head", start, nil)
 	if err != nil {
 		return plumbing.ErrObjectNotFound
 	}
@@ -128,7 +180,9 @@ func (s *S3Storage) HasEncodedObject(h plumbing.Hash) error {
 }
 
 func (s *S3Storage) EncodedObjectSize(h plumbing.Hash) (int64, error) {
+	start := time.Now()
 	o, err := s.s3.Head(s.ObjectPath(h))
+	metrics.observeS3("head", start, nil)
 	if err != nil {
 		return 0, plumbing.ErrObjectNotFound
 	}
@@ -142,7 +196,9 @@ func (s *S3Storage) RefPath(r plumbing.ReferenceName) string {
 func (s *S3Storage) SetReference(r *plumbing.Reference) error {
 	hdrs := &http.Header{}
 	hdrs.Set("Content-Type", "application/x-git-"+r.Type().String())
+	start := time.Now()
 	err := s.s3.Put(s.RefPath(r.Name()), []byte(r.String()), hdrs)
+	metrics.observeS3("put", start, err)
 	if err != nil {
 		log.Println(err)
 	}
@@ -154,6 +210,9 @@ func (s *S3Storage) SetReference(r *plumbing.Reference) error {
 // `old.Name()` matches the given reference value in `old`.  If
 // not, it returns an error and doesn't update `new`.
 func (s *S3Storage) CheckAndSetReference(new *plumbing.Reference, old *plumbing.Reference) error {
+	if old == nil {
+		return s.SetReference(new)
+	}
 	oldref, err := s.Reference(old.Name())
 	if err != nil {
 		log.Println("check and set error", err)
@@ -167,10 +226,15 @@ func (s *S3Storage) CheckAndSetReference(new *plumbing.Reference, old *plumbing.
 }
 
 func (s *S3Storage) Reference(rname plumbing.ReferenceName) (*plumbing.Reference, error) {
+	start := time.Now()
 	r, err := s.s3.Get(s.RefPath(rname))
+	metrics.observeS3("get", start, err)
 	if err != nil {
+		if s3err, ok := err.(s3.Error); ok && s3err.Code == "NoSuchKey" {
+			return nil, plumbing.ErrReferenceNotFound
+		}
 		log.Println("reference error", err)
-		return nil, plumbing.ErrReferenceNotFound
+		return nil, err
 	}
 	buf, err := ioutil.ReadAll(r)
 	if err != nil {
@@ -193,10 +257,12 @@ type ReferenceIter struct {
 
 func (ri *ReferenceIter) Next() (*plumbing.Reference, error) {
 	o, err := ri.li.Next()
-	if err == io.EOF {
-		return nil, io.EOF
+	if err != nil {
+		return nil, err
 	}
+	start := time.Now()
 	r, err := ri.s.s3.Get(o.Key)
+	metrics.observeS3("get", start, err)
 	if err != nil {
 		return nil, err
 	}
@@ -244,7 +310,10 @@ func (s *S3Storage) IterReferences() (storer.ReferenceIter, error) {
 }
 
 func (s *S3Storage) RemoveReference(r plumbing.ReferenceName) error {
-	return s.s3.Delete(s.RefPath(r))
+	start := time.Now()
+	err := s.s3.Delete(s.RefPath(r))
+	metrics.observeS3("delete", start, err)
+	return err
 }
 
 func (s *S3Storage) CountLooseRefs() (int, error) {
@@ -255,12 +324,16 @@ func (s *S3Storage) PackRefs() error {
 	return nil
 }
 
-func (s *S3Storage) SetShallow(_ []plumbing.Hash) error {
-	panic("not implemented") // TODO: Implement
+func (s *S3Storage) SetShallow(h []plumbing.Hash) error {
+	if len(h) == 0 {
+		return nil
+	}
+	return fmt.Errorf("shallow repositories are not supported")
 }
 
+// Shallow always returns no commits, as repos are never shallow.
 func (s *S3Storage) Shallow() ([]plumbing.Hash, error) {
-	panic("not implemented") // TODO: Implement
+	return nil, nil
 }
 
 func (s *S3Storage) SetIndex(_ *index.Index) error {
@@ -272,7 +345,9 @@ func (s *S3Storage) Index() (*index.Index, error) {
 }
 
 func (s *S3Storage) Config() (*config.Config, error) {
+	start := time.Now()
 	r, err := s.s3.Get(path.Join(s.base, "config"))
+	metrics.observeS3("get", start, err)
 	if err != nil {
 		if s3err, ok := err.(s3.Error); ok && s3err.Code == "NoSuchKey" {
 			return config.NewConfig(), nil
@@ -296,7 +371,9 @@ func (s *S3Storage) SetConfig(c *config.Config) error {
 	if err != nil {
 		return err
 	}
+	start := time.Now()
 	err = s.s3.Put(path.Join(s.base, "config"), buf, nil)
+	metrics.observeS3("put", start, err)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+)
+
+// Webhook is an outbound HTTP hook configured on a repo.
+type Webhook struct {
+	URL    string
+	Secret string
+
+	// Events limits the hook to "push" (branch updates) and/or "tag" (tag
+	// updates). An empty list receives everything.
+	Events []string
+}
+
+func (wh *Webhook) wants(event string) bool {
+	if len(wh.Events) == 0 {
+		return true
+	}
+	for _, e := range wh.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+type PushRef struct {
+	Ref    string `json:"ref"`
+	Before string `json:"before"`
+	After  string `json:"after"`
+}
+
+type PushCommit struct {
+	ID        string       `json:"id"`
+	Message   string       `json:"message"`
+	Author    apiSignature `json:"author"`
+	Committer apiSignature `json:"committer"`
+}
+
+// PushPayload is the body POSTed to webhooks after a push.
+type PushPayload struct {
+	Event   string       `json:"event"`
+	Repo    string       `json:"repository"`
+	Pusher  string       `json:"pusher"`
+	Refs    []PushRef    `json:"refs"`
+	Commits []PushCommit `json:"commits"`
+}
+
+type DeliveryAttempt struct {
+	Time       time.Time
+	Duration   time.Duration
+	StatusCode int
+	Error      string `json:",omitempty"`
+}
+
+// Delivery records a payload sent to a webhook and every attempt to send it.
+type Delivery struct {
+	ID        string
+	Repo      string
+	URL       string
+	Event     string
+	Payload   json.RawMessage
+	Delivered bool
+	Attempts  []DeliveryAttempt
+}
+
+const (
+	webhookAttempts   = 5
+	webhookMaxCommits = 20
+	// webhookWorkers is how many deliveries are sent at once, and
+	// webhookQueueSize how many more may wait for a worker before new ones
+	// are dropped.
+	webhookWorkers   = 4
+	webhookQueueSize = 1000
+	// deliveriesMax is the most deliveries listed at once.
+	deliveriesMax = 100
+)
+
+var webhookClient = &http.Client{
+	Timeout: 30 * time.Second,
+}
+
+// webhookBackoff is how long to wait before retry n (starting at 1).
+func webhookBackoff(n int) time.Duration {
+	return time.Duration(1<<uint(n-1)) * time.Second
+}
+
+// deliveriesPrefix is where the delivery log of repo is kept. It's under
+// metaPrefix so it can't collide with a repo named <repo>/webhooks.
+func deliveriesPrefix(repo string) string {
+	return path.Join(metaPrefix, "webhooks", repo) + "/"
+}
+
+func deliveryPath(repo string, id string) string {
+	return deliveriesPrefix(repo) + id + ".json"
+}
+
+func newDeliveryID() string {
+	b := make([]byte, 4)
+	rand.Read(b)
+	return fmt.Sprintf("%d-%s", time.Now().UnixNano(), hex.EncodeToString(b))
+}
+
+// pushCommits lists the commits reachable from newHash but not from any of
+// bases, newest first.
+func pushCommits(r *git.Repository, newHash plumbing.Hash, bases []plumbing.Hash, max int) ([]PushCommit, error) {
+	commits := []PushCommit{}
+	if newHash.IsZero() {
+		return commits, nil
+	}
+	cs, err := newCommits(r, newHash, bases, max)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range cs {
+		commits = append(commits, PushCommit{
+			ID:        c.Hash.String(),
+			Message:   c.Message,
+			Author:    apiSig(c.Author),
+			Committer: apiSig(c.Committer),
+		})
+	}
+	return commits, nil
+}
+
+// pushBases are the commits a new branch's commits are counted from: the
+// targets of every ref the push didn't touch and the old targets of those it
+// did.
+func pushBases(r *git.Repository, cmds []*packp.Command) ([]plumbing.Hash, error) {
+	pushed := map[plumbing.ReferenceName]bool{}
+	bases := []plumbing.Hash{}
+	for _, cmd := range cmds {
+		pushed[cmd.Name] = true
+		if !cmd.Old.IsZero() {
+			bases = append(bases, cmd.Old)
+		}
+	}
+	refs, err := r.References()
+	if err != nil {
+		return nil, err
+	}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Type() != plumbing.HashReference || pushed[ref.Name()] {
+			return nil
+		}
+		h := ref.Hash()
+		if t, err := r.TagObject(h); err == nil {
+			if t.TargetType != plumbing.CommitObject {
+				return nil
+			}
+			h = t.Target
+		}
+		bases = append(bases, h)
+		return nil
+	})
+	return bases, err
+}
+
+// pushPayloads builds one payload per event type touched by cmds.
+func pushPayloads(r *git.Repository, repo string, pusher string, cmds []*packp.Command) map[string]*PushPayload {
+	payloads := map[string]*PushPayload{}
+	var newBases []plumbing.Hash
+	for _, cmd := range cmds {
+		event := "push"
+		if cmd.Name.IsTag() {
+			event = "tag"
+		}
+		pp, ok := payloads[event]
+		if !ok {
+			pp = &PushPayload{
+				Event:   event,
+				Repo:    repo,
+				Pusher:  pusher,
+				Refs:    []PushRef{},
+				Commits: []PushCommit{},
+			}
+			payloads[event] = pp
+		}
+		pp.Refs = append(pp.Refs, pushRefs([]*packp.Command{cmd})...)
+		if event != "push" {
+			continue
+		}
+		bases := []plumbing.Hash{cmd.Old}
+		if cmd.Old.IsZero() {
+			if newBases == nil {
+				var err error
+				newBases, err = pushBases(r, cmds)
+				if err != nil {
+					log.Println("webhook commit walk error", err)
+					continue
+				}
+			}
+			bases = newBases
+		}
+		commits, err := pushCommits(r, cmd.New, bases, webhookMaxCommits-len(pp.Commits))
+		if err != nil {
+			log.Println("webhook commit walk error", err)
+			continue
+		}
+		pp.Commits = append(pp.Commits, commits...)
+	}
+	return payloads
+}
+
+// fireWebhooks queues deliveries for every webhook on repo interested in the
+// pushed ref updates.
+func (gs *gitServe) fireWebhooks(r *git.Repository, repo string, pusher string, cmds []*packp.Command) {
+	rc := gs.getConfig().Repos[repo]
+	if rc == nil || len(rc.Webhooks) == 0 {
+		return
+	}
+	for event, pp := range pushPayloads(r, repo, pusher, cmds) {
+		body, err := json.Marshal(pp)
+		if err != nil {
+			log.Println("webhook payload error", err)
+			continue
+		}
+		for _, wh := range rc.Webhooks {
+			if !wh.wants(event) {
+				continue
+			}
+			d := &Delivery{
+				ID:      newDeliveryID(),
+				Repo:    repo,
+				URL:     wh.URL,
+				Event:   event,
+				Payload: body,
+			}
+			gs.queueDelivery(d, wh.Secret)
+		}
+	}
+}
+
+type webhookJob struct {
+	d      *Delivery
+	secret string
+}
+
+// webhookQueue feeds deliveries to a fixed pool of workers, started by the
+// first delivery, so a burst of pushes can't start any number of
+// goroutines. Retries wait on a timer rather than holding a worker.
+type webhookQueue struct {
+	once sync.Once
+	jobs chan webhookJob
+}
+
+// queueDelivery hands d to a worker to send. If the queue is full the
+// delivery is logged as failed instead.
+func (gs *gitServe) queueDelivery(d *Delivery, secret string) {
+	gs.hooks.once.Do(func() {
+		gs.hooks.jobs = make(chan webhookJob, webhookQueueSize)
+		for i := 0; i < webhookWorkers; i++ {
+			go func() {
+				for job := range gs.hooks.jobs {
+					gs.deliver(job.d, job.secret)
+				}
+			}()
+		}
+	})
+	select {
+	case gs.hooks.jobs <- webhookJob{d: d, secret: secret}:
+	default:
+		log.Println("webhook queue full, dropping delivery", d.Repo, d.URL)
+		d.Attempts = append(d.Attempts, DeliveryAttempt{Time: time.Now(), Error: "delivery queue full"})
+		err := gs.saveDelivery(d)
+		if err != nil {
+			log.Println("webhook log error", err)
+		}
+	}
+}
+
+// deliver makes an attempt to send d and records it in the delivery log.
+// Failed attempts are queued again with exponential backoff.
+func (gs *gitServe) deliver(d *Delivery, secret string) {
+	a := sendWebhook(d, secret)
+	d.Attempts = append(d.Attempts, a)
+	d.Delivered = a.Error == "" && a.StatusCode >= 200 && a.StatusCode < 300
+	err := gs.saveDelivery(d)
+	if err != nil {
+		log.Println("webhook log error", err)
+	}
+	if d.Delivered {
+		return
+	}
+	log.Println("webhook delivery failed", d.Repo, d.URL, a.StatusCode, a.Error)
+	if n := len(d.Attempts); n < webhookAttempts {
+		time.AfterFunc(webhookBackoff(n), func() {
+			gs.queueDelivery(d, secret)
+		})
+	}
+}
+
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func sendWebhook(d *Delivery, secret string) DeliveryAttempt {
+	a := DeliveryAttempt{Time: time.Now()}
+	req, err := http.NewRequest(http.MethodPost, d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		a.Error = err.Error()
+		return a
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gitserve-hookshot")
+	req.Header.Set("X-Gitserve-Event", d.Event)
+	req.Header.Set("X-Gitserve-Delivery", d.ID)
+	if secret != "" {
+		req.Header.Set("X-Gitserve-Signature-256", signPayload(secret, d.Payload))
+	}
+	resp, err := webhookClient.Do(req)
+	a.Duration = time.Since(a.Time)
+	if err != nil {
+		a.Error = err.Error()
+		return a
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	a.StatusCode = resp.StatusCode
+	return a
+}
+
+func (gs *gitServe) saveDelivery(d *Delivery) error {
+	buf, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	hdrs := &http.Header{}
+	hdrs.Set("Content-Type", "application/json")
+	return gs.s3.Put(deliveryPath(d.Repo, d.ID), buf, hdrs)
+}
+
+func (gs *gitServe) loadDelivery(repo string, id string) (*Delivery, error) {
+	if id == "" || strings.ContainsAny(id, "/.") {
+		return nil, fmt.Errorf("bad delivery id %q", id)
+	}
+	r, err := gs.s3.Get(deliveryPath(repo, id))
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+	d := &Delivery{}
+	err = json.NewDecoder(r).Decode(d)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// listDeliveries returns up to limit deliveries from the log for repo,
+// newest first, starting after the one with ID before if it's set. IDs
+// start with their time, so they sort the same way.
+func (gs *gitServe) listDeliveries(repo string, before string, limit int) ([]*Delivery, error) {
+	prefix := deliveriesPrefix(repo)
+	start := time.Now()
+	objs, err := gs.s3.List(prefix)
+	metrics.observeS3("list", start, err)
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for _, o := range objs {
+		id := strings.TrimPrefix(o.Key, prefix)
+		// the logs of repos under this one share the prefix
+		if strings.Contains(id, "/") || !strings.HasSuffix(id, ".json") {
+			continue
+		}
+		id = strings.TrimSuffix(id, ".json")
+		if before == "" || id < before {
+			ids = append(ids, id)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+	if len(ids) > limit {
+		ids = ids[:limit]
+	}
+	ds := []*Delivery{}
+	for _, id := range ids {
+		d, err := gs.loadDelivery(repo, id)
+		if err != nil {
+			return nil, err
+		}
+		ds = append(ds, d)
+	}
+	return ds, nil
+}
+
+// redeliver sends the payload of an earlier delivery again as a new
+// delivery, using the secret currently configured for its URL.
+func (gs *gitServe) redeliver(repo string, id string) (*Delivery, error) {
+	old, err := gs.loadDelivery(repo, id)
+	if err != nil {
+		return nil, err
+	}
+	rc := gs.getConfig().Repos[repo]
+	if rc == nil {
+		return nil, fmt.Errorf("Unknown repo %s", repo)
+	}
+	for _, wh := range rc.Webhooks {
+		if wh.URL != old.URL {
+			continue
+		}
+		d := &Delivery{
+			ID:      newDeliveryID(),
+			Repo:    repo,
+			URL:     old.URL,
+			Event:   old.Event,
+			Payload: old.Payload,
+		}
+		resp := *d
+		gs.queueDelivery(d, wh.Secret)
+		return &resp, nil
+	}
+	return nil, fmt.Errorf("No webhook configured for %s", old.URL)
+}
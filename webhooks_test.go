@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/protocol/packp"
+)
+
+func commitMessages(commits []PushCommit) []string {
+	msgs := []string{}
+	for _, c := range commits {
+		msgs = append(msgs, c.Message)
+	}
+	return msgs
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestPushCommits(t *testing.T) {
+	tr := newTestRepo(t)
+	base := tr.commit("base", nil)
+	old := tr.commit("old", nil, base)
+	side1 := tr.commit("side1", nil, base)
+	side2 := tr.commit("side2", nil, side1)
+	main1 := tr.commit("main1", nil, old)
+	merge := tr.commit("merge", nil, main1, side2)
+	tr.branch("master", merge)
+	tr.branch("other", old)
+	feature := tr.commit("feature", nil, old)
+	tr.branch("feature", feature)
+
+	tests := []struct {
+		name  string
+		cmds  []*packp.Command
+		max   int
+		wants [][]string
+	}{
+		{
+			name:  "merged side branch",
+			cmds:  []*packp.Command{{Name: "refs/heads/master", Old: old, New: merge}},
+			max:   20,
+			wants: [][]string{{"merge", "main1", "side2", "side1"}},
+		},
+		{
+			name:  "limited",
+			cmds:  []*packp.Command{{Name: "refs/heads/master", Old: old, New: merge}},
+			max:   2,
+			wants: [][]string{{"merge", "main1"}},
+		},
+		{
+			name:  "new branch",
+			cmds:  []*packp.Command{{Name: "refs/heads/feature", New: feature}},
+			max:   20,
+			wants: [][]string{{"feature"}},
+		},
+		{
+			name:  "deleted",
+			cmds:  []*packp.Command{{Name: "refs/heads/feature", Old: feature}},
+			max:   20,
+			wants: [][]string{{}},
+		},
+	}
+	for _, test := range tests {
+		bases, err := pushBases(tr.r, test.cmds)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, cmd := range test.cmds {
+			b := []plumbing.Hash{cmd.Old}
+			if cmd.Old.IsZero() {
+				b = bases
+			}
+			commits, err := pushCommits(tr.r, cmd.New, b, test.max)
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if got := commitMessages(commits); !equalStrings(got, test.wants[i]) {
+				t.Errorf("%s: got %v, want %v", test.name, got, test.wants[i])
+			}
+		}
+	}
+}
+
+func TestPushPayloads(t *testing.T) {
+	tr := newTestRepo(t)
+	base := tr.commit("base", nil)
+	a := tr.commit("a", nil, base)
+	b := tr.commit("b", nil, a)
+	tr.branch("master", base)
+	tr.branch("x", a)
+	tr.branch("y", b)
+
+	// x and y are both new, so neither lists commits already on master.
+	cmds := []*packp.Command{
+		{Name: "refs/heads/x", New: a},
+		{Name: "refs/heads/y", New: b},
+		{Name: "refs/tags/v1", New: b},
+	}
+	payloads := pushPayloads(tr.r, "repo", "alice", cmds)
+	push := payloads["push"]
+	if push == nil || len(push.Refs) != 2 {
+		t.Fatalf("push payload: %+v", push)
+	}
+	if got := commitMessages(push.Commits); !equalStrings(got, []string{"a", "b", "a"}) {
+		t.Errorf("push commits: got %v", got)
+	}
+	tag := payloads["tag"]
+	if tag == nil || len(tag.Refs) != 1 || len(tag.Commits) != 0 {
+		t.Errorf("tag payload: %+v", tag)
+	}
+}
+
+func TestSendWebhookSignature(t *testing.T) {
+	var got http.Header
+	var body []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		got = req.Header
+		body, _ = ioutil.ReadAll(req.Body)
+	}))
+	defer srv.Close()
+
+	d := &Delivery{ID: "1", URL: srv.URL, Event: "push", Payload: []byte(`{"event":"push"}`)}
+	a := sendWebhook(d, "s3cret")
+	if a.Error != "" || a.StatusCode != 200 {
+		t.Fatalf("send: %+v", a)
+	}
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(body)
+	want := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if sig := got.Get("X-Gitserve-Signature-256"); sig != want {
+		t.Errorf("signature: got %q, want %q", sig, want)
+	}
+	if got.Get("X-Gitserve-Event") != "push" || got.Get("X-Gitserve-Delivery") != "1" {
+		t.Errorf("headers: %v", got)
+	}
+
+	sendWebhook(d, "")
+	if sig := got.Get("X-Gitserve-Signature-256"); sig != "" {
+		t.Errorf("unsigned delivery has signature %q", sig)
+	}
+}
+
+func TestDeliveryLog(t *testing.T) {
+	client, _ := newFakeS3(t)
+	gs := newTestServer(&Config{}, nil)
+	gs.s3 = client
+	for _, d := range []*Delivery{
+		{ID: "1-a", Repo: "repo"},
+		{ID: "2-b", Repo: "repo"},
+		{ID: "3-c", Repo: "repo"},
+		{ID: "4-d", Repo: "repo/webhooks"},
+		{ID: "5-e", Repo: "repo/sub"},
+	} {
+		err := gs.saveDelivery(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a repo named like the old log location is left alone
+	err := client.Put("repo/webhooks/ref/HEAD", []byte("ref: refs/heads/master"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := func(before string, limit int) []string {
+		ds, err := gs.listDeliveries("repo", before, limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids := []string{}
+		for _, d := range ds {
+			ids = append(ids, d.ID)
+		}
+		return ids
+	}
+	if got := ids("", 10); !equalStrings(got, []string{"3-c", "2-b", "1-a"}) {
+		t.Errorf("all: got %v", got)
+	}
+	if got := ids("", 2); !equalStrings(got, []string{"3-c", "2-b"}) {
+		t.Errorf("first page: got %v", got)
+	}
+	if got := ids("2-b", 2); !equalStrings(got, []string{"1-a"}) {
+		t.Errorf("second page: got %v", got)
+	}
+	if _, err := gs.loadDelivery("repo", "../repo/webhooks/4-d"); err == nil {
+		t.Error("loaded a delivery by path")
+	}
+}
+
+func TestWebhookQueue(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, most, calls := 0, 0, 0
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		inFlight++
+		calls++
+		if inFlight > most {
+			most = inFlight
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}))
+	defer srv.Close()
+	client, _ := newFakeS3(t)
+	gs := newTestServer(&Config{}, nil)
+	gs.s3 = client
+
+	n := webhookWorkers * 3
+	for i := 0; i < n; i++ {
+		gs.queueDelivery(&Delivery{ID: fmt.Sprint(i), Repo: "repo", URL: srv.URL}, "")
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ds, err := gs.listDeliveries("repo", "", deliveriesMax)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ds) == n || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != n {
+		t.Errorf("%d deliveries sent, want %d", calls, n)
+	}
+	if most > webhookWorkers {
+		t.Errorf("%d deliveries in flight at once", most)
+	}
+}